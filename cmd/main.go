@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"expvar"
 	"flag"
 	"io"
 	"log"
@@ -11,9 +12,14 @@ import (
 
 	"lorallabs.com/oauth-server/cmd/utils"
 	"lorallabs.com/oauth-server/internal/config"
+	"lorallabs.com/oauth-server/internal/drift"
+	"lorallabs.com/oauth-server/internal/keyring"
+	"lorallabs.com/oauth-server/internal/oauth"
 	"lorallabs.com/oauth-server/internal/oauthserver"
+	"lorallabs.com/oauth-server/internal/ratelimit"
 	"lorallabs.com/oauth-server/internal/store"
 	"lorallabs.com/oauth-server/internal/types"
+	"lorallabs.com/oauth-server/internal/upstream"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
@@ -24,19 +30,45 @@ import (
 
 func main() {
 	laxAuthFlag := flag.Bool("lax_auth", false, "accept expired or out-of-scope tokens for testing purposes")
+	rotateTokenKeysFlag := flag.Bool("rotate_token_keys", false, "re-encrypt stored provider tokens under the active key and exit")
+	generateTokenKeysFlag := flag.Bool("generate_token_keys", false, "write a new token key file to TOKEN_KEYS_FILE, unless it exists, and exit")
 	flag.Parse()
 
-	config := config.LoadConfig()
-	store, err := store.NewStore(config.DBConnectionString)
+	config, err := config.LoadConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *generateTokenKeysFlag {
+		if err := keyring.Generate(config.TokenKeysFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Wrote a new token key file to %s", config.TokenKeysFile)
+		return
+	}
+	tokenKeys, err := keyring.Load(config.TokenKeysFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store, err := store.NewStore(config.DBConnectionString, tokenKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *rotateTokenKeysFlag {
+		count, err := store.ReencryptProviderTokens(100)
+		if err != nil {
+			log.Fatalf("Re-encrypted %d provider tokens before failing: %v", count, err)
+		}
+		log.Printf("Re-encrypted %d provider tokens under key %s", count, tokenKeys.ActiveID())
+		return
+	}
 
 	// Setup CORS
 	corsWrapper := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"}, // or use "*" to allow any origin
 		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "Accept", "Accept-Language", "If-Match", "If-None-Match", "If-Modified-Since", "Range", "Prefer", "Cache-Control", "Mcp-Protocol-Version", "Mcp-Session-Id"},
+		ExposedHeaders:   []string{"ETag", "Last-Modified", "Location", "Link", "Retry-After", "Content-Range", "X-Total-Count", "X-Cache", "Age", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "WWW-Authenticate"},
 		AllowCredentials: true,
 	})
 
@@ -46,12 +78,39 @@ func main() {
 	ctx = context.WithValue(ctx, types.ConfigKey, config)
 	ctx = context.WithValue(ctx, types.StoreKey, store)
 	ctx = context.WithValue(ctx, types.LaxAuthFlag, laxAuthFlag)
-	oryClient := oauthserver.NewOryClient(ctx)
-	ctx = context.WithValue(ctx, types.OryClientKey, oryClient)
+	identity, err := oauthserver.NewIdentityProvider(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	authServer := oauthserver.NewAuthorizationServer(ctx, identity)
+	ctx = context.WithValue(ctx, types.AuthServerKey, authServer)
+	go authServer.RefreshSigningKeys(ctx)
+
+	// one pooled client per provider, shared by the execute proxy and token requests
+	upstreamClients, err := upstream.NewClients(config.Providers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx = context.WithValue(ctx, types.UpstreamKey, upstreamClients)
+
+	// one handler for every provider, so token refreshes are coordinated process-wide
+	oauthHandler := oauth.NewOAuthHandler(config, store, authServer, upstreamClients)
+	ctx = context.WithValue(ctx, types.OAuthHandlerKey, oauthHandler)
+	if config.Refresher.Enabled {
+		go oauth.NewRefresher(oauthHandler, config.Refresher).Run(ctx)
+	}
+	ctx = context.WithValue(ctx, types.RateLimiterKey, ratelimit.New(config.RateLimitBackend, store))
+	driftRecorder := drift.NewRecorder()
+	ctx = context.WithValue(ctx, types.DriftRecorderKey, driftRecorder)
 
 	handler := mux.NewRouter()
 
-	handler.HandleFunc("/auth/introspect", oryClient.ListAppsHandler).Methods("GET")
+	handler.HandleFunc("/auth/introspect", authServer.ListAppsHandler).Methods("GET")
+	handler.HandleFunc("/status/providers", upstreamClients.StatusHandler).Methods("GET")
+	if config.DriftReportEnabled {
+		handler.HandleFunc("/drift", utils.AdminMiddleware(ctx, driftRecorder.ReportHandler)).Methods("GET")
+		handler.HandleFunc("/debug/vars", utils.AdminMiddleware(ctx, expvar.Handler().ServeHTTP)).Methods("GET")
+	}
 	handler.HandleFunc("/ory/actions/newUserCallback", func(w http.ResponseWriter, r *http.Request) {
 		secret := r.Header.Get("X-Secret")
 		if secret != config.OryActionsSecret {
@@ -102,8 +161,26 @@ func main() {
 	}).Methods("POST")
 
 	// Load and register dynamic endpoints
-	oryClient.RegisterOAuthServerHandlers(handler)
-	utils.RegisterDynamicEndpoints(ctx, handler)
+	authServer.RegisterOAuthServerHandlers(handler)
+	if local, ok := identity.(*oauthserver.LocalIdentityProvider); ok {
+		local.RegisterAuthorizationHandlers(handler)
+	}
+	executeRoutes := utils.RegisterDynamicEndpoints(ctx, handler)
+	handler.HandleFunc("/openapi.json", executeRoutes.OpenAPIHandler).Methods("GET")
+	handler.HandleFunc("/tools", executeRoutes.ToolsHandler).Methods("GET")
+	handler.HandleFunc("/tools/invoke", executeRoutes.InvokeHandler).Methods("POST")
+	handler.HandleFunc("/mcp", executeRoutes.MCPHandler).Methods("GET", "POST", "DELETE")
+	if config.AdminSecret != "" {
+		handler.HandleFunc("/admin/reload", utils.AdminMiddleware(ctx, executeRoutes.ReloadHandler)).Methods("POST")
+		handler.HandleFunc("/admin/specs", utils.AdminMiddleware(ctx, executeRoutes.StatusHandler)).Methods("GET")
+		if local, ok := identity.(*oauthserver.LocalIdentityProvider); ok {
+			handler.HandleFunc("/admin/apikeys", utils.AdminMiddleware(ctx, local.CreateAPIKeyHandler)).Methods("POST")
+			handler.HandleFunc("/admin/users", utils.AdminMiddleware(ctx, local.SetPasswordHandler)).Methods("POST")
+		}
+	}
+	if config.SpecReloadInterval > 0 {
+		go executeRoutes.Watch(ctx, config.SpecReloadInterval)
+	}
 
 	// Register a catch-all 404 handler
 	handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"lorallabs.com/oauth-server/internal/apispec"
+	"lorallabs.com/oauth-server/internal/cache"
+	"lorallabs.com/oauth-server/internal/config"
+)
+
+const defaultMaxCachedBody = 1 << 20
+
+// responseCache caches GET responses of one provider for the execute proxy
+type responseCache struct {
+	provider string
+	cache    *cache.Cache
+	maxBody  int64
+}
+
+// newResponseCache returns nil if caching is off for the provider
+func newResponseCache(provider config.Provider) *responseCache {
+	if !provider.Cache.Enabled {
+		return nil
+	}
+	maxBody := provider.Cache.MaxBodyBytes
+	if maxBody == 0 {
+		maxBody = defaultMaxCachedBody
+	}
+	return &responseCache{provider: provider.Name, cache: cache.New(provider.Cache.MaxEntries), maxBody: maxBody}
+}
+
+// key returns the cache key of the request, or "" if the request must not use the cache
+func (c *responseCache) key(r *http.Request, op *apispec.Operation, userID uuid.UUID, pathAndQuery string) string {
+	if c == nil || op.Method != http.MethodGet {
+		return ""
+	}
+	if ttl, ok := op.CacheTTL(); ok && ttl == 0 {
+		return ""
+	}
+	// clients doing their own revalidation get the provider's answer, not ours
+	if r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" || r.Header.Get("Range") != "" {
+		return ""
+	}
+	if cache.ParseCacheControl(r.Header).NoStore {
+		return ""
+	}
+	scope := userID.String()
+	if op.CacheShared() {
+		scope = "shared"
+	}
+	return cache.Key(c.provider, scope, pathAndQuery)
+}
+
+// lookup returns the entry stored for the request, if any, and whether it can be served as is
+func (c *responseCache) lookup(key string, r *http.Request) (*cache.Entry, bool) {
+	if key == "" {
+		return nil, false
+	}
+	entry := c.cache.Get(key)
+	if entry == nil || !entry.Matches(r.Header) {
+		return nil, false
+	}
+	fresh := entry.Fresh(time.Now()) && !cache.ParseCacheControl(r.Header).NoCache
+	if !fresh && !entry.Revalidatable() {
+		return nil, false
+	}
+	return entry, fresh
+}
+
+// ttl returns how long a response to op stays fresh, the operation's override winning over the provider
+func (c *responseCache) ttl(op *apispec.Operation, header http.Header) time.Duration {
+	if ttl, ok := op.CacheTTL(); ok {
+		return ttl
+	}
+	return cache.Lifetime(header, op.CacheShared(), time.Now())
+}
+
+// revalidated stores and returns entry with its freshness renewed after the provider answered 304
+func (c *responseCache) revalidated(key string, op *apispec.Operation, entry *cache.Entry, upstream http.Header) *cache.Entry {
+	now := time.Now()
+	renewed := *entry
+	renewed.StoredAt = now
+	renewed.Expires = now.Add(c.ttl(op, upstream))
+	c.cache.Set(key, &renewed)
+	return &renewed
+}
+
+// store caches a 200 response if the provider allows it, returning the body read so far for the client.
+// Bodies over maxBody are not cached, and the rest of them is left in resp.Body.
+func (c *responseCache) store(key string, r *http.Request, op *apispec.Operation, resp *http.Response, header http.Header) ([]byte, error) {
+	if key == "" || resp.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+	directives := cache.ParseCacheControl(resp.Header)
+	if directives.NoStore || (directives.Private && op.CacheShared()) {
+		return nil, nil
+	}
+	vary, ok := cache.VaryHeaders(resp.Header, r.Header)
+	if !ok {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, c.maxBody+1))
+	if err != nil || int64(len(body)) > c.maxBody {
+		return body, err
+	}
+
+	now := time.Now()
+	entry := &cache.Entry{
+		Status:   resp.StatusCode,
+		Header:   header.Clone(),
+		Body:     body,
+		Vary:     vary,
+		StoredAt: now,
+		Expires:  now.Add(c.ttl(op, resp.Header)),
+	}
+	// an entry that is never fresh is only worth keeping if it can be revalidated
+	if entry.Fresh(now) || entry.Revalidatable() {
+		c.cache.Set(key, entry)
+	} else {
+		c.cache.Delete(key)
+	}
+	return body, nil
+}
+
+// writeCached replays entry to the client, status says how the cache answered
+func writeCached(w http.ResponseWriter, entry *cache.Entry, status string) {
+	for name, values := range entry.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Age", strconv.Itoa(int(entry.Age(time.Now()).Seconds())))
+	w.Header().Set("X-Cache", status)
+	w.WriteHeader(entry.Status)
+	w.Write(entry.Body)
+}
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/google/uuid"
+	"lorallabs.com/oauth-server/internal/apispec"
+	"lorallabs.com/oauth-server/internal/cache"
+	"lorallabs.com/oauth-server/internal/config"
+)
+
+// cachedOperation is an operation of method with the given x-loral extensions
+func cachedOperation(method string, extensions map[string]interface{}) *apispec.Operation {
+	op := openapi3.NewOperation()
+	op.Extensions = extensions
+	return &apispec.Operation{Provider: "demo", Path: "/items", Method: method, PathItem: &openapi3.PathItem{}, Operation: op}
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	c := newResponseCache(config.Provider{Name: "demo", Cache: config.CacheConfig{Enabled: true}})
+	user := uuid.New()
+	get := cachedOperation(http.MethodGet, nil)
+
+	tests := []struct {
+		name   string
+		cache  *responseCache
+		op     *apispec.Operation
+		header http.Header
+		want   string
+	}{
+		{"per user", c, get, nil, cache.Key("demo", user.String(), "/items")},
+		{"shared", c, cachedOperation(http.MethodGet, map[string]interface{}{apispec.CacheSharedExtension: true}), nil, cache.Key("demo", "shared", "/items")},
+		{"caching off", nil, get, nil, ""},
+		{"not a GET", c, cachedOperation(http.MethodPost, nil), nil, ""},
+		{"turned off for the operation", c, cachedOperation(http.MethodGet, map[string]interface{}{apispec.CacheTTLExtension: float64(0)}), nil, ""},
+		{"client revalidating", c, get, http.Header{"If-None-Match": {`"v1"`}}, ""},
+		{"range", c, get, http.Header{"Range": {"bytes=0-10"}}, ""},
+		{"no-store", c, get, http.Header{"Cache-Control": {"no-store"}}, ""},
+		{"no-cache still stores", c, get, http.Header{"Cache-Control": {"no-cache"}}, cache.Key("demo", user.String(), "/items")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/demo/execute/items", nil)
+			for name, values := range test.header {
+				r.Header[name] = values
+			}
+			if got := test.cache.key(r, test.op, user, "/items"); got != test.want {
+				t.Errorf("key() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestResponseCacheStore(t *testing.T) {
+	get := cachedOperation(http.MethodGet, nil)
+	shared := cachedOperation(http.MethodGet, map[string]interface{}{apispec.CacheSharedExtension: true})
+
+	tests := []struct {
+		name       string
+		op         *apispec.Operation
+		status     int
+		header     http.Header
+		body       string
+		wantStored bool
+	}{
+		{"fresh", get, http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "{}", true},
+		{"stale but revalidatable", get, http.StatusOK, http.Header{"Etag": {`"v1"`}}, "{}", true},
+		{"stale without validators", get, http.StatusOK, http.Header{}, "{}", false},
+		{"not a 200", get, http.StatusNotFound, http.Header{"Cache-Control": {"max-age=60"}}, "{}", false},
+		{"no-store", get, http.StatusOK, http.Header{"Cache-Control": {"no-store, max-age=60"}}, "{}", false},
+		{"private on a shared operation", shared, http.StatusOK, http.Header{"Cache-Control": {"private, max-age=60"}}, "{}", false},
+		{"private per user", get, http.StatusOK, http.Header{"Cache-Control": {"private, max-age=60"}}, "{}", true},
+		{"Vary: *", get, http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, "{}", false},
+		{"too large", get, http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, strings.Repeat("a", 17), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newResponseCache(config.Provider{Name: "demo", Cache: config.CacheConfig{Enabled: true, MaxBodyBytes: 16}})
+			r := httptest.NewRequest(http.MethodGet, "/demo/execute/items", nil)
+			key := c.key(r, test.op, uuid.New(), "/items")
+			resp := &http.Response{StatusCode: test.status, Header: test.header, Body: io.NopCloser(strings.NewReader(test.body))}
+
+			read, err := c.store(key, r, test.op, resp, test.header)
+			if err != nil {
+				t.Fatalf("store() error = %v", err)
+			}
+			// whatever store read has to reach the client, followed by the rest of the body
+			rest, _ := io.ReadAll(resp.Body)
+			if got := string(read) + string(rest); got != test.body {
+				t.Errorf("store() left %q for the client, want %q", got, test.body)
+			}
+			if stored := c.cache.Get(key) != nil; stored != test.wantStored {
+				t.Errorf("store() cached = %v, want %v", stored, test.wantStored)
+			}
+		})
+	}
+}
+
+func TestResponseCacheLookup(t *testing.T) {
+	now := time.Now()
+	fresh := &cache.Entry{Status: http.StatusOK, Header: http.Header{"Etag": {`"v1"`}}, Vary: map[string]string{"Accept": "application/json"}, Expires: now.Add(time.Minute)}
+	stale := &cache.Entry{Status: http.StatusOK, Header: http.Header{"Etag": {`"v1"`}}, Expires: now.Add(-time.Minute)}
+	expired := &cache.Entry{Status: http.StatusOK, Header: http.Header{}, Expires: now.Add(-time.Minute)}
+
+	tests := []struct {
+		name      string
+		entry     *cache.Entry
+		header    http.Header
+		wantEntry bool
+		wantFresh bool
+	}{
+		{"fresh", fresh, http.Header{"Accept": {"application/json"}}, true, true},
+		{"varying header differs", fresh, http.Header{"Accept": {"text/html"}}, false, false},
+		{"client asks for revalidation", fresh, http.Header{"Accept": {"application/json"}, "Cache-Control": {"no-cache"}}, true, false},
+		{"stale with an ETag", stale, nil, true, false},
+		{"stale without validators", expired, nil, false, false},
+		{"missing", nil, nil, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newResponseCache(config.Provider{Name: "demo", Cache: config.CacheConfig{Enabled: true}})
+			if test.entry != nil {
+				c.cache.Set("key", test.entry)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/demo/execute/items", nil)
+			for name, values := range test.header {
+				r.Header[name] = values
+			}
+			entry, isFresh := c.lookup("key", r)
+			if (entry != nil) != test.wantEntry || isFresh != test.wantFresh {
+				t.Errorf("lookup() = %v, %v, want entry %v, fresh %v", entry != nil, isFresh, test.wantEntry, test.wantFresh)
+			}
+		})
+	}
+}
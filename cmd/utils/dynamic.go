@@ -1,22 +1,25 @@
 package utils
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"io"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
-	"path/filepath"
+	"strconv"
 	"strings"
 
-	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"lorallabs.com/oauth-server/internal/apispec"
 	"lorallabs.com/oauth-server/internal/config"
+	"lorallabs.com/oauth-server/internal/drift"
 	"lorallabs.com/oauth-server/internal/oauth"
 	"lorallabs.com/oauth-server/internal/oauthserver"
-	"lorallabs.com/oauth-server/internal/store"
 	"lorallabs.com/oauth-server/internal/types"
+	"lorallabs.com/oauth-server/internal/upstream"
 )
 
 // AuthMiddleware checks if the request is authenticated
@@ -34,9 +37,18 @@ func AuthMiddleware(ctx context.Context, next http.HandlerFunc, provider string)
 		}
 		token := parts[1]
 
-		// get oryclient from context
-		o := ctx.Value(types.OryClientKey).(*oauthserver.OryClient)
+		// get the authorization server from context
+		o := ctx.Value(types.AuthServerKey).(*oauthserver.AuthorizationServer)
 		introspected := o.IntrospectToken(token, provider)
+		if introspected == nil {
+			http.Error(w, "Unable to validate token", http.StatusServiceUnavailable)
+			return
+		}
+
+		if introspected.Active && oauthserver.IsClientToken(introspected) {
+			http.Error(w, "Client credentials tokens cannot act for a user", http.StatusForbidden)
+			return
+		}
 
 		oryUserID := introspected.GetSub()
 		log.Default().Printf("Ory User ID: %s", oryUserID)
@@ -56,54 +68,28 @@ func AuthMiddleware(ctx context.Context, next http.HandlerFunc, provider string)
 		ogContext := r.Context()
 		ctxWithToken := context.WithValue(ogContext, types.BearerTokenKey, token)
 		ctxWithToken = context.WithValue(ctxWithToken, types.OryUserIDKey, userID)
+		ctxWithToken = context.WithValue(ctxWithToken, types.OryClientIDKey, introspected.GetClientId())
 
 		// If authenticated, call the next handler
 		next(w, r.WithContext(ctxWithToken))
 	}
 }
 
-func RegisterDynamicEndpoints(ctx context.Context, handler *mux.Router) {
+// RegisterDynamicEndpoints registers the auth endpoints of every provider and routes /{provider}/execute
+// to the returned ExecuteRoutes, which can be reloaded while the server runs
+func RegisterDynamicEndpoints(ctx context.Context, handler *mux.Router) *ExecuteRoutes {
 	config := ctx.Value(types.ConfigKey).(*config.Config)
-	store := ctx.Value(types.StoreKey).(*store.Store)
+	oauthHandler := ctx.Value(types.OAuthHandlerKey).(*oauth.OAuthHandler)
+	upstreamClients := ctx.Value(types.UpstreamKey).(*upstream.Clients)
 
 	// master directory of providers
 	allProviders := config.Providers
 
+	routes := NewExecuteRoutes(ctx)
 	for _, provider := range allProviders {
 		provider := provider // create a new variable to avoid improper closure
 
-		dirPath := "internal/apps/" + provider.Name
-		files, err := ioutil.ReadDir(dirPath)
-		if err != nil {
-			log.Fatalf("Failed to read directory: %v", err)
-		}
-
-		loader := openapi3.NewLoader()
-		loader.IsExternalRefsAllowed = true
-
-		// parse all files for openapi3 paths
-		for _, file := range files {
-			if !file.IsDir() {
-				filePath := filepath.Join(dirPath, file.Name())
-				doc, err := loader.LoadFromFile(filePath)
-				if err != nil {
-					log.Fatalf("Failed to load OpenAPI document: %v", err)
-				}
-
-				if err := doc.Validate(ctx); err != nil {
-					log.Fatalf("Failed to validate OpenAPI document: %v", err)
-				}
-
-				// add to allPaths
-				paths := *doc.Paths
-				for path, pathItem := range paths.Map() {
-					provider.Paths[path] = *pathItem
-				}
-			}
-		}
-
 		// auth to the provider
-		oauthHandler := oauth.NewOAuthHandler(config, store)
 		log.Default().Printf("Authentication Registered %s", "/"+provider.Name+"/auth")
 		authHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			log.Default().Printf("Authenticating %s", "/"+provider.Name+"/auth")
@@ -122,98 +108,191 @@ func RegisterDynamicEndpoints(ctx context.Context, handler *mux.Router) {
 			oauthHandler.HandleCallback(provider.Name, w, r)
 		})
 
-		// Provider function endpoints
-		for path, pathItem := range provider.Paths {
-			// Create new variables to avoid improper closure
-			path := path
-			pathItem := pathItem
-
-			for method, operation := range pathItem.Operations() {
-
-				handlerFunc := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-					log.Default().Printf("%s%s hit", provider.Name, path)
-
-					if r.Method != method {
-						http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-						return
-					}
-
-					// Parse path parameters using Gorilla Mux
-					vars := mux.Vars(r)
-					truePath := path // truePath is the actual path to the provider's API — for now we mirror real routes
-
-					// Replace placeholders in the path with actual parameter values
-					for paramName, paramValue := range vars {
-						placeholder := "{" + paramName + "}"
-						truePath = strings.Replace(truePath, placeholder, paramValue, 1)
-					}
-
-					// Get oryUserID from context
-					oryUserID := r.Context().Value(types.OryUserIDKey).(uuid.UUID)
-
-					// Get the provider-specific bearer token from the user id
-					bearerToken := oauthHandler.HandleGetToken(provider.Name, oryUserID)
-
-					// Construct a request to the true path
-					params := r.URL.Query()
-					for _, parameter := range operation.Parameters {
-						p := *parameter.Value
-						if p.Required && p.In == "query" {
-							if _, ok := params[p.Name]; !ok {
-								http.Error(w, "Missing required parameter: "+p.Name, http.StatusBadRequest)
-								return
-							}
-						}
-						if p.Required && p.In == "path" {
-							if _, ok := vars[p.Name]; !ok {
-								http.Error(w, "Missing required parameter: "+p.Name, http.StatusBadRequest)
-								return
-							}
-						}
-					}
-
-					// check if params is length 0
-					if len(params) != 0 {
-						truePath += "?"
-						for key, value := range params {
-							truePath += key + "=" + value[0] + "&"
-						}
-						truePath = truePath[:len(truePath)-1]
-					}
-
-					req, err := http.NewRequest(r.Method, provider.APIRoot+truePath, r.Body)
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-
-					// Add authentication headers, if necessary
-					req.Header.Add("Authorization", "Bearer "+bearerToken)
-
-					log.Default().Printf("Request: %v\n", req.URL.String())
-					// Forward the request to the true path
-					log.Default().Printf("Request: %v\n", req)
-					client := &http.Client{}
-					resp, err := client.Do(req)
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-					defer resp.Body.Close()
-
-					// Copy the response body to the original response writer - just the body, not the headers
-					w.WriteHeader(resp.StatusCode)
-					_, err = io.Copy(w, resp.Body)
-					if err != nil {
-						http.Error(w, err.Error(), http.StatusInternalServerError)
-						return
-					}
-				})
-
-				// Wrap in AuthMiddleware
-				log.Default().Printf("Registering %s, %s", method, "/"+provider.Name+"/execute"+path)
-				handler.Handle("/"+provider.Name+"/execute"+path, AuthMiddleware(ctx, handlerFunc, provider.Name)).Methods(method)
+		// Provider function endpoints, kept across spec reloads along with their caches and clients
+		routes.addProvider(&providerProxy{
+			Provider:        provider,
+			requestHeaders:  newHeaderFilter(defaultRequestHeaders, strippedRequestHeaders, provider.Headers.Request),
+			responseHeaders: newHeaderFilter(defaultResponseHeaders, strippedResponseHeaders, provider.Headers.Response),
+			client:          upstreamClients.For(provider.Name),
+			responses:       newResponseCache(provider),
+		})
+		handler.PathPrefix("/" + provider.Name + "/execute/").Handler(routes)
+	}
+
+	// a provider with a broken spec serves no operations rather than taking every provider down
+	for name, err := range routes.Reload() {
+		log.Printf("Failed to load %s OpenAPI specs: %v", name, err)
+	}
+	return routes
+}
+
+// providerProxy is everything the execute handlers of one provider share
+type providerProxy struct {
+	config.Provider
+	requestHeaders  *headerFilter
+	responseHeaders *headerFilter
+	client          *http.Client
+	responses       *responseCache
+}
+
+// newExecuteHandler proxies op to the provider as the authenticated user
+func newExecuteHandler(ctx context.Context, proxy *providerProxy, op *apispec.Operation) http.HandlerFunc {
+	config := ctx.Value(types.ConfigKey).(*config.Config)
+	oauthHandler := ctx.Value(types.OAuthHandlerKey).(*oauth.OAuthHandler)
+	driftRecorder := ctx.Value(types.DriftRecorderKey).(*drift.Recorder)
+	path := op.Path
+	method := op.Method
+
+	handlerFunc := func(w http.ResponseWriter, r *http.Request) {
+		log.Default().Printf("%s%s hit", proxy.Name, path)
+
+		if r.Method != method {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// Parse path parameters using Gorilla Mux
+		vars := mux.Vars(r)
+
+		// Validate parameters and body against the operation before going upstream, the body is buffered
+		// for it so its size is capped
+		r.Body = http.MaxBytesReader(w, r.Body, config.MaxRequestBodyBytes)
+		violations, err := validateRequest(r, op, vars)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body exceeds "+strconv.FormatInt(tooLarge.Limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(violations) > 0 {
+			writeValidationError(w, op, violations)
+			return
+		}
+
+		// Get oryUserID from context
+		oryUserID := r.Context().Value(types.OryUserIDKey).(uuid.UUID)
+
+		// Get the provider-specific bearer token from the user id
+		bearerToken, err := oauthHandler.HandleGetToken(r.Context(), proxy.Name, oryUserID)
+		if err != nil {
+			oauth.WriteTokenError(w, proxy.Name, err)
+			return
+		}
+
+		// Construct a request to the true path, re-serializing only the params the operation declares
+		truePath, err := buildUpstreamPath(op, vars)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query, dropped, err := buildUpstreamQuery(op, r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(dropped) > 0 {
+			log.Default().Printf("Dropping undeclared query params for %s %s: %v", method, path, dropped)
+		}
+		if query != "" {
+			truePath += "?" + query
+		}
+
+		// Serve fresh cached responses without going upstream, stale ones are revalidated below
+		cacheKey := proxy.responses.key(r, op, oryUserID, truePath)
+		cached, fresh := proxy.responses.lookup(cacheKey, r)
+		if fresh {
+			writeCached(w, cached, "HIT")
+			return
+		}
+
+		// buffered so the upstream client can replay it on a retry
+		reqBody, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// cancelled along with the client request, so an abandoned call stops waiting on the provider
+		upstreamCtx := upstream.WithIdempotent(r.Context(), op.Idempotent())
+		req, err := http.NewRequestWithContext(upstreamCtx, r.Method, proxy.APIRoot+truePath, bytes.NewReader(reqBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Pass through the allowed client headers and the operation's header params, then authenticate as the user
+		proxy.requestHeaders.copy(req.Header, r.Header)
+		proxy.requestHeaders.copyNamed(req.Header, r.Header, declaredHeaders(op))
+		req.Header.Set("Authorization", "Bearer "+bearerToken)
+		if cached != nil {
+			cached.SetConditional(req.Header)
+		}
+
+		log.Default().Printf("Request: %v\n", req.URL.String())
+		// Forward the request to the true path
+		resp, err := proxy.client.Do(req)
+		if err != nil {
+			var netErr net.Error
+			var openErr *upstream.CircuitOpenError
+			switch {
+			case r.Context().Err() != nil:
+				// the client hung up, there is no one left to answer
+			case errors.As(err, &openErr):
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(openErr.RetryAfter)))
+				http.Error(w, openErr.Error(), http.StatusServiceUnavailable)
+			case errors.As(err, &netErr) && netErr.Timeout():
+				http.Error(w, err.Error(), http.StatusGatewayTimeout)
+			default:
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+		defer resp.Body.Close()
+
+		if cached != nil && resp.StatusCode == http.StatusNotModified {
+			writeCached(w, proxy.responses.revalidated(cacheKey, op, cached, resp.Header), "REVALIDATED")
+			return
+		}
+
+		// Optionally check the response against the spec to catch upstream API changes
+		if config.ValidateResponses || proxy.ValidateResponses {
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
 			}
+			checkResponse(r, op, vars, resp, body, driftRecorder)
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		// Copy the allowed response headers and the body to the original response writer
+		header := http.Header{}
+		proxy.responseHeaders.copy(header, resp.Header)
+		rewriteLocation(header, proxy.Provider)
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+
+		// Keep a copy if the response is cacheable, then send what was read and whatever is left
+		body, err := proxy.responses.store(cacheKey, r, op, resp, header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if cacheKey != "" {
+			w.Header().Set("X-Cache", "MISS")
+		}
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			// the status is sent already, all that is left is to cut the response short
+			log.Default().Printf("Failed to copy the %s response for %s %s: %v", proxy.Name, method, path, err)
 		}
 	}
+
+	// Wrap in AuthMiddleware, then the rate limits of the authenticated client and user
+	return AuthMiddleware(ctx, RateLimitMiddleware(ctx, handlerFunc, proxy.Provider), proxy.Name)
 }
@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"lorallabs.com/oauth-server/internal/config"
+)
+
+// Headers forwarded by default in each direction, a trailing * matches any suffix
+var (
+	defaultRequestHeaders = []string{
+		"Accept", "Accept-Language", "Content-Type", "Content-Language", "Cache-Control", "Prefer",
+		"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range", "Range",
+		"X-Request-Id",
+	}
+	defaultResponseHeaders = []string{
+		"Content-Type", "Content-Language", "Content-Disposition", "Content-Range", "Accept-Ranges",
+		"ETag", "Last-Modified", "Cache-Control", "Expires", "Vary", "Location", "Link", "Retry-After",
+		"X-Total-Count", "X-Request-Id", "X-Ratelimit-*", "Ratelimit-*",
+	}
+)
+
+// Never forwarded regardless of policy: hop-by-hop headers (RFC 9110 section 7.6.1) and
+// credentials that belong to Loral on one side and to the provider on the other
+var (
+	hopByHopHeaders         = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+	strippedRequestHeaders  = []string{"Authorization", "Cookie", "Host", "Content-Length", "Accept-Encoding"}
+	strippedResponseHeaders = []string{"Set-Cookie", "Www-Authenticate", "Content-Length", "Content-Encoding"}
+)
+
+// headerFilter copies the headers allowed by a provider's policy in one direction
+type headerFilter struct {
+	allow []string
+	deny  []string
+	set   map[string]string
+}
+
+func newHeaderFilter(defaults []string, stripped []string, rules config.HeaderRules) *headerFilter {
+	f := &headerFilter{set: make(map[string]string, len(rules.Set))}
+	for _, name := range append(defaults, rules.Allow...) {
+		f.allow = append(f.allow, canonicalPattern(name))
+	}
+	for _, name := range append(append(hopByHopHeaders, stripped...), rules.Deny...) {
+		f.deny = append(f.deny, canonicalPattern(name))
+	}
+	for name, value := range rules.Set {
+		f.set[textproto.CanonicalMIMEHeaderKey(name)] = value
+	}
+	return f
+}
+
+// copy adds every allowed header of src to dst, then the policy's static headers
+func (f *headerFilter) copy(dst http.Header, src http.Header) {
+	// headers named in Connection are hop-by-hop for this hop only
+	connection := map[string]bool{}
+	for _, value := range src.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			connection[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	for name, values := range src {
+		if connection[name] || matchesAny(f.deny, name) || !matchesAny(f.allow, name) {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+	for name, value := range f.set {
+		dst.Set(name, value)
+	}
+}
+
+// copyNamed adds the named headers of src to dst unless they are denied, whether or not they are allowed.
+// It passes on the header params an operation declares.
+func (f *headerFilter) copyNamed(dst http.Header, src http.Header, names []string) {
+	for _, name := range names {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if values := src.Values(name); len(values) > 0 && !matchesAny(f.deny, name) {
+			dst[name] = values
+		}
+	}
+}
+
+// rewriteLocation points redirects at the provider back through the Loral execute endpoint
+func rewriteLocation(header http.Header, provider config.Provider) {
+	location := header.Get("Location")
+	if rest, ok := strings.CutPrefix(location, provider.APIRoot); ok && (rest == "" || strings.HasPrefix(rest, "/")) {
+		header.Set("Location", "/"+provider.Name+"/execute"+rest)
+	}
+}
+
+func canonicalPattern(name string) string {
+	if prefix, ok := strings.CutSuffix(name, "*"); ok {
+		return textproto.CanonicalMIMEHeaderKey(prefix) + "*"
+	}
+	return textproto.CanonicalMIMEHeaderKey(name)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if pattern == name {
+			return true
+		}
+	}
+	return false
+}
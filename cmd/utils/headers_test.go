@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"lorallabs.com/oauth-server/internal/config"
+)
+
+func TestHeaderFilterCopy(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults []string
+		stripped []string
+		rules    config.HeaderRules
+		src      http.Header
+		want     http.Header
+	}{
+		{
+			name:     "defaults",
+			defaults: defaultRequestHeaders,
+			stripped: strippedRequestHeaders,
+			src:      http.Header{"Accept": {"application/json"}, "X-Custom": {"1"}, "If-None-Match": {`"a"`, `"b"`}},
+			want:     http.Header{"Accept": {"application/json"}, "If-None-Match": {`"a"`, `"b"`}},
+		},
+		{
+			name:     "credentials and hop-by-hop headers",
+			defaults: defaultRequestHeaders,
+			stripped: strippedRequestHeaders,
+			rules:    config.HeaderRules{Allow: []string{"Authorization", "Cookie", "Transfer-Encoding"}},
+			src:      http.Header{"Authorization": {"Bearer loral"}, "Cookie": {"session=1"}, "Transfer-Encoding": {"chunked"}, "Accept": {"*/*"}},
+			want:     http.Header{"Accept": {"*/*"}},
+		},
+		{
+			name:     "named in Connection",
+			defaults: defaultRequestHeaders,
+			stripped: strippedRequestHeaders,
+			src:      http.Header{"Connection": {"close, x-request-id"}, "X-Request-Id": {"1"}, "Prefer": {"return=minimal"}},
+			want:     http.Header{"Prefer": {"return=minimal"}},
+		},
+		{
+			name:     "wildcards",
+			defaults: defaultResponseHeaders,
+			stripped: strippedResponseHeaders,
+			rules:    config.HeaderRules{Allow: []string{"x-github-*"}},
+			src:      http.Header{"X-Ratelimit-Remaining": {"10"}, "X-Github-Request-Id": {"abc"}, "X-Other": {"1"}},
+			want:     http.Header{"X-Ratelimit-Remaining": {"10"}, "X-Github-Request-Id": {"abc"}},
+		},
+		{
+			name:     "deny wins over allow",
+			defaults: defaultResponseHeaders,
+			stripped: strippedResponseHeaders,
+			rules:    config.HeaderRules{Allow: []string{"X-Debug-*"}, Deny: []string{"x-debug-secret", "Link"}},
+			src:      http.Header{"X-Debug-Trace": {"1"}, "X-Debug-Secret": {"s"}, "Link": {"<next>"}},
+			want:     http.Header{"X-Debug-Trace": {"1"}},
+		},
+		{
+			name:     "stripped response headers",
+			defaults: defaultResponseHeaders,
+			stripped: strippedResponseHeaders,
+			rules:    config.HeaderRules{Allow: []string{"*"}},
+			src:      http.Header{"Set-Cookie": {"a=1"}, "Www-Authenticate": {"Bearer"}, "Content-Encoding": {"gzip"}, "Etag": {`"v1"`}},
+			want:     http.Header{"Etag": {`"v1"`}},
+		},
+		{
+			name:     "static headers",
+			defaults: defaultRequestHeaders,
+			stripped: strippedRequestHeaders,
+			rules:    config.HeaderRules{Set: map[string]string{"x-api-version": "2022-11-28", "accept": "application/vnd.github+json"}},
+			src:      http.Header{"Accept": {"text/html"}},
+			want:     http.Header{"Accept": {"application/vnd.github+json"}, "X-Api-Version": {"2022-11-28"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := http.Header{}
+			newHeaderFilter(test.defaults, test.stripped, test.rules).copy(got, test.src)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("copy() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHeaderFilterCopyNamed(t *testing.T) {
+	filter := newHeaderFilter(defaultRequestHeaders, strippedRequestHeaders, config.HeaderRules{Deny: []string{"X-Internal"}})
+	src := http.Header{"X-Tenant": {"acme"}, "X-Internal": {"1"}, "Authorization": {"Bearer loral"}}
+
+	got := http.Header{}
+	filter.copyNamed(got, src, []string{"x-tenant", "x-internal", "authorization", "x-missing"})
+	if want := (http.Header{"X-Tenant": {"acme"}}); !reflect.DeepEqual(got, want) {
+		t.Errorf("copyNamed() = %v, want %v", got, want)
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	provider := config.Provider{Name: "github", APIRoot: "https://api.github.com"}
+	tests := []struct {
+		location string
+		want     string
+	}{
+		{"https://api.github.com/repos/a/b", "/github/execute/repos/a/b"},
+		{"https://api.github.com", "/github/execute"},
+		{"https://api.github.com.evil.com/x", "https://api.github.com.evil.com/x"},
+		{"https://github.com/login", "https://github.com/login"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.location, func(t *testing.T) {
+			header := http.Header{}
+			if test.location != "" {
+				header.Set("Location", test.location)
+			}
+			rewriteLocation(header, provider)
+			if got := header.Get("Location"); got != test.want {
+				t.Errorf("rewriteLocation(%q) = %q, want %q", test.location, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"net/http"
+	"strings"
+
+	"lorallabs.com/oauth-server/internal/mcp"
+	"lorallabs.com/oauth-server/internal/tools"
+)
+
+var mcpServer = &mcp.Server{Name: "loral", Version: "1.0.0"}
+
+// MCPHandler serves the execute proxy as an MCP server, with the operations of the providers in the
+// caller's token scope as tools. Like /tools, the provider query param narrows them down.
+func (e *ExecuteRoutes) MCPHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		mcpServer.Serve(w, r, nil)
+		return
+	}
+	// MCP clients start their OAuth flow from the challenge of a 401
+	w.Header().Set("WWW-Authenticate", `Bearer realm="loral"`)
+	scopes, ok := tokenScopes(e.ctx, w, r)
+	if !ok {
+		return
+	}
+	w.Header().Del("WWW-Authenticate")
+	var providers []string
+	if filter := r.URL.Query().Get("provider"); filter != "" {
+		providers = strings.Split(filter, ",")
+	}
+	mcpServer.Serve(w, r, &callerToolbox{routes: e, r: r, scopes: scopes, providers: providers})
+}
+
+// callerToolbox is the tools of one MCP request's caller, called with the caller's token
+type callerToolbox struct {
+	routes    *ExecuteRoutes
+	r         *http.Request
+	scopes    []string
+	providers []string
+	tools     []*tools.Tool
+}
+
+func (c *callerToolbox) Tools() []*tools.Tool {
+	if c.tools == nil {
+		c.tools = c.routes.scopedTools(c.scopes, c.providers)
+	}
+	return c.tools
+}
+
+func (c *callerToolbox) Call(tool *tools.Tool, args map[string]interface{}) (*tools.Result, error) {
+	return c.routes.invoke(c.r, tool, args)
+}
@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"lorallabs.com/oauth-server/internal/apispec"
+)
+
+// operationParameters returns the parameters of op, with operation level ones overriding path level ones
+func operationParameters(op *apispec.Operation) []*openapi3.Parameter {
+	var params []*openapi3.Parameter
+	for _, ref := range op.PathItem.Parameters {
+		if op.Operation.Parameters.GetByInAndName(ref.Value.In, ref.Value.Name) == nil {
+			params = append(params, ref.Value)
+		}
+	}
+	for _, ref := range op.Operation.Parameters {
+		params = append(params, ref.Value)
+	}
+	return params
+}
+
+// buildUpstreamPath expands op's path template with the escaped path params. Values arrive serialized per
+// their style and explode, as validated against the spec, and are forwarded in the same serialization.
+func buildUpstreamPath(op *apispec.Operation, pathParams map[string]string) (string, error) {
+	path := op.Path
+	for _, p := range operationParameters(op) {
+		if p.In != openapi3.ParameterInPath {
+			continue
+		}
+		value, ok := pathParams[p.Name]
+		if !ok {
+			return "", fmt.Errorf("missing required parameter: %s", p.Name)
+		}
+		method, err := p.SerializationMethod()
+		if err != nil {
+			return "", err
+		}
+		prefix, separator, assign, err := pathDelimiters(p.Name, method, isObject(p))
+		if err != nil {
+			return "", err
+		}
+		rest, ok := strings.CutPrefix(value, prefix)
+		if !ok {
+			return "", fmt.Errorf("invalid value for path parameter %s: %q does not start with %q", p.Name, value, prefix)
+		}
+
+		// escape each item, and each property and value of exploded objects, but keep the delimiters
+		items := strings.Split(rest, separator)
+		for i, item := range items {
+			if hasDotSegment(item) {
+				return "", fmt.Errorf("invalid value for path parameter %s: %q", p.Name, item)
+			}
+			if property, propertyValue, found := strings.Cut(item, assign); assign != "" && found {
+				items[i] = url.PathEscape(property) + assign + url.PathEscape(propertyValue)
+			} else {
+				items[i] = url.PathEscape(item)
+			}
+		}
+		prefix, separator, _, _ = pathDelimiters(url.PathEscape(p.Name), method, isObject(p))
+		escaped := prefix + strings.Join(items, separator)
+		// an exploded label value like ".." is made of empty items, but is a dot segment once joined
+		if hasDotSegment(escaped) {
+			return "", fmt.Errorf("invalid value for path parameter %s: %q", p.Name, value)
+		}
+		path = strings.Replace(path, "{"+p.Name+"}", escaped, 1)
+	}
+	return path, nil
+}
+
+// pathDelimiters returns the prefix a path param named name starts with under method, the separator
+// between its items and, for exploded objects, between a property and its value (OpenAPI 3 style values)
+func pathDelimiters(name string, method *openapi3.SerializationMethod, object bool) (prefix string, separator string, assign string, err error) {
+	if method.Explode && object {
+		assign = "="
+	}
+	switch method.Style {
+	case openapi3.SerializationSimple:
+		return "", ",", assign, nil
+	case openapi3.SerializationLabel:
+		if method.Explode {
+			return ".", ".", assign, nil
+		}
+		return ".", ",", assign, nil
+	case openapi3.SerializationMatrix:
+		switch {
+		case method.Explode && object:
+			return ";", ";", assign, nil
+		case method.Explode:
+			return ";" + name + "=", ";" + name + "=", assign, nil
+		}
+		return ";" + name + "=", ",", assign, nil
+	}
+	return "", "", "", fmt.Errorf("unsupported style %q for path parameter %s", method.Style, name)
+}
+
+// hasDotSegment reports whether value is or contains a . or .. path segment, which escaping leaves as is and
+// the provider, decoding %2F or treating a backslash as a separator, could resolve to another path
+func hasDotSegment(value string) bool {
+	for _, segment := range strings.FieldsFunc(value, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// declaredHeaders returns the names of the header params of op
+func declaredHeaders(op *apispec.Operation) []string {
+	var names []string
+	for _, p := range operationParameters(op) {
+		if p.In == openapi3.ParameterInHeader {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// buildUpstreamQuery serializes the declared query params of op from the incoming query, following each
+// param's style and explode settings. Params the operation does not declare are dropped and returned.
+func buildUpstreamQuery(op *apispec.Operation, query url.Values) (string, []string, error) {
+	var parts []string
+	used := make(map[string]bool)
+	add := func(key string, value string) {
+		parts = append(parts, url.QueryEscape(key)+"="+value)
+	}
+
+	for _, p := range operationParameters(op) {
+		if p.In != openapi3.ParameterInQuery {
+			continue
+		}
+		method, err := p.SerializationMethod()
+		if err != nil {
+			return "", nil, err
+		}
+
+		// deepObject params arrive as name[prop]=value, forward every key under the param
+		if method.Style == openapi3.SerializationDeepObject {
+			for _, key := range sortedKeys(query) {
+				if strings.HasPrefix(key, p.Name+"[") {
+					used[key] = true
+					for _, value := range query[key] {
+						add(key, url.QueryEscape(value))
+					}
+				}
+			}
+			continue
+		}
+
+		// exploded form objects arrive as one key per property rather than under the param name
+		if method.Style == openapi3.SerializationForm && method.Explode && isObject(p) {
+			for _, property := range sortedKeys(p.Schema.Value.Properties) {
+				if values, ok := query[property]; ok {
+					used[property] = true
+					for _, value := range values {
+						add(property, url.QueryEscape(value))
+					}
+				}
+			}
+			continue
+		}
+
+		values, ok := query[p.Name]
+		if !ok {
+			continue
+		}
+		used[p.Name] = true
+		if method.Explode {
+			for _, value := range values {
+				add(p.Name, url.QueryEscape(value))
+			}
+			continue
+		}
+
+		separator := ","
+		switch method.Style {
+		case openapi3.SerializationSpaceDelimited:
+			separator = "%20"
+		case openapi3.SerializationPipeDelimited:
+			separator = "|"
+		}
+		escaped := make([]string, len(values))
+		for i, value := range values {
+			escaped[i] = escapeDelimited(value, separator)
+		}
+		add(p.Name, strings.Join(escaped, separator))
+	}
+
+	var dropped []string
+	for _, key := range sortedKeys(query) {
+		if !used[key] {
+			dropped = append(dropped, key)
+		}
+	}
+	return strings.Join(parts, "&"), dropped, nil
+}
+
+// escapeDelimited escapes a value that may already contain the style's delimiter, keeping the delimiter literal
+func escapeDelimited(value string, separator string) string {
+	raw := separator
+	if separator == "%20" {
+		raw = " "
+	}
+	items := strings.Split(value, raw)
+	for i, item := range items {
+		items[i] = url.QueryEscape(item)
+	}
+	return strings.Join(items, separator)
+}
+
+func isObject(p *openapi3.Parameter) bool {
+	return p.Schema != nil && p.Schema.Value != nil && p.Schema.Value.Type == openapi3.TypeObject
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
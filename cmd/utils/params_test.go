@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"lorallabs.com/oauth-server/internal/apispec"
+)
+
+// paramOperation is a GET operation on path declaring params
+func paramOperation(path string, params ...*openapi3.Parameter) *apispec.Operation {
+	op := openapi3.NewOperation()
+	for _, p := range params {
+		op.AddParameter(p)
+	}
+	return &apispec.Operation{Path: path, Method: http.MethodGet, PathItem: &openapi3.PathItem{}, Operation: op}
+}
+
+func styled(p *openapi3.Parameter, style string, explode bool, schema *openapi3.Schema) *openapi3.Parameter {
+	p.Style = style
+	p.Explode = &explode
+	p.Schema = schema.NewRef()
+	return p
+}
+
+func TestBuildUpstreamPath(t *testing.T) {
+	array := openapi3.NewArraySchema().WithItems(openapi3.NewStringSchema())
+	object := openapi3.NewObjectSchema().WithProperty("R", openapi3.NewIntegerSchema()).WithProperty("G", openapi3.NewIntegerSchema())
+	pathParam := func(style string, explode bool, schema *openapi3.Schema) *openapi3.Parameter {
+		return styled(openapi3.NewPathParameter("id"), style, explode, schema)
+	}
+
+	tests := []struct {
+		name    string
+		param   *openapi3.Parameter
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"simple", openapi3.NewPathParameter("id").WithSchema(openapi3.NewStringSchema()), "a b", "/items/a%20b", false},
+		{"simple array", pathParam("simple", false, array), "a,b c", "/items/a,b%20c", false},
+		{"simple exploded object", pathParam("simple", true, object), "R=1,G=2", "/items/R=1,G=2", false},
+		{"label", pathParam("label", false, openapi3.NewStringSchema()), ".a", "/items/.a", false},
+		{"label array", pathParam("label", false, array), ".a,b c", "/items/.a,b%20c", false},
+		{"label exploded array", pathParam("label", true, array), ".a.b c", "/items/.a.b%20c", false},
+		{"label exploded object", pathParam("label", true, object), ".R=1.G=2", "/items/.R=1.G=2", false},
+		{"label without its prefix", pathParam("label", false, array), "a,b", "", true},
+		{"matrix", pathParam("matrix", false, openapi3.NewStringSchema()), ";id=a", "/items/;id=a", false},
+		{"matrix array", pathParam("matrix", false, array), ";id=a,b", "/items/;id=a,b", false},
+		{"matrix exploded array", pathParam("matrix", true, array), ";id=a;id=b c", "/items/;id=a;id=b%20c", false},
+		{"matrix object", pathParam("matrix", false, object), ";id=R,1,G,2", "/items/;id=R,1,G,2", false},
+		{"matrix exploded object", pathParam("matrix", true, object), ";R=1;G=2", "/items/;R=1;G=2", false},
+		{"matrix without its prefix", pathParam("matrix", true, array), "a;id=b", "", true},
+		{"escaped slash", pathParam("simple", false, array), "a/b,c", "/items/a%2Fb,c", false},
+		{"dot segment", openapi3.NewPathParameter("id").WithSchema(openapi3.NewStringSchema()), "..", "", true},
+		{"dot segment in an item", pathParam("simple", false, array), "a,../admin", "", true},
+		{"dot segment of a label", pathParam("label", false, openapi3.NewStringSchema()), "..", "", true},
+		{"dot segment of empty exploded label items", pathParam("label", true, array), "..", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := buildUpstreamPath(paramOperation("/items/{id}", test.param), map[string]string{"id": test.value})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("buildUpstreamPath(%q) error = %v, want error %v", test.value, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("buildUpstreamPath(%q) = %q, want %q", test.value, got, test.want)
+			}
+		})
+	}
+
+	if _, err := buildUpstreamPath(paramOperation("/items/{id}", openapi3.NewPathParameter("id")), nil); err == nil {
+		t.Errorf("buildUpstreamPath() without the param succeeded")
+	}
+}
+
+func TestBuildUpstreamQuery(t *testing.T) {
+	array := openapi3.NewArraySchema().WithItems(openapi3.NewStringSchema())
+	object := openapi3.NewObjectSchema().WithProperty("name", openapi3.NewStringSchema()).WithProperty("size", openapi3.NewIntegerSchema())
+	queryParam := func(style string, explode bool, schema *openapi3.Schema) *openapi3.Parameter {
+		return styled(openapi3.NewQueryParameter("tag"), style, explode, schema)
+	}
+
+	tests := []struct {
+		name        string
+		param       *openapi3.Parameter
+		query       url.Values
+		want        string
+		wantDropped []string
+	}{
+		{"form exploded", queryParam("form", true, array), url.Values{"tag": {"a b", "c&d"}}, "tag=a+b&tag=c%26d", nil},
+		{"form", queryParam("form", false, array), url.Values{"tag": {"a,b"}}, "tag=a,b", nil},
+		{"space delimited", queryParam("spaceDelimited", false, array), url.Values{"tag": {"a b"}}, "tag=a%20b", nil},
+		{"pipe delimited", queryParam("pipeDelimited", false, array), url.Values{"tag": {"a|b&c"}}, "tag=a|b%26c", nil},
+		{"deep object", queryParam("deepObject", true, object), url.Values{"tag[size]": {"2"}, "tag[name]": {"x"}}, "tag%5Bname%5D=x&tag%5Bsize%5D=2", nil},
+		{"form exploded object", queryParam("form", true, object), url.Values{"size": {"2"}, "name": {"x"}}, "name=x&size=2", nil},
+		{"undeclared", queryParam("form", true, array), url.Values{"tag": {"a"}, "debug": {"1"}}, "tag=a", []string{"debug"}},
+		{"absent", queryParam("form", true, array), url.Values{}, "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, dropped, err := buildUpstreamQuery(paramOperation("/items", test.param), test.query)
+			if err != nil {
+				t.Fatalf("buildUpstreamQuery() error = %v", err)
+			}
+			if got != test.want || !reflect.DeepEqual(dropped, test.wantDropped) {
+				t.Errorf("buildUpstreamQuery() = %q, dropped %v, want %q, dropped %v", got, dropped, test.want, test.wantDropped)
+			}
+		})
+	}
+}
+
+func TestStyledPathParamsPassValidation(t *testing.T) {
+	array := openapi3.NewArraySchema().WithItems(openapi3.NewIntegerSchema())
+	tests := []struct {
+		style   string
+		explode bool
+		value   string
+	}{
+		{"simple", false, "3,4"},
+		{"label", false, ".3,4"},
+		{"label", true, ".3.4"},
+		{"matrix", false, ";id=3,4"},
+		{"matrix", true, ";id=3;id=4"},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			op := paramOperation("/items/{id}", styled(openapi3.NewPathParameter("id"), test.style, test.explode, array))
+			op.Doc = &openapi3.T{}
+			r := httptest.NewRequest(http.MethodGet, "/demo/execute/items/"+test.value, nil)
+			violations, err := validateRequest(r, op, map[string]string{"id": test.value})
+			if err != nil || len(violations) > 0 {
+				t.Fatalf("validateRequest() = %v, %v", violations, err)
+			}
+			if got, err := buildUpstreamPath(op, map[string]string{"id": test.value}); err != nil || got != "/items/"+test.value {
+				t.Errorf("buildUpstreamPath() = %q, %v, want /items/%s", got, err, test.value)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"lorallabs.com/oauth-server/internal/config"
+	"lorallabs.com/oauth-server/internal/ratelimit"
+	"lorallabs.com/oauth-server/internal/types"
+)
+
+// RateLimitMiddleware enforces the provider's provider-wide, per-client and per-user limits. It runs after
+// AuthMiddleware, which puts the client and user IDs on the request context.
+func RateLimitMiddleware(ctx context.Context, next http.HandlerFunc, provider config.Provider) http.HandlerFunc {
+	limits := provider.RateLimit
+	if !limits.Provider.Enabled() && !limits.Client.Enabled() && !limits.User.Enabled() && len(limits.Clients) == 0 {
+		return next
+	}
+	limiter := ctx.Value(types.RateLimiterKey).(ratelimit.Limiter)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		clientID := r.Context().Value(types.OryClientIDKey).(string)
+		userID := r.Context().Value(types.OryUserIDKey).(uuid.UUID)
+
+		clientLimit, ok := limits.Clients[clientID]
+		if !ok {
+			clientLimit = limits.Client
+		}
+
+		// narrowest first, so a throttled user or client stops before spending the shared buckets
+		buckets := []struct {
+			key   string
+			limit config.RateLimit
+		}{
+			{provider.Name + "/user/" + userID.String(), limits.User},
+			{provider.Name + "/client/" + clientID, clientLimit},
+			{provider.Name + "/provider", limits.Provider},
+		}
+
+		// report whichever bucket is closest to running out
+		var tightest *ratelimit.Result
+		var taken []int
+		allowed := true
+		for i, bucket := range buckets {
+			if !bucket.limit.Enabled() {
+				continue
+			}
+			result, err := limiter.Allow(bucket.key, ratelimit.NewLimit(bucket.limit))
+			if err != nil {
+				// fail open, an unavailable limiter should not take the proxy down with it
+				log.Printf("Error checking rate limit %s: %v", bucket.key, err)
+				continue
+			}
+			if tightest == nil || !result.Allowed || result.Remaining < tightest.Remaining {
+				tightest = &result
+			}
+			if !result.Allowed {
+				allowed = false
+				break
+			}
+			taken = append(taken, i)
+		}
+		if !allowed {
+			// the request is not made, so it must not count against the buckets that let it through
+			for _, i := range taken {
+				if err := limiter.Refund(buckets[i].key, ratelimit.NewLimit(buckets[i].limit)); err != nil {
+					log.Printf("Error refunding rate limit %s: %v", buckets[i].key, err)
+				}
+			}
+		}
+
+		if tightest != nil {
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(tightest.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(tightest.Reset)))
+		}
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(tightest.RetryAfter)))
+			http.Error(w, "Rate limit exceeded for "+provider.Name, http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
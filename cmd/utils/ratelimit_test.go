@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"lorallabs.com/oauth-server/internal/config"
+	"lorallabs.com/oauth-server/internal/ratelimit"
+	"lorallabs.com/oauth-server/internal/types"
+)
+
+// failingLimiter stands in for an unreachable Postgres limiter
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(key string, limit ratelimit.Limit) (ratelimit.Result, error) {
+	return ratelimit.Result{}, errors.New("database is down")
+}
+func (failingLimiter) Refund(key string, limit ratelimit.Limit) error { return nil }
+
+func TestRateLimitMiddleware(t *testing.T) {
+	alice, bob := uuid.New(), uuid.New()
+	perMinute := func(requests int) config.RateLimit { return config.RateLimit{Requests: requests, Per: time.Minute} }
+
+	type call struct {
+		client     string
+		user       uuid.UUID
+		wantStatus int
+	}
+	tests := []struct {
+		name    string
+		limits  config.RateLimitConfig
+		limiter ratelimit.Limiter
+		calls   []call
+	}{
+		{
+			name:   "per user",
+			limits: config.RateLimitConfig{User: perMinute(1)},
+			calls:  []call{{"app", alice, 200}, {"app", alice, 429}, {"app", bob, 200}},
+		},
+		{
+			name:   "per client with an override",
+			limits: config.RateLimitConfig{Client: perMinute(1), Clients: map[string]config.RateLimit{"partner": perMinute(2)}},
+			calls:  []call{{"app", alice, 200}, {"app", bob, 429}, {"partner", alice, 200}, {"partner", bob, 200}, {"partner", alice, 429}},
+		},
+		{
+			name:   "provider wide",
+			limits: config.RateLimitConfig{Provider: perMinute(2)},
+			calls:  []call{{"app", alice, 200}, {"other", bob, 200}, {"third", uuid.New(), 429}},
+		},
+		{
+			// the client bucket denies alice's third call, which must not cost her a token of her own bucket
+			name:   "denied calls are refunded",
+			limits: config.RateLimitConfig{User: perMinute(3), Client: perMinute(2)},
+			calls:  []call{{"app", alice, 200}, {"app", alice, 200}, {"app", alice, 429}, {"other", alice, 200}},
+		},
+		{
+			name:   "denied by the user bucket first",
+			limits: config.RateLimitConfig{User: perMinute(1), Provider: perMinute(2)},
+			calls:  []call{{"app", alice, 200}, {"app", alice, 429}, {"app", alice, 429}, {"app", bob, 200}},
+		},
+		{
+			name:    "fails open",
+			limits:  config.RateLimitConfig{User: perMinute(1)},
+			limiter: failingLimiter{},
+			calls:   []call{{"app", alice, 200}, {"app", alice, 200}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := test.limiter
+			if limiter == nil {
+				limiter = ratelimit.NewMemoryLimiter()
+			}
+			ctx := context.WithValue(context.Background(), types.RateLimiterKey, limiter)
+			provider := config.Provider{Name: "demo", RateLimit: test.limits}
+			handler := RateLimitMiddleware(ctx, func(w http.ResponseWriter, r *http.Request) {}, provider)
+
+			for i, call := range test.calls {
+				r := httptest.NewRequest(http.MethodGet, "/demo/execute/items", nil)
+				r = r.WithContext(context.WithValue(context.WithValue(r.Context(), types.OryClientIDKey, call.client), types.OryUserIDKey, call.user))
+				w := httptest.NewRecorder()
+				handler(w, r)
+				if w.Code != call.wantStatus {
+					t.Fatalf("call %d: status = %d, want %d", i, w.Code, call.wantStatus)
+				}
+				if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+					t.Errorf("call %d: 429 without Retry-After", i)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	ctx := context.WithValue(context.Background(), types.RateLimiterKey, ratelimit.NewMemoryLimiter())
+	provider := config.Provider{Name: "demo", RateLimit: config.RateLimitConfig{
+		User:     config.RateLimit{Requests: 10, Per: time.Minute},
+		Provider: config.RateLimit{Requests: 3, Per: time.Minute},
+	}}
+	handler := RateLimitMiddleware(ctx, func(w http.ResponseWriter, r *http.Request) {}, provider)
+
+	r := httptest.NewRequest(http.MethodGet, "/demo/execute/items", nil)
+	r = r.WithContext(context.WithValue(context.WithValue(r.Context(), types.OryClientIDKey, "app"), types.OryUserIDKey, uuid.New()))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	// the provider bucket is the closest to running out
+	if w.Header().Get("RateLimit-Limit") != "3" || w.Header().Get("RateLimit-Remaining") != "2" || w.Header().Get("RateLimit-Reset") != "20" {
+		t.Errorf("headers = %v, want the provider bucket's", w.Header())
+	}
+
+	if unlimited := RateLimitMiddleware(ctx, nil, config.Provider{Name: "demo"}); unlimited != nil {
+		t.Errorf("RateLimitMiddleware() wrapped a provider without limits")
+	}
+}
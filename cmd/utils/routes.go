@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"lorallabs.com/oauth-server/internal/apispec"
+	"lorallabs.com/oauth-server/internal/config"
+	"lorallabs.com/oauth-server/internal/oauthserver"
+	"lorallabs.com/oauth-server/internal/types"
+)
+
+// SpecStatus describes the spec a provider is serving and the outcome of its last reload
+type SpecStatus struct {
+	Operations  int        `json:"operations"`
+	LoadedAt    *time.Time `json:"loaded_at,omitempty"`     // when the serving spec was loaded
+	LastError   string     `json:"last_error,omitempty"`    // why the last reload was rejected, if it was
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"` // cleared by the next successful reload
+}
+
+// ExecuteRoutes serves /{provider}/execute from a route table built from the provider specs.
+// Reload swaps in a new table atomically, so requests always see a complete set of routes.
+type ExecuteRoutes struct {
+	ctx       context.Context
+	providers []*providerProxy
+	router    atomic.Pointer[mux.Router]
+
+	mu           sync.Mutex // serializes reloads
+	specs        map[string]*apispec.Spec
+	status       map[string]*SpecStatus
+	fingerprints map[string]string // spec directories as of the last reload attempt
+}
+
+func NewExecuteRoutes(ctx context.Context) *ExecuteRoutes {
+	routes := &ExecuteRoutes{
+		ctx:          ctx,
+		specs:        make(map[string]*apispec.Spec),
+		status:       make(map[string]*SpecStatus),
+		fingerprints: make(map[string]string),
+	}
+	routes.router.Store(mux.NewRouter())
+	return routes
+}
+
+func (e *ExecuteRoutes) addProvider(proxy *providerProxy) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.providers = append(e.providers, proxy)
+	e.status[proxy.Name] = &SpecStatus{}
+}
+
+func (e *ExecuteRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.router.Load().ServeHTTP(w, r)
+}
+
+// Reload reads every provider's spec directory again and swaps in the new routes. Providers whose specs
+// fail to load keep serving their previous version, and the errors are returned by provider name.
+func (e *ExecuteRoutes) Reload() map[string]error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	errs := make(map[string]error)
+	for _, proxy := range e.providers {
+		status := e.status[proxy.Name]
+		fingerprint, _ := apispec.Fingerprint(proxy.SpecDir)
+		e.fingerprints[proxy.Name] = fingerprint
+
+		spec, err := apispec.Load(e.ctx, proxy.Name, proxy.SpecDir)
+		now := time.Now()
+		if err != nil {
+			errs[proxy.Name] = err
+			status.LastError, status.LastErrorAt = err.Error(), &now
+			continue
+		}
+		e.specs[proxy.Name] = spec
+		status.Operations, status.LoadedAt = len(spec.Operations), &now
+		status.LastError, status.LastErrorAt = "", nil
+	}
+
+	router := mux.NewRouter()
+	for _, proxy := range e.providers {
+		spec, ok := e.specs[proxy.Name]
+		if !ok {
+			continue
+		}
+		for _, op := range spec.Operations {
+			log.Default().Printf("Registering %s, %s", op.Method, "/"+proxy.Name+"/execute"+op.Path)
+			router.Handle("/"+proxy.Name+"/execute"+op.Path, newExecuteHandler(e.ctx, proxy, op)).Methods(op.Method)
+		}
+	}
+	e.router.Store(router)
+	return errs
+}
+
+// Status returns the spec status of every provider
+func (e *ExecuteRoutes) Status() map[string]SpecStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	status := make(map[string]SpecStatus, len(e.status))
+	for name, s := range e.status {
+		status[name] = *s
+	}
+	return status
+}
+
+// Watch reloads whenever a file in a spec directory is added, removed or modified, checking every
+// interval until ctx is cancelled
+func (e *ExecuteRoutes) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !e.changed() {
+			continue
+		}
+		log.Printf("OpenAPI specs changed, reloading routes")
+		for name, err := range e.Reload() {
+			log.Printf("Rejected %s OpenAPI specs, still serving the previous version: %v", name, err)
+		}
+	}
+}
+
+func (e *ExecuteRoutes) changed() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, proxy := range e.providers {
+		fingerprint, err := apispec.Fingerprint(proxy.SpecDir)
+		if err == nil && fingerprint != e.fingerprints[proxy.Name] {
+			return true
+		}
+	}
+	return false
+}
+
+// ReloadHandler reloads the specs and responds with the status of every provider,
+// as 422 if any provider's specs were rejected
+func (e *ExecuteRoutes) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	errs := e.Reload()
+	for name, err := range errs {
+		log.Printf("Rejected %s OpenAPI specs, still serving the previous version: %v", name, err)
+	}
+	status := http.StatusOK
+	if len(errs) > 0 {
+		status = http.StatusUnprocessableEntity
+	}
+	writeJSON(w, status, e.Status())
+}
+
+// StatusHandler responds with the spec status of every provider
+func (e *ExecuteRoutes) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, e.Status())
+}
+
+// AdminMiddleware only lets through requests carrying the admin secret in X-Secret
+func AdminMiddleware(ctx context.Context, next http.HandlerFunc) http.HandlerFunc {
+	config := ctx.Value(types.ConfigKey).(*config.Config)
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get("X-Secret")
+		if config.AdminSecret == "" || subtle.ConstantTimeCompare([]byte(secret), []byte(config.AdminSecret)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// OpenAPIHandler serves the merged OpenAPI document of the execute proxy. It is limited to the
+// comma separated providers in the provider query param, and to the scopes of the caller's token if
+// the request has one.
+func (e *ExecuteRoutes) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	config := e.ctx.Value(types.ConfigKey).(*config.Config)
+
+	allowed := func(provider string) bool { return true }
+	if filter := r.URL.Query().Get("provider"); filter != "" {
+		providers := strings.Split(filter, ",")
+		allowed = func(provider string) bool { return contains(providers, provider) }
+	}
+	if r.Header.Get("Authorization") != "" {
+		scopes, ok := tokenScopes(e.ctx, w, r)
+		if !ok {
+			return
+		}
+		byProvider := allowed
+		allowed = func(provider string) bool { return byProvider(provider) && contains(scopes, provider) }
+	}
+
+	specs := e.loadedSpecs(allowed)
+
+	doc, err := apispec.Merge(specs, apispec.MergeOptions{
+		Title:     "Loral",
+		ServerURL: config.PublicURL,
+		AuthURL:   strings.TrimSuffix(config.IssuerURL, "/") + "/oauth2/auth",
+		TokenURL:  strings.TrimSuffix(config.IssuerURL, "/") + "/oauth2/token",
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(doc)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// loadedSpecs returns the serving specs of the providers allowed reports true for
+func (e *ExecuteRoutes) loadedSpecs(allowed func(provider string) bool) []*apispec.Spec {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var specs []*apispec.Spec
+	for name, spec := range e.specs {
+		if allowed(name) {
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+// tokenScopes introspects the caller's bearer token and returns its scopes, which are the providers
+// it may call. It writes a 401 and returns false if the token is missing or inactive, or a 403 if it does
+// not act for a user.
+func tokenScopes(ctx context.Context, w http.ResponseWriter, r *http.Request) ([]string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		http.Error(w, "Unauthorized - Invalid token format", http.StatusUnauthorized)
+		return nil, false
+	}
+	o := ctx.Value(types.AuthServerKey).(*oauthserver.AuthorizationServer)
+	introspected := o.IntrospectToken(token, "")
+	if introspected == nil || !introspected.Active {
+		http.Error(w, "Invalid Token", http.StatusUnauthorized)
+		return nil, false
+	}
+	if oauthserver.IsClientToken(introspected) {
+		http.Error(w, "Client credentials tokens cannot act for a user", http.StatusForbidden)
+		return nil, false
+	}
+	return strings.Split(introspected.GetScope(), " "), true
+}
@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"lorallabs.com/oauth-server/internal/config"
+	"lorallabs.com/oauth-server/internal/drift"
+	"lorallabs.com/oauth-server/internal/oauth"
+	"lorallabs.com/oauth-server/internal/oauthserver"
+	"lorallabs.com/oauth-server/internal/types"
+)
+
+// specWithPath is an OpenAPI document with a single GET operation on path
+func specWithPath(path string) string {
+	return `{"openapi":"3.0.0","info":{"title":"demo","version":"1"},"paths":{"` + path + `":{"get":{"responses":{"200":{"description":"ok"}}}}}}`
+}
+
+// routesContext holds what building the execute handlers needs, none of which a request gets to use before
+// AuthMiddleware turns it away
+func routesContext(adminSecret string) context.Context {
+	lax := false
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, types.ConfigKey, &config.Config{AdminSecret: adminSecret})
+	ctx = context.WithValue(ctx, types.OAuthHandlerKey, (*oauth.OAuthHandler)(nil))
+	ctx = context.WithValue(ctx, types.DriftRecorderKey, drift.NewRecorder())
+	ctx = context.WithValue(ctx, types.AuthServerKey, (*oauthserver.AuthorizationServer)(nil))
+	return context.WithValue(ctx, types.LaxAuthFlag, &lax)
+}
+
+func TestExecuteRoutesReload(t *testing.T) {
+	dir := t.TempDir()
+	routes := NewExecuteRoutes(routesContext(""))
+	routes.addProvider(&providerProxy{Provider: config.Provider{Name: "demo", SpecDir: dir}})
+
+	tests := []struct {
+		name       string
+		spec       string // written to the spec directory before reloading
+		wantErr    bool
+		registered string // served by the execute routes after the reload
+		missing    string // not served
+	}{
+		{"first load", specWithPath("/items"), false, "/demo/execute/items", "/demo/execute/orders"},
+		{"operation replaced", specWithPath("/orders"), false, "/demo/execute/orders", "/demo/execute/items"},
+		{"broken spec keeps the previous routes", `{"openapi":`, true, "/demo/execute/orders", "/demo/execute/items"},
+		{"fixed spec", specWithPath("/items"), false, "/demo/execute/items", "/demo/execute/orders"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := os.WriteFile(filepath.Join(dir, "demo.json"), []byte(test.spec), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if !routes.changed() {
+				t.Errorf("changed() = false after the spec was rewritten")
+			}
+			errs := routes.Reload()
+			if (errs["demo"] != nil) != test.wantErr {
+				t.Fatalf("Reload() = %v, want error %v", errs, test.wantErr)
+			}
+			if routes.changed() {
+				t.Errorf("changed() = true right after a reload")
+			}
+
+			// a matched route stops at AuthMiddleware, an unmatched one is a 404
+			for path, want := range map[string]int{test.registered: http.StatusUnauthorized, test.missing: http.StatusNotFound} {
+				w := httptest.NewRecorder()
+				routes.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+				if w.Code != want {
+					t.Errorf("GET %s = %d, want %d", path, w.Code, want)
+				}
+			}
+
+			status := routes.Status()["demo"]
+			if (status.LastError != "") != test.wantErr || (status.LastErrorAt != nil) != test.wantErr {
+				t.Errorf("Status() = %+v, want an error %v", status, test.wantErr)
+			}
+			if status.Operations != 1 || status.LoadedAt == nil {
+				t.Errorf("Status() = %+v, want the serving spec's single operation", status)
+			}
+		})
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	dir := t.TempDir()
+	routes := NewExecuteRoutes(routesContext(""))
+	routes.addProvider(&providerProxy{Provider: config.Provider{Name: "demo", SpecDir: dir}})
+
+	tests := []struct {
+		name string
+		spec string
+		want int
+	}{
+		{"valid", specWithPath("/items"), http.StatusOK},
+		{"rejected", `{"openapi":`, http.StatusUnprocessableEntity},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := os.WriteFile(filepath.Join(dir, "demo.json"), []byte(test.spec), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			routes.ReloadHandler(w, httptest.NewRequest(http.MethodPost, "/admin/reload", nil))
+			if w.Code != test.want {
+				t.Errorf("ReloadHandler() = %d, want %d: %s", w.Code, test.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string // configured
+		sent   string
+		want   int
+	}{
+		{"right secret", "s3cret", "s3cret", http.StatusOK},
+		{"wrong secret", "s3cret", "guess", http.StatusUnauthorized},
+		{"no secret sent", "s3cret", "", http.StatusUnauthorized},
+		{"admin endpoints off", "", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := AdminMiddleware(routesContext(test.secret), func(w http.ResponseWriter, r *http.Request) {})
+			r := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+			if test.sent != "" {
+				r.Header.Set("X-Secret", test.sent)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != test.want {
+				t.Errorf("AdminMiddleware() = %d, want %d", w.Code, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"lorallabs.com/oauth-server/internal/tools"
+)
+
+const (
+	// maxToolCallBytes caps the body of /tools/invoke
+	maxToolCallBytes = 1 << 20
+	// maxToolResultBytes caps the response body kept for a tool result, which is buffered in memory
+	maxToolResultBytes = 4 << 20
+)
+
+// ToolsHandler lists the operations the caller's token can reach as LLM tool definitions,
+// in the OpenAI (default) or Anthropic format picked by the format query param
+func (e *ExecuteRoutes) ToolsHandler(w http.ResponseWriter, r *http.Request) {
+	available, ok := e.callerTools(w, r)
+	if !ok {
+		return
+	}
+
+	var defs []map[string]interface{}
+	switch r.URL.Query().Get("format") {
+	case "", "openai":
+		defs = tools.OpenAI(available)
+	case "anthropic":
+		defs = tools.Anthropic(available)
+	default:
+		http.Error(w, "format must be openai or anthropic", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, defs)
+}
+
+// toolCall is the body of /tools/invoke. Arguments may be an object or, as OpenAI sends them, a JSON string.
+type toolCall struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// InvokeHandler executes a tool call by sending the matching request through the execute routes,
+// so it is authenticated, rate limited, validated and cached exactly like a direct call
+func (e *ExecuteRoutes) InvokeHandler(w http.ResponseWriter, r *http.Request) {
+	var call toolCall
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxToolCallBytes)).Decode(&call); err != nil {
+		http.Error(w, "Invalid tool call: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	args, err := decodeArguments(call.Arguments)
+	if err != nil {
+		http.Error(w, "Invalid tool arguments: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	available, ok := e.callerTools(w, r)
+	if !ok {
+		return
+	}
+	tool := findTool(available, call.Name)
+	if tool == nil {
+		http.Error(w, "Unknown tool "+call.Name, http.StatusNotFound)
+		return
+	}
+
+	result, err := e.invoke(r, tool, args)
+	if err != nil {
+		http.Error(w, "Invalid tool arguments: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// invoke dispatches a tool call made by the caller of r to the execute routes, with the caller's token.
+// Its error means the arguments do not fit the tool, failed calls are reported in the result.
+func (e *ExecuteRoutes) invoke(r *http.Request, tool *tools.Tool, args map[string]interface{}) (*tools.Result, error) {
+	built, err := tool.BuildCall(args)
+	if err != nil {
+		return nil, err
+	}
+	target := "/" + tool.Operation.Provider + "/execute" + built.Path
+	if len(built.Query) > 0 {
+		target += "?" + built.Query.Encode()
+	}
+	req, err := http.NewRequestWithContext(r.Context(), built.Method, target, bytes.NewReader(built.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = built.Header
+	req.Header.Set("Authorization", r.Header.Get("Authorization"))
+	req.Header.Set("Accept", "application/json")
+	if built.Body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	recorder := newResponseRecorder()
+	e.ServeHTTP(recorder, req)
+	recorder.WriteHeader(http.StatusOK)
+
+	result := &tools.Result{
+		Name:        tool.Name,
+		Status:      recorder.status,
+		IsError:     recorder.status >= 400,
+		ContentType: recorder.sent.Get("Content-Type"),
+		Content:     recorder.body.String(),
+		Truncated:   recorder.truncated,
+	}
+	if mediaType, _, _ := mime.ParseMediaType(result.ContentType); strings.HasSuffix(mediaType, "json") && !recorder.truncated {
+		var parsed interface{}
+		if json.Unmarshal(recorder.body.Bytes(), &parsed) == nil {
+			result.Content = parsed
+		}
+	}
+	return result, nil
+}
+
+// callerTools returns the tools of every provider in the caller's token scope, narrowed down by the
+// comma separated provider query param
+func (e *ExecuteRoutes) callerTools(w http.ResponseWriter, r *http.Request) ([]*tools.Tool, bool) {
+	scopes, ok := tokenScopes(e.ctx, w, r)
+	if !ok {
+		return nil, false
+	}
+	var providers []string
+	if filter := r.URL.Query().Get("provider"); filter != "" {
+		providers = strings.Split(filter, ",")
+	}
+	return e.scopedTools(scopes, providers), true
+}
+
+// scopedTools returns the tools of the providers in scopes, and in providers unless it is nil
+func (e *ExecuteRoutes) scopedTools(scopes, providers []string) []*tools.Tool {
+	specs := e.loadedSpecs(func(provider string) bool {
+		return contains(scopes, provider) && (providers == nil || contains(providers, provider))
+	})
+	return tools.FromSpecs(specs)
+}
+
+func findTool(available []*tools.Tool, name string) *tools.Tool {
+	for _, t := range available {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+func decodeArguments(raw json.RawMessage) (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	if len(raw) == 0 || string(raw) == "null" {
+		return args, nil
+	}
+	var encoded string
+	if json.Unmarshal(raw, &encoded) == nil {
+		raw = json.RawMessage(encoded)
+		if encoded == "" {
+			return args, nil
+		}
+	}
+	err := json.Unmarshal(raw, &args)
+	return args, err
+}
+
+// responseRecorder buffers a response from the execute routes for a tool result, up to maxToolResultBytes
+type responseRecorder struct {
+	header    http.Header
+	sent      http.Header // header as of WriteHeader, later changes are not part of the response
+	status    int
+	body      bytes.Buffer
+	truncated bool
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: http.Header{}, status: http.StatusOK}
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+// WriteHeader keeps the first status, like a real response, later calls cannot change it
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.sent != nil {
+		return
+	}
+	r.status = status
+	r.sent = r.header.Clone()
+}
+
+// Write keeps what fits under the limit and drops the rest, marking the result truncated. It never
+// fails, so a handler copying a large response carries on and its status stands.
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if room := maxToolResultBytes - r.body.Len(); len(b) > room {
+		r.body.Write(b[:room])
+		r.truncated = true
+		return len(b), nil
+	}
+	return r.body.Write(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
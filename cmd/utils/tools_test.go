@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/gorilla/mux"
+	"lorallabs.com/oauth-server/internal/apispec"
+	"lorallabs.com/oauth-server/internal/tools"
+)
+
+// invokeAgainst calls a tool whose execute route is served by handler
+func invokeAgainst(t *testing.T, handler http.HandlerFunc) *tools.Result {
+	t.Helper()
+	routes := NewExecuteRoutes(context.Background())
+	router := mux.NewRouter()
+	router.Handle("/demo/execute/items", handler).Methods(http.MethodGet)
+	routes.router.Store(router)
+
+	tool := tools.FromOperation(&apispec.Operation{Provider: "demo", Path: "/items", Method: http.MethodGet, PathItem: &openapi3.PathItem{}, Operation: openapi3.NewOperation()})
+	result, err := routes.invoke(httptest.NewRequest(http.MethodPost, "/tools/invoke", nil), tool, nil)
+	if err != nil {
+		t.Fatalf("invoke() error = %v", err)
+	}
+	return result
+}
+
+// copyResponse answers the way the execute handler does: headers, then the body copied from upstream
+func copyResponse(status int, contentType string, body []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		if _, err := io.Copy(w, bytes.NewReader(body)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func TestInvokeResult(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), maxToolResultBytes+1024)
+
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		status      int
+		isError     bool
+		contentType string
+		truncated   bool
+		content     interface{}
+	}{
+		{
+			name:        "JSON",
+			handler:     copyResponse(http.StatusOK, "application/json", []byte(`{"id":1}`)),
+			status:      http.StatusOK,
+			contentType: "application/json",
+			content:     map[string]interface{}{"id": float64(1)},
+		},
+		{
+			name:        "text",
+			handler:     copyResponse(http.StatusOK, "text/plain", []byte("hello")),
+			status:      http.StatusOK,
+			contentType: "text/plain",
+			content:     "hello",
+		},
+		{
+			name:        "oversized success",
+			handler:     copyResponse(http.StatusOK, "application/json", large),
+			status:      http.StatusOK,
+			contentType: "application/json",
+			truncated:   true,
+			content:     string(large[:maxToolResultBytes]),
+		},
+		{
+			name:        "upstream error",
+			handler:     copyResponse(http.StatusNotFound, "application/json", []byte(`{"error":"missing"}`)),
+			status:      http.StatusNotFound,
+			isError:     true,
+			contentType: "application/json",
+			content:     map[string]interface{}{"error": "missing"},
+		},
+		{
+			name: "error after the header",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte("partial"))
+				http.Error(w, "copy failed", http.StatusInternalServerError)
+			},
+			status:      http.StatusOK,
+			contentType: "text/plain",
+			content:     "partialcopy failed\n",
+		},
+		{
+			name:    "no body",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			status:  http.StatusOK,
+			content: "",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := invokeAgainst(t, test.handler)
+			if result.Status != test.status || result.IsError != test.isError {
+				t.Errorf("invoke() status = %d, is_error = %v, want %d, %v", result.Status, result.IsError, test.status, test.isError)
+			}
+			if result.ContentType != test.contentType {
+				t.Errorf("invoke() content type = %q, want %q", result.ContentType, test.contentType)
+			}
+			if result.Truncated != test.truncated {
+				t.Errorf("invoke() truncated = %v, want %v", result.Truncated, test.truncated)
+			}
+			switch want := test.content.(type) {
+			case string:
+				if got, ok := result.Content.(string); !ok || got != want {
+					t.Errorf("invoke() content = %.100v, want %.100q", result.Content, want)
+				}
+			case map[string]interface{}:
+				got, ok := result.Content.(map[string]interface{})
+				if !ok || len(got) != len(want) {
+					t.Fatalf("invoke() content = %v, want %v", result.Content, want)
+				}
+				for key, value := range want {
+					if got[key] != value {
+						t.Errorf("invoke() content[%q] = %v, want %v", key, got[key], value)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeArguments(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{"object", `{"id":"1"}`, map[string]interface{}{"id": "1"}, false},
+		{"OpenAI string", `"{\"id\":\"1\"}"`, map[string]interface{}{"id": "1"}, false},
+		{"empty string", `""`, map[string]interface{}{}, false},
+		{"null", `null`, map[string]interface{}{}, false},
+		{"missing", ``, map[string]interface{}{}, false},
+		{"array", `[1]`, nil, true},
+		{"string that is not an object", `"id"`, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeArguments([]byte(test.raw))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("decodeArguments() error = %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("decodeArguments() = %v, want %v", got, test.want)
+			}
+			for key, value := range test.want {
+				if got[key] != value {
+					t.Errorf("decodeArguments()[%q] = %v, want %v", key, got[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseRecorderLimit(t *testing.T) {
+	recorder := newResponseRecorder()
+	chunk := strings.Repeat("a", maxToolResultBytes/2+1)
+	for i := 0; i < 3; i++ {
+		if n, err := recorder.Write([]byte(chunk)); n != len(chunk) || err != nil {
+			t.Fatalf("Write() = %d, %v, want %d, nil", n, err, len(chunk))
+		}
+	}
+	if recorder.body.Len() != maxToolResultBytes || !recorder.truncated {
+		t.Errorf("recorder kept %d bytes, truncated = %v", recorder.body.Len(), recorder.truncated)
+	}
+}
@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"lorallabs.com/oauth-server/internal/apispec"
+	"lorallabs.com/oauth-server/internal/drift"
+)
+
+// Violation is one way a request does not match the provider's OpenAPI operation
+type Violation struct {
+	In      string `json:"in"`              // query, path, header, cookie, body or response
+	Name    string `json:"name,omitempty"`  // parameter name
+	Field   string `json:"field,omitempty"` // JSON pointer to the offending value, if known
+	Message string `json:"message"`
+}
+
+var validationOptions = &openapi3filter.Options{
+	MultiError:          true,
+	SkipSettingDefaults: true,
+	// the caller authenticates to Loral, not to the provider, so skip the spec's security schemes
+	AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+}
+
+// validateRequest checks r's parameters and body against op, leaving r.Body readable for forwarding
+func validateRequest(r *http.Request, op *apispec.Operation, pathParams map[string]string) ([]Violation, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	defer func() { r.Body = io.NopCloser(bytes.NewReader(body)) }()
+
+	err = openapi3filter.ValidateRequest(r.Context(), &openapi3filter.RequestValidationInput{
+		Request:    r,
+		PathParams: pathParams,
+		Route:      op.Route(),
+		Options:    validationOptions,
+	})
+	if err == nil {
+		return nil, nil
+	}
+	return collectViolations(err), nil
+}
+
+// collectViolations flattens the nested errors returned by openapi3filter into one entry per problem
+func collectViolations(err error) []Violation {
+	var violations []Violation
+	switch e := err.(type) {
+	case openapi3.MultiError:
+		for _, inner := range e {
+			violations = append(violations, collectViolations(inner)...)
+		}
+		return violations
+	case *openapi3filter.RequestError:
+		base := Violation{In: "body"}
+		if p := e.Parameter; p != nil {
+			base = Violation{In: p.In, Name: p.Name}
+		}
+
+		// schema errors carry the location of the bad value, report each one separately
+		schemaErrs := schemaErrors(e.Err)
+		if len(schemaErrs) == 0 {
+			base.Message = e.Error()
+			return []Violation{base}
+		}
+		for _, schemaErr := range schemaErrs {
+			v := base
+			if pointer := schemaErr.JSONPointer(); len(pointer) > 0 {
+				v.Field = "/" + strings.Join(pointer, "/")
+			}
+			v.Message = schemaErr.Reason
+			violations = append(violations, v)
+		}
+		return violations
+	case *openapi3filter.ResponseError:
+		schemaErrs := schemaErrors(e.Err)
+		if len(schemaErrs) == 0 {
+			return []Violation{{In: "response", Message: e.Error()}}
+		}
+		for _, schemaErr := range schemaErrs {
+			v := Violation{In: "response", Message: schemaErr.Reason}
+			if pointer := schemaErr.JSONPointer(); len(pointer) > 0 {
+				v.Field = "/" + strings.Join(pointer, "/")
+			}
+			violations = append(violations, v)
+		}
+		return violations
+	default:
+		return []Violation{{In: "request", Message: err.Error()}}
+	}
+}
+
+func schemaErrors(err error) []*openapi3.SchemaError {
+	switch e := err.(type) {
+	case openapi3.MultiError:
+		var schemaErrs []*openapi3.SchemaError
+		for _, inner := range e {
+			schemaErrs = append(schemaErrs, schemaErrors(inner)...)
+		}
+		return schemaErrs
+	case *openapi3.SchemaError:
+		return []*openapi3.SchemaError{e}
+	default:
+		var schemaErr *openapi3.SchemaError
+		if errors.As(err, &schemaErr) {
+			return []*openapi3.SchemaError{schemaErr}
+		}
+		return nil
+	}
+}
+
+// writeValidationError responds with a 400 listing every violation
+func writeValidationError(w http.ResponseWriter, op *apispec.Operation, violations []Violation) {
+	body, _ := json.Marshal(struct {
+		Error      string      `json:"error"`
+		Message    string      `json:"message"`
+		Operation  string      `json:"operation"`
+		Violations []Violation `json:"violations"`
+	}{
+		Error:      "invalid_request",
+		Message:    "request does not match the provider's API specification",
+		Operation:  op.Method + " " + op.Path,
+		Violations: violations,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(body)
+}
+
+// checkResponse validates an upstream response against op and records any mismatch as drift.
+// The response is always forwarded as is, this only reports.
+func checkResponse(r *http.Request, op *apispec.Operation, pathParams map[string]string, resp *http.Response, body []byte, recorder *drift.Recorder) {
+	input := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: pathParams,
+			Route:      op.Route(),
+		},
+		Status:  resp.StatusCode,
+		Header:  resp.Header,
+		Options: &openapi3filter.Options{MultiError: true, IncludeResponseStatus: true},
+	}
+	input.SetBodyBytes(body)
+
+	err := openapi3filter.ValidateResponse(r.Context(), input)
+	if err == nil {
+		return
+	}
+
+	messages := make([]string, 0, 1)
+	for _, v := range collectViolations(err) {
+		message := v.Message
+		if v.Field != "" {
+			message = v.Field + ": " + message
+		}
+		messages = append(messages, message)
+	}
+	if len(messages) == 0 {
+		messages = append(messages, err.Error())
+	}
+	recorder.Record(op.Provider, op.Method, op.Path, resp.StatusCode, messages)
+	log.Printf("event=response_drift provider=%s method=%s path=%s status=%d mismatches=%d first=%q",
+		op.Provider, op.Method, op.Path, resp.StatusCode, len(messages), messages[0])
+}
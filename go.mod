@@ -4,6 +4,7 @@ go 1.20
 
 require (
 	github.com/joho/godotenv v1.5.1
+	gopkg.in/yaml.v3 v3.0.1
 	gorm.io/driver/postgres v1.5.6
 	gorm.io/gorm v1.25.7
 )
@@ -21,7 +22,6 @@ require (
 	golang.org/x/oauth2 v0.17.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/protobuf v1.31.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
 
 require (
@@ -35,6 +35,6 @@ require (
 	github.com/jinzhu/now v1.1.5 // indirect
 	github.com/ory/client-go v1.6.1
 	github.com/rs/cors v1.10.1
-	golang.org/x/crypto v0.19.0 // indirect
+	golang.org/x/crypto v0.19.0
 	golang.org/x/text v0.14.0 // indirect
 )
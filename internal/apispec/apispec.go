@@ -0,0 +1,171 @@
+package apispec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/routers"
+)
+
+// Operation is one endpoint of a provider, along with the OpenAPI document that declares it
+type Operation struct {
+	Provider  string
+	Path      string // upstream path template, ie. /v1/products/{id}
+	Method    string
+	PathItem  *openapi3.PathItem
+	Operation *openapi3.Operation
+	Doc       *openapi3.T
+}
+
+// IdempotentExtension marks an operation as safe (true) or unsafe (false) to retry, overriding its method
+const IdempotentExtension = "x-loral-idempotent"
+
+// Idempotent reports whether the operation can be safely retried: GET, HEAD, OPTIONS, PUT and DELETE
+// are, unless the spec says otherwise with IdempotentExtension
+func (o *Operation) Idempotent() bool {
+	if idempotent, ok := o.Operation.Extensions[IdempotentExtension].(bool); ok {
+		return idempotent
+	}
+	switch o.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+const (
+	// CacheTTLExtension overrides how long responses of a GET operation are cached, in seconds or as a
+	// duration like "5m". 0 turns caching off for the operation.
+	CacheTTLExtension = "x-loral-cache-ttl"
+	// CacheSharedExtension marks a GET operation whose responses do not depend on the user,
+	// so one cached response is served to every user
+	CacheSharedExtension = "x-loral-cache-shared"
+)
+
+// CacheTTL returns the CacheTTLExtension of the operation, if it has a valid one
+func (o *Operation) CacheTTL() (time.Duration, bool) {
+	switch ttl := o.Operation.Extensions[CacheTTLExtension].(type) {
+	case float64:
+		return time.Duration(ttl * float64(time.Second)), ttl >= 0
+	case string:
+		d, err := time.ParseDuration(ttl)
+		return d, err == nil && d >= 0
+	}
+	return 0, false
+}
+
+// CacheShared reports whether the operation is marked with CacheSharedExtension
+func (o *Operation) CacheShared() bool {
+	shared, _ := o.Operation.Extensions[CacheSharedExtension].(bool)
+	return shared
+}
+
+// Route describes the operation in the form openapi3filter validates against
+func (o *Operation) Route() *routers.Route {
+	return &routers.Route{
+		Spec:      o.Doc,
+		Path:      o.Path,
+		PathItem:  o.PathItem,
+		Method:    o.Method,
+		Operation: o.Operation,
+	}
+}
+
+// Spec is every operation loaded for a provider
+type Spec struct {
+	Provider   string
+	Docs       []*openapi3.T
+	Files      []string // file name of each of Docs, ie. products.json
+	Operations []*Operation
+}
+
+// Load reads and validates every OpenAPI document in dir. An empty dir yields an empty Spec.
+func Load(ctx context.Context, provider string, dir string) (*Spec, error) {
+	spec := &Spec{Provider: provider}
+	if dir == "" {
+		return spec, nil
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	loader := openapi3.NewLoader()
+	loader.IsExternalRefsAllowed = true
+	// the default reader caches documents for the life of the process, which would defeat reloading
+	loader.ReadFromURIFunc = openapi3.URIMapCache(openapi3.ReadFromURIs(openapi3.ReadFromHTTP(http.DefaultClient), openapi3.ReadFromFile))
+
+	// parse all files for openapi3 paths, the first document to declare an operation wins
+	var errs []error
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		filePath := filepath.Join(dir, file.Name())
+		doc, err := loader.LoadFromFile(filePath)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to load OpenAPI document %s: %w", filePath, err))
+			continue
+		}
+		if err := doc.Validate(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("failed to validate OpenAPI document %s: %w", filePath, err))
+			continue
+		}
+		spec.Docs = append(spec.Docs, doc)
+		spec.Files = append(spec.Files, file.Name())
+
+		for _, path := range doc.Paths.InMatchingOrder() {
+			pathItem := doc.Paths.Value(path)
+			for method, operation := range pathItem.Operations() {
+				if seen[method+" "+path] {
+					continue
+				}
+				seen[method+" "+path] = true
+				spec.Operations = append(spec.Operations, &Operation{
+					Provider:  provider,
+					Path:      path,
+					Method:    method,
+					PathItem:  pathItem,
+					Operation: operation,
+					Doc:       doc,
+				})
+			}
+		}
+	}
+
+	// report every broken document at once, but never serve a partial spec
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return spec, nil
+}
+
+// Fingerprint summarizes the names, sizes and modification times of the documents in dir,
+// so a watcher can tell when Load would return something new
+func Fingerprint(dir string) (string, error) {
+	if dir == "" {
+		return "", nil
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, file := range files {
+		info, err := file.Info()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", file.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,73 @@
+package apispec
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const itemsSpec = `{"openapi":"3.0.0","info":{"title":"demo","version":"1"},"paths":{"/items":{"get":{"responses":{"200":{"description":"ok"}}}}}}`
+
+func writeSpecs(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name           string
+		files          map[string]string
+		wantOperations int
+		wantErrs       []string // files named in the error
+	}{
+		{"valid", map[string]string{"items.json": itemsSpec}, 1, nil},
+		{"empty", map[string]string{}, 0, nil},
+		{"one broken", map[string]string{"items.json": itemsSpec, "broken.json": `{"openapi":`}, 0, []string{"broken.json"}},
+		{"every broken file reported", map[string]string{"a.json": `{"openapi":`, "b.json": `{"openapi":"3.0.0"}`}, 0, []string{"a.json", "b.json"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spec, err := Load(context.Background(), "demo", writeSpecs(t, test.files))
+			if (err != nil) != (len(test.wantErrs) > 0) {
+				t.Fatalf("Load() error = %v, want errors for %v", err, test.wantErrs)
+			}
+			for _, file := range test.wantErrs {
+				if !strings.Contains(err.Error(), file) {
+					t.Errorf("Load() error = %v, want it to name %s", err, file)
+				}
+			}
+			if err == nil && len(spec.Operations) != test.wantOperations {
+				t.Errorf("Load() = %d operations, want %d", len(spec.Operations), test.wantOperations)
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	dir := writeSpecs(t, map[string]string{"items.json": itemsSpec})
+	before, err := Fingerprint(dir)
+	if err != nil {
+		t.Fatalf("Fingerprint() error = %v", err)
+	}
+	if again, _ := Fingerprint(dir); again != before {
+		t.Errorf("Fingerprint() changed without a change to the directory")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "orders.json"), []byte(itemsSpec), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := Fingerprint(dir); after == before {
+		t.Errorf("Fingerprint() did not change when a document was added")
+	}
+	if empty, err := Fingerprint(""); empty != "" || err != nil {
+		t.Errorf("Fingerprint(\"\") = %q, %v", empty, err)
+	}
+}
@@ -0,0 +1,201 @@
+package apispec
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// SecuritySchemeName is the security scheme of the Loral access token in a merged document
+const SecuritySchemeName = "loral"
+
+// MergeOptions describes the Loral server a merged document is published for
+type MergeOptions struct {
+	Title     string
+	ServerURL string // base URL of the execute proxy, ie. https://api.loral.dev
+	AuthURL   string // Loral authorization endpoint
+	TokenURL  string // Loral token endpoint
+}
+
+// Merge combines the specs of several providers into one OpenAPI 3 document describing the execute proxy.
+// Every path is moved under /{provider}/execute, operation IDs and component names are prefixed with the
+// provider and document they come from so they cannot collide, and the provider's own security is
+// replaced by the Loral access token with the provider as its scope.
+func Merge(specs []*Spec, options MergeOptions) ([]byte, error) {
+	paths := make(map[string]map[string]interface{})
+	components := map[string]map[string]interface{}{}
+	scopes := make(map[string]string)
+	var tags []map[string]interface{}
+
+	sort.Slice(specs, func(i, j int) bool { return specs[i].Provider < specs[j].Provider })
+	for _, spec := range specs {
+		if len(spec.Operations) == 0 {
+			continue
+		}
+		scopes[spec.Provider] = "Call the " + spec.Provider + " API as the user"
+		tags = append(tags, map[string]interface{}{"name": spec.Provider})
+
+		prefixes := make(map[*openapi3.T]string, len(spec.Docs))
+		for i, doc := range spec.Docs {
+			prefix := spec.Provider + "_" + strings.TrimSuffix(spec.Files[i], filepath.Ext(spec.Files[i])) + "_"
+			prefixes[doc] = prefix
+			if err := mergeComponents(components, doc.Components, prefix); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, op := range spec.Operations {
+			operation, err := toJSONMap(op.Operation)
+			if err != nil {
+				return nil, err
+			}
+			if err := inheritPathParameters(operation, op.PathItem); err != nil {
+				return nil, err
+			}
+			prefix := prefixes[op.Doc]
+			rewriteRefs(operation, prefix)
+			if id, ok := operation["operationId"].(string); ok {
+				operation["operationId"] = spec.Provider + "_" + id
+			}
+			operation["tags"] = []string{spec.Provider}
+			operation["security"] = []map[string][]string{{SecuritySchemeName: {spec.Provider}}}
+
+			path := "/" + spec.Provider + "/execute" + op.Path
+			if paths[path] == nil {
+				paths[path] = make(map[string]interface{})
+			}
+			paths[path][strings.ToLower(op.Method)] = operation
+		}
+	}
+
+	if components["securitySchemes"] == nil {
+		components["securitySchemes"] = make(map[string]interface{})
+	}
+	components["securitySchemes"][SecuritySchemeName] = map[string]interface{}{
+		"type":        "oauth2",
+		"description": "Loral access token, sent as `Authorization: Bearer <token>`. Each provider is a scope.",
+		"flows": map[string]interface{}{
+			"authorizationCode": map[string]interface{}{
+				"authorizationUrl": options.AuthURL,
+				"tokenUrl":         options.TokenURL,
+				"scopes":           scopes,
+			},
+		},
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"openapi":    "3.0.3",
+		"info":       map[string]string{"title": options.Title, "version": "1.0.0"},
+		"servers":    []map[string]string{{"url": options.ServerURL}},
+		"tags":       tags,
+		"paths":      paths,
+		"components": components,
+	})
+}
+
+// mergeComponents adds every component of a document to merged under prefixed names, except the
+// provider's own security schemes, which do not apply to callers of the proxy
+func mergeComponents(merged map[string]map[string]interface{}, c *openapi3.Components, prefix string) error {
+	if c == nil {
+		return nil
+	}
+	doc, err := toJSONMap(c)
+	if err != nil {
+		return err
+	}
+	delete(doc, "securitySchemes")
+	for kind, value := range doc {
+		entries, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if merged[kind] == nil {
+			merged[kind] = make(map[string]interface{})
+		}
+		for name, component := range entries {
+			rewriteRefs(component, prefix)
+			merged[kind][prefix+name] = component
+		}
+	}
+	return nil
+}
+
+// inheritPathParameters copies the path item's parameters onto the operation, which has the final say,
+// since operations from different documents may end up under one merged path item
+func inheritPathParameters(operation map[string]interface{}, pathItem *openapi3.PathItem) error {
+	if pathItem == nil || len(pathItem.Parameters) == 0 {
+		return nil
+	}
+	params, _ := operation["parameters"].([]interface{})
+	declared := make(map[string]bool)
+	for _, p := range params {
+		if param, ok := p.(map[string]interface{}); ok {
+			declared[paramKey(param)] = true
+		}
+	}
+	inherited, err := toJSONArray(pathItem.Parameters)
+	if err != nil {
+		return err
+	}
+	for _, p := range inherited {
+		if param, ok := p.(map[string]interface{}); ok && !declared[paramKey(param)] {
+			params = append(params, param)
+		}
+	}
+	operation["parameters"] = params
+	return nil
+}
+
+// paramKey identifies a parameter by location and name, or by its $ref
+func paramKey(param map[string]interface{}) string {
+	if ref, ok := param["$ref"].(string); ok {
+		return ref
+	}
+	in, _ := param["in"].(string)
+	name, _ := param["name"].(string)
+	return in + ":" + name
+}
+
+// rewriteRefs prefixes the component name of every local $ref below value
+func rewriteRefs(value interface{}, prefix string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if ref, ok := child.(string); ok && key == "$ref" && strings.HasPrefix(ref, "#/components/") {
+				parts := strings.SplitN(ref, "/", 4)
+				if len(parts) == 4 {
+					v[key] = "#/components/" + parts[2] + "/" + prefix + parts[3]
+				}
+				continue
+			}
+			rewriteRefs(child, prefix)
+		}
+	case []interface{}:
+		for _, child := range v {
+			rewriteRefs(child, prefix)
+		}
+	}
+}
+
+func toJSONMap(value interface{}) (map[string]interface{}, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(raw, &m)
+	return m, err
+}
+
+func toJSONArray(value interface{}) ([]interface{}, error) {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var a []interface{}
+	err = json.Unmarshal(raw, &a)
+	return a, err
+}
@@ -0,0 +1,124 @@
+package apispec
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+)
+
+// providerSpec declares GET /items/{id} with an Item schema and the provider's own security scheme
+const providerSpec = `{
+	"openapi": "3.0.0",
+	"info": {"title": "provider", "version": "1"},
+	"paths": {
+		"/items/{id}": {
+			"parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+			"get": {
+				"operationId": "getItem",
+				"security": [{"apiKey": []}],
+				"responses": {"200": {"description": "ok", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Item"}}}}}
+			}
+		}
+	},
+	"components": {
+		"schemas": {"Item": {"type": "object", "properties": {"tags": {"type": "array", "items": {"$ref": "#/components/schemas/Tag"}}}}, "Tag": {"type": "string"}},
+		"securitySchemes": {"apiKey": {"type": "apiKey", "in": "header", "name": "X-Key"}}
+	}
+}`
+
+func TestMerge(t *testing.T) {
+	var specs []*Spec
+	for _, provider := range []string{"kroger", "github", "empty"} {
+		files := map[string]string{"items.json": providerSpec}
+		if provider == "empty" {
+			files = nil
+		}
+		spec, err := Load(context.Background(), provider, writeSpecs(t, files))
+		if err != nil {
+			t.Fatal(err)
+		}
+		specs = append(specs, spec)
+	}
+
+	raw, err := Merge(specs, MergeOptions{Title: "Loral", ServerURL: "https://api.loral.dev", AuthURL: "https://auth.loral.dev/oauth2/auth", TokenURL: "https://auth.loral.dev/oauth2/token"})
+	if err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	// the merged document has to stand on its own, every $ref resolving within it
+	doc, err := openapi3.NewLoader().LoadFromData(raw)
+	if err != nil {
+		t.Fatalf("merged document does not load: %v", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		t.Fatalf("merged document is invalid: %v", err)
+	}
+
+	for _, provider := range []string{"github", "kroger"} {
+		t.Run(provider, func(t *testing.T) {
+			item := doc.Paths.Find("/" + provider + "/execute/items/{id}")
+			if item == nil || item.Get == nil {
+				t.Fatalf("merged document has no GET /%s/execute/items/{id}", provider)
+			}
+			op := item.Get
+			if op.OperationID != provider+"_getItem" {
+				t.Errorf("operationId = %q, want %s_getItem", op.OperationID, provider)
+			}
+			if op.Parameters.GetByInAndName("path", "id") == nil {
+				t.Errorf("the path item's id param was not carried onto the operation")
+			}
+			if want := (openapi3.SecurityRequirements{{SecuritySchemeName: {provider}}}); !reflect.DeepEqual(*op.Security, want) {
+				t.Errorf("security = %v, want %v", *op.Security, want)
+			}
+			schema := op.Responses.Status(200).Value.Content.Get("application/json").Schema
+			if want := "#/components/schemas/" + provider + "_items_Item"; schema.Ref != want {
+				t.Errorf("response schema $ref = %q, want %q", schema.Ref, want)
+			}
+			tag := doc.Components.Schemas[provider+"_items_Item"].Value.Properties["tags"].Value.Items
+			if want := "#/components/schemas/" + provider + "_items_Tag"; tag.Ref != want {
+				t.Errorf("nested $ref = %q, want %q", tag.Ref, want)
+			}
+		})
+	}
+
+	if doc.Paths.Len() != 2 {
+		t.Errorf("merged document has %d paths, want 2, the empty provider adding none", doc.Paths.Len())
+	}
+	schemes := doc.Components.SecuritySchemes
+	if len(schemes) != 1 || schemes[SecuritySchemeName] == nil {
+		t.Fatalf("security schemes = %v, want only %s", schemes, SecuritySchemeName)
+	}
+	flow := schemes[SecuritySchemeName].Value.Flows.AuthorizationCode
+	if flow.TokenURL != "https://auth.loral.dev/oauth2/token" || len(flow.Scopes) != 2 || flow.Scopes["empty"] != "" {
+		t.Errorf("authorization code flow = %+v, want a scope for github and kroger", flow)
+	}
+	if doc.Servers[0].URL != "https://api.loral.dev" {
+		t.Errorf("servers = %v", doc.Servers)
+	}
+}
+
+func TestRewriteRefs(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  interface{}
+	}{
+		{"local", map[string]interface{}{"$ref": "#/components/schemas/Item"}, map[string]interface{}{"$ref": "#/components/schemas/p_Item"}},
+		{"external left alone", map[string]interface{}{"$ref": "other.json#/Item"}, map[string]interface{}{"$ref": "other.json#/Item"}},
+		{
+			"nested in arrays",
+			map[string]interface{}{"allOf": []interface{}{map[string]interface{}{"$ref": "#/components/parameters/Id"}}},
+			map[string]interface{}{"allOf": []interface{}{map[string]interface{}{"$ref": "#/components/parameters/p_Id"}}},
+		},
+		{"a property named $ref", map[string]interface{}{"properties": map[string]interface{}{"$ref": map[string]interface{}{"type": "string"}}}, map[string]interface{}{"properties": map[string]interface{}{"$ref": map[string]interface{}{"type": "string"}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rewriteRefs(test.value, "p_")
+			if !reflect.DeepEqual(test.value, test.want) {
+				t.Errorf("rewriteRefs() = %v, want %v", test.value, test.want)
+			}
+		})
+	}
+}
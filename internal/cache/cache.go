@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMaxEntries = 1000
+
+// Entry is a cached upstream response, with the headers already filtered for the client
+type Entry struct {
+	Status int
+	Header http.Header
+	Body   []byte
+
+	Vary     map[string]string // request headers the response varies on, and their values when it was stored
+	StoredAt time.Time
+	Expires  time.Time // fresh until then, after which it must be revalidated with ETag or LastModified
+}
+
+// Fresh reports whether the entry can be served without asking the provider
+func (e *Entry) Fresh(now time.Time) bool {
+	return now.Before(e.Expires)
+}
+
+// Matches reports whether the entry was stored for a request with the same varying headers as header
+func (e *Entry) Matches(header http.Header) bool {
+	for name, value := range e.Vary {
+		if header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Revalidatable reports whether the provider can confirm a stale entry with a 304
+func (e *Entry) Revalidatable() bool {
+	return e.Header.Get("ETag") != "" || e.Header.Get("Last-Modified") != ""
+}
+
+// SetConditional adds the entry's validators to an upstream request
+func (e *Entry) SetConditional(header http.Header) {
+	if etag := e.Header.Get("ETag"); etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	if lastModified := e.Header.Get("Last-Modified"); lastModified != "" {
+		header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// Age is how long ago the entry was stored or last revalidated
+func (e *Entry) Age(now time.Time) time.Duration {
+	return now.Sub(e.StoredAt)
+}
+
+// Cache is a least recently used cache of upstream responses, safe for concurrent use
+type Cache struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List // front is most recently used
+	items      map[string]*list.Element
+}
+
+type item struct {
+	key   string
+	entry *Entry
+}
+
+func New(maxEntries int) *Cache {
+	if maxEntries <= 0 {
+		maxEntries = defaultMaxEntries
+	}
+	return &Cache{maxEntries: maxEntries, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// Key identifies a response by provider, scope ("shared" or the user ID) and the upstream path with
+// its normalized query
+func Key(provider string, scope string, pathAndQuery string) string {
+	return provider + "|" + scope + "|" + pathAndQuery
+}
+
+func (c *Cache) Get(key string) *Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*item).entry
+}
+
+func (c *Cache) Set(key string, entry *Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.items[key]; ok {
+		element.Value.(*item).entry = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.items[key] = c.order.PushFront(&item{key: key, entry: entry})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*item).key)
+	}
+}
+
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.items[key]; ok {
+		c.order.Remove(element)
+		delete(c.items, key)
+	}
+}
+
+// Directives are the Cache-Control directives the cache acts on
+type Directives struct {
+	NoStore bool
+	NoCache bool
+	Private bool
+	MaxAge  *time.Duration
+	SMaxAge *time.Duration
+}
+
+// ParseCacheControl reads the Cache-Control headers of a request or response
+func ParseCacheControl(header http.Header) Directives {
+	var d Directives
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			switch strings.ToLower(name) {
+			case "no-store":
+				d.NoStore = true
+			case "no-cache":
+				d.NoCache = true
+			case "private":
+				d.Private = true
+			case "max-age":
+				d.MaxAge = parseSeconds(arg)
+			case "s-maxage":
+				d.SMaxAge = parseSeconds(arg)
+			}
+		}
+	}
+	return d
+}
+
+func parseSeconds(arg string) *time.Duration {
+	seconds, err := strconv.Atoi(strings.Trim(arg, `"`))
+	if err != nil || seconds < 0 {
+		return nil
+	}
+	d := time.Duration(seconds) * time.Second
+	return &d
+}
+
+// Lifetime returns how long a response stays fresh according to its headers, preferring s-maxage for
+// shared entries, then max-age, then Expires. A response without any of them is not fresh at all.
+func Lifetime(header http.Header, shared bool, now time.Time) time.Duration {
+	d := ParseCacheControl(header)
+	var lifetime time.Duration
+	switch {
+	case d.NoCache:
+		return 0
+	case shared && d.SMaxAge != nil:
+		lifetime = *d.SMaxAge
+	case d.MaxAge != nil:
+		lifetime = *d.MaxAge
+	default:
+		expires, err := http.ParseTime(header.Get("Expires"))
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		lifetime = expires.Sub(date)
+	}
+
+	// the provider may have served it from its own cache already
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil {
+		lifetime -= time.Duration(age) * time.Second
+	}
+	if lifetime < 0 {
+		return 0
+	}
+	return lifetime
+}
+
+// VaryHeaders returns the request headers named by the response's Vary, and false for Vary: *
+func VaryHeaders(response http.Header, request http.Header) (map[string]string, bool) {
+	vary := make(map[string]string)
+	for _, value := range response.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				vary[http.CanonicalHeaderKey(name)] = request.Get(name)
+			}
+		}
+	}
+	return vary, true
+}
@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCacheEviction(t *testing.T) {
+	c := New(2)
+	c.Set("a", &Entry{Status: 1})
+	c.Set("b", &Entry{Status: 2})
+	c.Get("a") // b is now the least recently used
+	c.Set("c", &Entry{Status: 3})
+
+	tests := []struct {
+		key  string
+		want int // status of the entry, 0 if evicted
+	}{
+		{"a", 1},
+		{"b", 0},
+		{"c", 3},
+	}
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			entry := c.Get(test.key)
+			if (entry == nil) != (test.want == 0) || (entry != nil && entry.Status != test.want) {
+				t.Errorf("Get(%q) = %+v, want status %d", test.key, entry, test.want)
+			}
+		})
+	}
+
+	c.Set("a", &Entry{Status: 4})
+	c.Delete("c")
+	if entry := c.Get("a"); entry == nil || entry.Status != 4 || c.Get("c") != nil || c.order.Len() != 1 {
+		t.Errorf("after Set and Delete the cache holds %d entries", c.order.Len())
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	seconds := func(s int) *time.Duration { d := time.Duration(s) * time.Second; return &d }
+	tests := []struct {
+		name   string
+		values []string
+		want   Directives
+	}{
+		{"none", nil, Directives{}},
+		{"max-age", []string{"public, max-age=60"}, Directives{MaxAge: seconds(60)}},
+		{"quoted and cased", []string{`Max-Age="30", S-MAXAGE=120`}, Directives{MaxAge: seconds(30), SMaxAge: seconds(120)}},
+		{"several headers", []string{"private", "no-cache, no-store"}, Directives{Private: true, NoCache: true, NoStore: true}},
+		{"invalid age", []string{"max-age=-1, s-maxage=soon"}, Directives{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ParseCacheControl(http.Header{"Cache-Control": test.values}); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseCacheControl(%q) = %+v, want %+v", test.values, got, test.want)
+			}
+		})
+	}
+}
+
+func TestLifetime(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		header http.Header
+		shared bool
+		want   time.Duration
+	}{
+		{"nothing", http.Header{}, false, 0},
+		{"max-age", http.Header{"Cache-Control": {"max-age=60"}}, false, time.Minute},
+		{"s-maxage for shared entries", http.Header{"Cache-Control": {"max-age=60, s-maxage=300"}}, true, 5 * time.Minute},
+		{"s-maxage ignored per user", http.Header{"Cache-Control": {"max-age=60, s-maxage=300"}}, false, time.Minute},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache, max-age=60"}}, false, 0},
+		{"Expires", http.Header{"Date": {date}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, false, time.Hour},
+		{"Expires without Date", http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, false, time.Hour},
+		{"invalid Expires", http.Header{"Expires": {"0"}}, false, 0},
+		{"Age", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"45"}}, false, 15 * time.Second},
+		{"older than its max-age", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"90"}}, false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Lifetime(test.header, test.shared, now); got != test.want {
+				t.Errorf("Lifetime() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestVaryHeaders(t *testing.T) {
+	request := http.Header{"Accept": {"application/json"}, "Accept-Language": {"en"}}
+	tests := []struct {
+		name   string
+		vary   []string
+		want   map[string]string
+		wantOK bool
+	}{
+		{"none", nil, map[string]string{}, true},
+		{"listed", []string{"accept, accept-language"}, map[string]string{"Accept": "application/json", "Accept-Language": "en"}, true},
+		{"absent from the request", []string{"X-Tenant"}, map[string]string{"X-Tenant": ""}, true},
+		{"star", []string{"Accept", "*"}, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := VaryHeaders(http.Header{"Vary": test.vary}, request)
+			if ok != test.wantOK || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("VaryHeaders() = %v, %v, want %v, %v", got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+}
+
+func TestEntry(t *testing.T) {
+	now := time.Now()
+	entry := &Entry{
+		Header:   http.Header{"Etag": {`"v1"`}},
+		Vary:     map[string]string{"Accept": "application/json"},
+		StoredAt: now.Add(-time.Minute),
+		Expires:  now.Add(time.Minute),
+	}
+	if !entry.Fresh(now) || entry.Fresh(now.Add(2*time.Minute)) {
+		t.Errorf("Fresh() does not follow Expires")
+	}
+	if !entry.Matches(http.Header{"Accept": {"application/json"}}) || entry.Matches(http.Header{"Accept": {"text/html"}}) {
+		t.Errorf("Matches() does not follow the varying headers")
+	}
+	if entry.Age(now) != time.Minute {
+		t.Errorf("Age() = %v, want a minute", entry.Age(now))
+	}
+
+	conditional := http.Header{}
+	entry.SetConditional(conditional)
+	if conditional.Get("If-None-Match") != `"v1"` || conditional.Get("If-Modified-Since") != "" {
+		t.Errorf("SetConditional() = %v", conditional)
+	}
+	if !entry.Revalidatable() || (&Entry{Header: http.Header{}}).Revalidatable() {
+		t.Errorf("Revalidatable() does not follow the validators")
+	}
+}
@@ -1,70 +1,301 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/getkin/kin-openapi/openapi3"
 	"github.com/joho/godotenv"
 )
 
-type Provider struct {
-	Name    string
-	APIRoot string
-	Paths   map[string]openapi3.PathItem
-}
+const (
+	defaultProvidersFile = "providers.yaml"
+	defaultStateTTL      = 10 * time.Minute
+)
 
 type Config struct {
 	Providers []Provider
 
-	KrogerClientID     string
-	KrogerClientSecret string
-	KrogerRedirectURI  string
-	KrogerScopes       string
-
-	GoogleClientID     string
-	GoogleClientSecret string
-	GoogleRedirectURI  string
-	GoogleScopes       string
-
 	DBConnectionString string
 	OryActionsSecret   string
+
+	// IdentityBackend holds Loral OAuth clients and their tokens: "ory" (default), the Ory project at OryURL,
+	// or "local", the clients table in Postgres, which needs no Ory project
+	IdentityBackend string
+	OryURL          string
+
+	// StateSecret is the HMAC key for the OAuth state sent to providers, shared by all replicas
+	StateSecret string
+	StateTTL    time.Duration
+
+	// TokenKeysFile is the JSON key file used to encrypt provider tokens at rest, see keyring.Load
+	TokenKeysFile string
+
+	// TokenExpirySkew refreshes provider tokens this long before their reported expiry
+	TokenExpirySkew time.Duration
+	Refresher       RefresherConfig
+
+	// MaxRequestBodyBytes caps the body of an execute request, which is buffered for validation and retries
+	MaxRequestBodyBytes int64
+	// ValidateResponses turns on response validation for every provider, see Provider.ValidateResponses
+	ValidateResponses bool
+	// DriftReportEnabled serves the response drift report on /drift and metrics on /debug/vars
+	DriftReportEnabled bool
+
+	// PublicURL is where clients reach this server, published in /openapi.json
+	PublicURL string
+	// IssuerURL is the Loral authorization server clients get access tokens from
+	IssuerURL string
+	// TokenValidation controls how the access tokens of Loral clients are checked
+	TokenValidation TokenValidationConfig
+	// AuthorizationServer configures the OAuth 2.0 server Loral runs itself with the local identity backend
+	AuthorizationServer AuthorizationServerConfig
+
+	// AdminSecret guards the /admin endpoints, which are off when it is empty
+	AdminSecret string
+	// SpecReloadInterval is how often spec directories are checked for changes, 0 turns the watcher off
+	SpecReloadInterval time.Duration
+
+	// RateLimitBackend keeps rate limit buckets in "memory" (default) or in "postgres", shared by all replicas
+	RateLimitBackend string
+}
+
+// RefresherConfig controls the background job that refreshes provider tokens before they expire
+type RefresherConfig struct {
+	Enabled      bool
+	Interval     time.Duration // time between scans
+	Window       time.Duration // refresh tokens expiring within this window
+	Concurrency  int           // refreshes in flight at once
+	Jitter       time.Duration // max random delay before each refresh
+	BatchSize    int           // tokens refreshed per scan
+	RetryBackoff time.Duration // wait after a failed refresh before the refresher retries it
+}
+
+// TokenValidationConfig controls how access tokens are validated. By default every token is introspected
+// with the authorization server; LocalJWT verifies JWT access tokens against its JWKS instead, and only
+// opaque tokens are introspected.
+type TokenValidationConfig struct {
+	LocalJWT            bool
+	JWKSURL             string
+	JWKSRefreshInterval time.Duration
+	Audience            string // required in the aud claim of JWTs if set, Hydra only sets aud for clients that request one
+
+	// IntrospectionCacheTTL is how long an active introspection result is reused, 0 turns the cache off.
+	// A revoked token stays usable for up to this long.
+	IntrospectionCacheTTL  time.Duration
+	IntrospectionCacheSize int
+}
+
+// AuthorizationServerConfig controls the built-in authorization server, which issues RS256 JWT access tokens
+type AuthorizationServerConfig struct {
+	// SigningKeyFile is a PEM encoded RSA private key. Without one a key is generated at startup, so tokens
+	// do not survive a restart and are only valid on the replica that issued them.
+	SigningKeyFile  string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
 }
 
-func LoadConfig() *Config {
+func LoadConfig() (*Config, error) {
 	// load from .env file if it exists, otherwise in prod enviroment
 	err := godotenv.Load()
 	if err != nil {
 		log.Default().Printf("Error loading .env file: %v\n", err)
 	}
 
-	providers := []Provider{
-		{
-			Name:    "kroger",
-			APIRoot: "https://api.kroger.com",
-			Paths:   make(map[string]openapi3.PathItem),
-		},
-		{
-			Name:    "google",
-			APIRoot: "https://www.googleapis.com",
-			Paths:   make(map[string]openapi3.PathItem),
-		},
+	providersFile := os.Getenv("PROVIDERS_FILE")
+	if providersFile == "" {
+		providersFile = defaultProvidersFile
+	}
+	providers, err := LoadProviders(providersFile)
+	if err != nil {
+		return nil, err
+	}
+
+	stateSecret := os.Getenv("OAUTH_STATE_SECRET")
+	if len(stateSecret) < 32 {
+		return nil, errors.New("OAUTH_STATE_SECRET must be set to at least 32 characters")
+	}
+	stateTTL, err := durationEnv("OAUTH_STATE_TTL", defaultStateTTL)
+	if err != nil {
+		return nil, err
 	}
 
-	return &Config{
-		Providers: providers,
+	tokenExpirySkew, err := durationEnv("TOKEN_EXPIRY_SKEW", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	refresher, err := loadRefresherConfig()
+	if err != nil {
+		return nil, err
+	}
 
-		KrogerClientID:     os.Getenv("KROGER_CLIENT_ID"),
-		KrogerClientSecret: os.Getenv("KROGER_CLIENT_SECRET"),
-		KrogerRedirectURI:  os.Getenv("KROGER_REDIRECT_URI"),
-		KrogerScopes:       os.Getenv("KROGER_SCOPES"),
+	identityBackend := envOr("IDENTITY_BACKEND", "ory")
+	if identityBackend != "ory" && identityBackend != "local" {
+		return nil, fmt.Errorf("IDENTITY_BACKEND must be \"ory\" or \"local\", got %q", identityBackend)
+	}
 
-		GoogleClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
-		GoogleClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
-		GoogleRedirectURI:  os.Getenv("GOOGLE_REDIRECT_URI"),
-		GoogleScopes:       os.Getenv("GOOGLE_SCOPES"),
+	publicURL := envOr("PUBLIC_URL", "https://api.loral.dev")
+	issuerURL := envOr("OAUTH_ISSUER_URL", "https://auth.loral.dev")
+	tokenValidation, err := loadTokenValidationConfig(issuerURL, publicURL)
+	if err != nil {
+		return nil, err
+	}
+
+	authorizationServer := AuthorizationServerConfig{SigningKeyFile: os.Getenv("OAUTH_SIGNING_KEY_FILE")}
+	authorizationServer.AccessTokenTTL, err = durationEnv("ACCESS_TOKEN_TTL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	authorizationServer.RefreshTokenTTL, err = durationEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if authorizationServer.AccessTokenTTL <= 0 || authorizationServer.RefreshTokenTTL <= 0 {
+		return nil, errors.New("ACCESS_TOKEN_TTL and REFRESH_TOKEN_TTL must be positive")
+	}
+
+	specReloadInterval, err := durationEnv("SPEC_RELOAD_INTERVAL", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	maxRequestBodyBytes, err := intEnv("MAX_REQUEST_BODY_BYTES", 10<<20)
+	if err != nil {
+		return nil, err
+	}
+	if maxRequestBodyBytes <= 0 {
+		return nil, errors.New("MAX_REQUEST_BODY_BYTES must be positive")
+	}
+
+	rateLimitBackend := os.Getenv("RATE_LIMIT_BACKEND")
+	if rateLimitBackend == "" {
+		rateLimitBackend = "memory"
+	}
+	if rateLimitBackend != "memory" && rateLimitBackend != "postgres" {
+		return nil, fmt.Errorf("RATE_LIMIT_BACKEND must be \"memory\" or \"postgres\", got %q", rateLimitBackend)
+	}
+
+	return &Config{
+		Providers: providers,
 
 		DBConnectionString: os.Getenv("DB_CONNECTION_STRING"),
 		OryActionsSecret:   os.Getenv("ORY_ACTIONS_SECRET"),
+
+		IdentityBackend: identityBackend,
+		OryURL:          envOr("ORY_URL", "https://fervent-cori-shm6sflkse.projects.oryapis.com"),
+
+		StateSecret: stateSecret,
+		StateTTL:    stateTTL,
+
+		TokenKeysFile: os.Getenv("TOKEN_KEYS_FILE"),
+
+		TokenExpirySkew: tokenExpirySkew,
+		Refresher:       *refresher,
+
+		MaxRequestBodyBytes: int64(maxRequestBodyBytes),
+		ValidateResponses:   os.Getenv("VALIDATE_RESPONSES") == "true",
+		DriftReportEnabled:  os.Getenv("DRIFT_REPORT_ENABLED") == "true",
+
+		PublicURL:           publicURL,
+		IssuerURL:           issuerURL,
+		TokenValidation:     *tokenValidation,
+		AuthorizationServer: authorizationServer,
+
+		AdminSecret:        os.Getenv("ADMIN_SECRET"),
+		SpecReloadInterval: specReloadInterval,
+
+		RateLimitBackend: rateLimitBackend,
+	}, nil
+}
+
+func loadRefresherConfig() (*RefresherConfig, error) {
+	c := &RefresherConfig{Enabled: os.Getenv("TOKEN_REFRESHER_ENABLED") != "false"}
+	var errs []error
+	var err error
+	c.Interval, err = durationEnv("TOKEN_REFRESHER_INTERVAL", time.Minute)
+	errs = append(errs, err)
+	c.Window, err = durationEnv("TOKEN_REFRESHER_WINDOW", 5*time.Minute)
+	errs = append(errs, err)
+	c.Jitter, err = durationEnv("TOKEN_REFRESHER_JITTER", 10*time.Second)
+	errs = append(errs, err)
+	c.RetryBackoff, err = durationEnv("TOKEN_REFRESHER_RETRY_BACKOFF", 5*time.Minute)
+	errs = append(errs, err)
+	c.Concurrency, err = intEnv("TOKEN_REFRESHER_CONCURRENCY", 4)
+	errs = append(errs, err)
+	c.BatchSize, err = intEnv("TOKEN_REFRESHER_BATCH_SIZE", 100)
+	errs = append(errs, err)
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if c.Interval <= 0 || c.Concurrency <= 0 || c.BatchSize <= 0 {
+		return nil, errors.New("TOKEN_REFRESHER_INTERVAL, TOKEN_REFRESHER_CONCURRENCY and TOKEN_REFRESHER_BATCH_SIZE must be positive")
+	}
+	return c, nil
+}
+
+func loadTokenValidationConfig(issuerURL string, publicURL string) (*TokenValidationConfig, error) {
+	c := &TokenValidationConfig{
+		JWKSURL:  envOr("JWKS_URL", strings.TrimSuffix(issuerURL, "/")+"/.well-known/jwks.json"),
+		Audience: os.Getenv("TOKEN_AUDIENCE"),
+	}
+	switch mode := envOr("TOKEN_VALIDATION", "introspect"); mode {
+	case "introspect":
+	case "jwt":
+		c.LocalJWT = true
+	default:
+		return nil, fmt.Errorf("TOKEN_VALIDATION must be \"introspect\" or \"jwt\", got %q", mode)
+	}
+	var errs []error
+	var err error
+	c.JWKSRefreshInterval, err = durationEnv("JWKS_REFRESH_INTERVAL", 5*time.Minute)
+	errs = append(errs, err)
+	c.IntrospectionCacheTTL, err = durationEnv("INTROSPECTION_CACHE_TTL", 0)
+	errs = append(errs, err)
+	c.IntrospectionCacheSize, err = intEnv("INTROSPECTION_CACHE_SIZE", 10000)
+	errs = append(errs, err)
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	if c.JWKSRefreshInterval <= 0 || c.IntrospectionCacheSize <= 0 {
+		return nil, errors.New("JWKS_REFRESH_INTERVAL and INTROSPECTION_CACHE_SIZE must be positive")
+	}
+	return c, nil
+}
+
+// envOr returns the environment variable name, or fallback if unset
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// intEnv parses an integer from the environment, or returns fallback if unset
+func intEnv(name string, fallback int) (int, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return n, nil
+}
+
+// durationEnv parses a Go duration string such as "10m" from the environment, or returns fallback if unset
+func durationEnv(name string, fallback time.Duration) (time.Duration, error) {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
 	}
+	return d, nil
 }
@@ -0,0 +1,358 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// OAuth describes how to run the authorization code flow against a provider
+type OAuth struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RedirectURI  string `yaml:"redirect_uri"`
+	Scopes       Scopes `yaml:"scopes"`
+
+	AuthURL        string            `yaml:"auth_url"`
+	TokenURL       string            `yaml:"token_url"`
+	AuthStyle      string            `yaml:"client_auth"`     // "basic" or "body"
+	AuthParams     map[string]string `yaml:"auth_params"`     // extra query params sent to AuthURL
+	ScopeSeparator string            `yaml:"scope_separator"` // defaults to a single space
+	PKCE           string            `yaml:"pkce"`            // "S256" (default), "plain" or "disabled"
+}
+
+// Scopes is a YAML list of scopes, or a single space separated string so it can come from one env variable
+type Scopes []string
+
+func (s *Scopes) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*s = strings.Fields(node.Value)
+		return nil
+	}
+	return node.Decode((*[]string)(s))
+}
+
+type Provider struct {
+	Name    string `yaml:"name"`
+	APIRoot string `yaml:"api_root"`
+	SpecDir string `yaml:"spec_dir"` // directory of OpenAPI documents, optional
+	OAuth   OAuth  `yaml:"oauth"`
+
+	// ValidateResponses checks upstream responses against the spec and reports drift
+	ValidateResponses bool `yaml:"validate_responses"`
+
+	Headers HeaderPolicy  `yaml:"headers"`
+	HTTP    HTTPConfig    `yaml:"http"`
+	Retry   RetryConfig   `yaml:"retry"`
+	Breaker BreakerConfig `yaml:"circuit_breaker"`
+
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Cache     CacheConfig     `yaml:"cache"`
+}
+
+// CacheConfig turns on the in-memory cache for GET operations of the provider, see the cache package
+type CacheConfig struct {
+	Enabled      bool  `yaml:"enabled"`
+	MaxEntries   int   `yaml:"max_entries"`    // least recently used entries are evicted past this, defaults to 1000
+	MaxBodyBytes int64 `yaml:"max_body_bytes"` // larger responses are not cached, defaults to 1 MiB
+}
+
+// HTTPConfig tunes the HTTP client used for both proxied calls and token requests to a provider.
+// Zero values fall back to the defaults in the upstream package.
+type HTTPConfig struct {
+	Timeout               time.Duration `yaml:"timeout"`                 // whole call including retries and reading the body
+	DialTimeout           time.Duration `yaml:"dial_timeout"`            // TCP connect
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout"`   // TLS handshake
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"` // wait for the status line after the request is sent
+	IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout"`       // close pooled connections idle this long
+	MaxIdleConns          int           `yaml:"max_idle_conns"`          // pooled connections to the provider
+
+	ProxyURL string `yaml:"proxy_url"` // outbound proxy, defaults to HTTPS_PROXY/HTTP_PROXY from the environment
+	CABundle string `yaml:"ca_bundle"` // PEM file of extra CAs trusted for the provider
+}
+
+// HeaderPolicy controls which headers the execute proxy passes through in each direction.
+// Hop-by-hop headers and credentials are always stripped.
+type HeaderPolicy struct {
+	Request  HeaderRules `yaml:"request"`  // client to provider
+	Response HeaderRules `yaml:"response"` // provider to client
+}
+
+type HeaderRules struct {
+	Allow []string          `yaml:"allow"` // forwarded in addition to the defaults, a trailing * matches any suffix
+	Deny  []string          `yaml:"deny"`  // never forwarded, wins over allow
+	Set   map[string]string `yaml:"set"`   // static headers added to every message
+}
+
+// RetryConfig controls how idempotent upstream calls are retried. Zero values fall back to the defaults in the upstream package.
+type RetryConfig struct {
+	MaxAttempts    int           `yaml:"max_attempts"`    // including the first try, 1 disables retries
+	InitialBackoff time.Duration `yaml:"initial_backoff"` // doubled after every attempt
+	MaxBackoff     time.Duration `yaml:"max_backoff"`     // longest wait between attempts, a longer Retry-After is relayed instead
+	Statuses       []int         `yaml:"statuses"`        // response codes worth retrying
+}
+
+// BreakerConfig controls the per-provider circuit breaker in front of upstream calls
+type BreakerConfig struct {
+	FailureThreshold int           `yaml:"failure_threshold"` // consecutive failures that open the circuit, -1 disables it
+	OpenFor          time.Duration `yaml:"open_for"`          // how long to fail fast before letting a probe request through
+}
+
+// RateLimitConfig limits calls to /{provider}/execute. Each Loral OAuth client and each end user
+// gets its own token bucket, the provider one shared by everybody, and an empty limit is not enforced.
+type RateLimitConfig struct {
+	Provider RateLimit            `yaml:"provider"` // across every client and user, ie. the provider's own quota
+	Client   RateLimit            `yaml:"client"`   // per Loral OAuth client, shared by all its users
+	User     RateLimit            `yaml:"user"`     // per end user, across clients
+	Clients  map[string]RateLimit `yaml:"clients"`  // per client ID overrides of Client
+}
+
+// RateLimit allows Requests per Per on average, in bursts of up to Burst (defaults to Requests)
+type RateLimit struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+	Burst    int           `yaml:"burst"`
+}
+
+// Enabled reports whether the limit is set
+func (l RateLimit) Enabled() bool {
+	return l.Requests > 0
+}
+
+func (l RateLimit) validate() error {
+	if l.Requests < 0 || l.Burst < 0 || l.Per < 0 {
+		return errors.New("must not be negative")
+	}
+	if l.Requests > 0 && l.Per == 0 {
+		return errors.New("per is required with requests")
+	}
+	return nil
+}
+
+type providersFile struct {
+	Providers []Provider `yaml:"providers"`
+}
+
+var (
+	envPattern      = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+	namePattern     = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	validAuthStyles = map[string]bool{"basic": true, "body": true}
+	validPKCE       = map[string]bool{"S256": true, "plain": true, "disabled": true}
+)
+
+// LoadProviders reads the providers file at path, interpolating ${VAR} and
+// ${VAR:-default} references from the environment, and validates every entry
+func LoadProviders(path string) ([]Provider, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading providers file: %w", err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(raw, &root); err != nil {
+		return nil, fmt.Errorf("parsing providers file %s: %w", path, err)
+	}
+
+	// interpolate scalar values only, so comments and keys are left untouched. Unset variables in a
+	// provider's oauth block disable the provider, anywhere else they are an error.
+	oauthNodes := providerOAuthNodes(&root)
+	unsetCredentials := make(map[int][]string)
+	var errs []error
+	interpolate(&root, func(node *yaml.Node, name string) {
+		if i, ok := oauthNodes[node]; ok {
+			unsetCredentials[i] = append(unsetCredentials[i], name)
+			return
+		}
+		errs = append(errs, fmt.Errorf("line %d: environment variable %s is not set", node.Line, name))
+	})
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid providers file %s:\n%w", path, errors.Join(errs...))
+	}
+
+	var file providersFile
+	if err := root.Decode(&file); err != nil {
+		return nil, fmt.Errorf("parsing providers file %s: %w", path, err)
+	}
+	enabled := file.Providers[:0]
+	for i, p := range file.Providers {
+		if names, ok := unsetCredentials[i]; ok {
+			log.Printf("Provider %s is disabled, %s not set", p.Name, strings.Join(names, ", "))
+			continue
+		}
+		enabled = append(enabled, p)
+	}
+	file.Providers = enabled
+
+	if err := validateProviders(file.Providers); err != nil {
+		return nil, fmt.Errorf("invalid providers file %s:\n%w", path, err)
+	}
+
+	for i := range file.Providers {
+		if file.Providers[i].OAuth.PKCE == "" {
+			file.Providers[i].OAuth.PKCE = "S256"
+		}
+	}
+	return file.Providers, nil
+}
+
+// providerOAuthNodes maps every node below the oauth block of a provider to the provider's index
+func providerOAuthNodes(root *yaml.Node) map[*yaml.Node]int {
+	nodes := make(map[*yaml.Node]int)
+	var mark func(node *yaml.Node, i int)
+	mark = func(node *yaml.Node, i int) {
+		nodes[node] = i
+		for _, child := range node.Content {
+			mark(child, i)
+		}
+	}
+
+	if len(root.Content) == 0 {
+		return nodes
+	}
+	list := mappingValue(root.Content[0], "providers")
+	if list == nil || list.Kind != yaml.SequenceNode {
+		return nodes
+	}
+	for i, provider := range list.Content {
+		if oauth := mappingValue(provider, "oauth"); oauth != nil {
+			mark(oauth, i)
+		}
+	}
+	return nodes
+}
+
+// mappingValue returns the value of key in a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// interpolate expands env references in every scalar below node, reporting unset variables without a default
+func interpolate(node *yaml.Node, unset func(node *yaml.Node, name string)) {
+	if node.Kind == yaml.ScalarNode {
+		node.Value = envPattern.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			match := envPattern.FindStringSubmatch(ref)
+			if value, ok := os.LookupEnv(match[1]); ok {
+				return value
+			}
+			if match[2] == "" {
+				unset(node, match[1])
+			}
+			return match[3]
+		})
+		return
+	}
+	for _, child := range node.Content {
+		interpolate(child, unset)
+	}
+}
+
+func validateProviders(providers []Provider) error {
+	if len(providers) == 0 {
+		return errors.New("no providers defined")
+	}
+
+	var errs []error
+	seen := make(map[string]bool)
+	for i, p := range providers {
+		fail := func(format string, args ...interface{}) {
+			errs = append(errs, fmt.Errorf("providers[%d] (%s): %s", i, p.Name, fmt.Sprintf(format, args...)))
+		}
+
+		if !namePattern.MatchString(p.Name) {
+			fail("name must be lowercase alphanumeric, '-' or '_'")
+		} else if seen[p.Name] {
+			fail("duplicate provider name")
+		}
+		seen[p.Name] = true
+
+		if !isAbsoluteURL(p.APIRoot) {
+			fail("api_root %q is not an absolute URL", p.APIRoot)
+		}
+		if p.SpecDir != "" {
+			if info, err := os.Stat(p.SpecDir); err != nil || !info.IsDir() {
+				fail("spec_dir %q is not a readable directory", p.SpecDir)
+			}
+		}
+
+		if p.OAuth.ClientID == "" {
+			fail("oauth.client_id is empty")
+		}
+		if p.OAuth.ClientSecret == "" {
+			fail("oauth.client_secret is empty")
+		}
+		if !isAbsoluteURL(p.OAuth.RedirectURI) {
+			fail("oauth.redirect_uri %q is not an absolute URL", p.OAuth.RedirectURI)
+		}
+		if !isAbsoluteURL(p.OAuth.AuthURL) {
+			fail("oauth.auth_url %q is not an absolute URL", p.OAuth.AuthURL)
+		}
+		if !isAbsoluteURL(p.OAuth.TokenURL) {
+			fail("oauth.token_url %q is not an absolute URL", p.OAuth.TokenURL)
+		}
+		if !validAuthStyles[p.OAuth.AuthStyle] {
+			fail("oauth.client_auth must be \"basic\" or \"body\", got %q", p.OAuth.AuthStyle)
+		}
+		if p.OAuth.PKCE != "" && !validPKCE[p.OAuth.PKCE] {
+			fail("oauth.pkce must be \"S256\", \"plain\" or \"disabled\", got %q", p.OAuth.PKCE)
+		}
+
+		if p.HTTP.Timeout < 0 || p.HTTP.DialTimeout < 0 || p.HTTP.TLSHandshakeTimeout < 0 ||
+			p.HTTP.ResponseHeaderTimeout < 0 || p.HTTP.IdleConnTimeout < 0 || p.HTTP.MaxIdleConns < 0 {
+			fail("http timeouts and max_idle_conns must not be negative")
+		}
+		if p.Retry.MaxAttempts < 0 || p.Retry.InitialBackoff < 0 || p.Retry.MaxBackoff < 0 || p.Breaker.OpenFor < 0 {
+			fail("retry and circuit_breaker settings must not be negative")
+		}
+		for _, status := range p.Retry.Statuses {
+			if status < 400 || status > 599 {
+				fail("retry.statuses contains %d, which is not an error status", status)
+			}
+		}
+		if err := p.RateLimit.Provider.validate(); err != nil {
+			fail("rate_limit.provider %v", err)
+		}
+		if err := p.RateLimit.Client.validate(); err != nil {
+			fail("rate_limit.client %v", err)
+		}
+		if err := p.RateLimit.User.validate(); err != nil {
+			fail("rate_limit.user %v", err)
+		}
+		for clientID, limit := range p.RateLimit.Clients {
+			if err := limit.validate(); err != nil {
+				fail("rate_limit.clients.%s %v", clientID, err)
+			}
+		}
+		if p.Cache.MaxEntries < 0 || p.Cache.MaxBodyBytes < 0 {
+			fail("cache settings must not be negative")
+		}
+		if p.HTTP.ProxyURL != "" && !isAbsoluteURL(p.HTTP.ProxyURL) {
+			fail("http.proxy_url %q is not an absolute URL", p.HTTP.ProxyURL)
+		}
+		if p.HTTP.CABundle != "" {
+			if _, err := os.Stat(p.HTTP.CABundle); err != nil {
+				fail("http.ca_bundle %q is not readable", p.HTTP.CABundle)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func isAbsoluteURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && u.Scheme != "" && u.Host != ""
+}
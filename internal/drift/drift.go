@@ -0,0 +1,99 @@
+package drift
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxSamples bounds how many distinct mismatch messages are kept per operation
+const maxSamples = 5
+
+// mismatches counts responses that did not match the spec, keyed by "provider METHOD /path", under /debug/vars
+var mismatches = expvar.NewMap("loral_response_drift")
+
+// Entry summarizes the schema drift seen for one provider operation
+type Entry struct {
+	Provider   string    `json:"provider"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Mismatches int64     `json:"mismatches"`
+	LastStatus int       `json:"last_status"`
+	LastSeen   time.Time `json:"last_seen"`
+	Samples    []string  `json:"samples"` // distinct mismatch messages, oldest first
+}
+
+// Recorder keeps an in-memory drift report for the life of the process
+type Recorder struct {
+	mu      sync.Mutex
+	entries map[string]*Entry
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{entries: make(map[string]*Entry)}
+}
+
+// Record notes that an upstream response for the operation did not match its spec
+func (r *Recorder) Record(provider string, method string, path string, status int, messages []string) {
+	key := provider + " " + method + " " + path
+	mismatches.Add(key, 1)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.entries[key]
+	if !ok {
+		entry = &Entry{Provider: provider, Method: method, Path: path}
+		r.entries[key] = entry
+	}
+	entry.Mismatches++
+	entry.LastStatus = status
+	entry.LastSeen = time.Now()
+	for _, message := range messages {
+		if len(entry.Samples) >= maxSamples {
+			break
+		}
+		if !contains(entry.Samples, message) {
+			entry.Samples = append(entry.Samples, message)
+		}
+	}
+}
+
+// Report returns a copy of every entry, optionally limited to one provider, most recent first
+func (r *Recorder) Report(provider string) []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	report := make([]Entry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		if provider != "" && entry.Provider != provider {
+			continue
+		}
+		e := *entry
+		e.Samples = append([]string(nil), entry.Samples...)
+		report = append(report, e)
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].LastSeen.After(report[j].LastSeen) })
+	return report
+}
+
+// ReportHandler serves the drift report as JSON, filtered by the optional provider query param
+func (r *Recorder) ReportHandler(w http.ResponseWriter, req *http.Request) {
+	body, err := json.Marshal(r.Report(req.URL.Query().Get("provider")))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrUnknownKey = errors.New("unknown key-encryption key")
+
+// Keyring holds the key-encryption keys (KEKs) used to wrap per-row data keys.
+// Only the active key wraps new data keys; the rest are kept to decrypt older rows.
+type Keyring struct {
+	activeID string
+	keys     map[string][]byte
+}
+
+type keyFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"` // key ID -> base64 encoded 32 byte key
+}
+
+// Load reads a JSON key file of the form {"active": "k2", "keys": {"k1": "<base64>", "k2": "<base64>"}}
+func Load(path string) (*Keyring, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading token key file: %w", err)
+	}
+	var file keyFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("parsing token key file %s: %w", path, err)
+	}
+
+	keys := make(map[string][]byte, len(file.Keys))
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("token key %q in %s must be 32 bytes, base64 encoded", id, path)
+		}
+		keys[id] = key
+	}
+	if _, ok := keys[file.Active]; !ok {
+		return nil, fmt.Errorf("active token key %q is not defined in %s", file.Active, path)
+	}
+	return &Keyring{activeID: file.Active, keys: keys}, nil
+}
+
+// Generate writes a key file with a single random key to path, for a new deployment or a dev setup.
+// It refuses to overwrite an existing file, whose keys may still be needed to decrypt tokens.
+func Generate(path string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(keyFile{Active: "k1", Keys: map[string]string{"k1": base64.StdEncoding.EncodeToString(key)}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("creating token key file: %w", err)
+	}
+	if _, err := file.Write(append(raw, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ActiveID is the ID of the key that wraps newly generated data keys
+func (k *Keyring) ActiveID() string {
+	return k.activeID
+}
+
+// NewDataKey generates a random data key and returns it along with its wrapped form under the active KEK
+func (k *Keyring) NewDataKey() (dataKey []byte, keyID string, wrapped []byte, err error) {
+	dataKey = make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", nil, err
+	}
+	wrapped, err = seal(k.keys[k.activeID], dataKey, []byte(k.activeID))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return dataKey, k.activeID, wrapped, nil
+}
+
+// UnwrapDataKey decrypts a data key that was wrapped by the KEK keyID
+func (k *Keyring) UnwrapDataKey(keyID string, wrapped []byte) ([]byte, error) {
+	kek, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	return open(kek, wrapped, []byte(keyID))
+}
+
+// Encrypt seals plaintext with dataKey, binding it to additionalData, and returns base64 text safe for a string column
+func Encrypt(dataKey []byte, plaintext string, additionalData string) (string, error) {
+	sealed, err := seal(dataKey, []byte(plaintext), []byte(additionalData))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverses Encrypt
+func Decrypt(dataKey []byte, ciphertext string, additionalData string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataKey, sealed, []byte(additionalData))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// seal encrypts with AES-256-GCM, prefixing the random nonce to the ciphertext
+func seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(key []byte, sealed []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
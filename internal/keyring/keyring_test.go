@@ -0,0 +1,184 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeyFile writes a key file to a temporary directory and returns its path
+func writeKeyFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "token_keys.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  string
+	}{
+		{"valid", `{"active":"k2","keys":{"k1":"` + testKey(1) + `","k2":"` + testKey(2) + `"}}`, ""},
+		{"not JSON", `active: k1`, "parsing token key file"},
+		{"short key", `{"active":"k1","keys":{"k1":"` + base64.StdEncoding.EncodeToString([]byte("short")) + `"}}`, "must be 32 bytes"},
+		{"not base64", `{"active":"k1","keys":{"k1":"not base64!"}}`, "must be 32 bytes"},
+		{"active key missing", `{"active":"k2","keys":{"k1":"` + testKey(1) + `"}}`, `active token key "k2" is not defined`},
+		{"no keys", `{"active":"k1"}`, `active token key "k1" is not defined`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyring, err := Load(writeKeyFile(t, test.contents))
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Load() error = %v", err)
+				}
+				if keyring.ActiveID() != "k2" {
+					t.Errorf("ActiveID() = %q, want k2", keyring.ActiveID())
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Load() error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Load() of a missing file error = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	before, err := Load(writeKeyFile(t, `{"active":"k1","keys":{"k1":"`+testKey(1)+`"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, keyID, wrapped, err := before.NewDataKey()
+	if err != nil {
+		t.Fatalf("NewDataKey() error = %v", err)
+	}
+	ciphertext, err := Encrypt(dataKey, "access token", "row")
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	rotated, err := Load(writeKeyFile(t, `{"active":"k2","keys":{"k1":"`+testKey(1)+`","k2":"`+testKey(2)+`"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	retired, err := Load(writeKeyFile(t, `{"active":"k2","keys":{"k2":"`+testKey(2)+`"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		keyID   string
+		wrapped []byte
+		wantErr bool
+		unknown bool // the error should be ErrUnknownKey
+	}{
+		{"before rotation", before, keyID, wrapped, false, false},
+		{"old key kept after rotation", rotated, keyID, wrapped, false, false},
+		{"old key removed", retired, keyID, wrapped, true, true},
+		{"wrapped key under another ID", rotated, "k2", wrapped, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			unwrapped, err := test.keyring.UnwrapDataKey(test.keyID, test.wrapped)
+			if (err != nil) != test.wantErr || errors.Is(err, ErrUnknownKey) != test.unknown {
+				t.Fatalf("UnwrapDataKey() error = %v, want error %v, unknown key %v", err, test.wantErr, test.unknown)
+			}
+			if test.wantErr {
+				return
+			}
+			plaintext, err := Decrypt(unwrapped, ciphertext, "row")
+			if err != nil || plaintext != "access token" {
+				t.Errorf("Decrypt() = %q, %v, want the access token", plaintext, err)
+			}
+		})
+	}
+
+	_, keyID, _, err = rotated.NewDataKey()
+	if err != nil || keyID != "k2" {
+		t.Errorf("NewDataKey() after rotation wrapped with %q, %v, want k2", keyID, err)
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	dataKey := bytes.Repeat([]byte{7}, 32)
+	ciphertext, err := Encrypt(dataKey, "access token", "user/provider")
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	sealed, _ := base64.StdEncoding.DecodeString(ciphertext)
+	sealed[len(sealed)-1] ^= 1
+
+	tests := []struct {
+		name           string
+		dataKey        []byte
+		ciphertext     string
+		additionalData string
+		wantErr        bool
+	}{
+		{"same AAD", dataKey, ciphertext, "user/provider", false},
+		{"wrong AAD", dataKey, ciphertext, "other-user/provider", true},
+		{"wrong key", bytes.Repeat([]byte{8}, 32), ciphertext, "user/provider", true},
+		{"tampered", dataKey, base64.StdEncoding.EncodeToString(sealed), "user/provider", true},
+		{"too short", dataKey, base64.StdEncoding.EncodeToString([]byte("short")), "user/provider", true},
+		{"not base64", dataKey, "not base64!", "user/provider", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plaintext, err := Decrypt(test.dataKey, test.ciphertext, test.additionalData)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Decrypt() error = %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && plaintext != "access token" {
+				t.Errorf("Decrypt() = %q, want the access token", plaintext)
+			}
+		})
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token_keys.json")
+	if err := Generate(path); err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Generate() wrote mode %v, want 0600", info.Mode().Perm())
+	}
+	keyring, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() of a generated file error = %v", err)
+	}
+	if _, _, _, err := keyring.NewDataKey(); err != nil {
+		t.Errorf("NewDataKey() error = %v", err)
+	}
+
+	original, _ := os.ReadFile(path)
+	if err := Generate(path); err == nil {
+		t.Errorf("Generate() overwrote an existing key file")
+	}
+	if current, _ := os.ReadFile(path); !bytes.Equal(current, original) {
+		t.Errorf("Generate() changed an existing key file")
+	}
+}
@@ -0,0 +1,278 @@
+package mcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"lorallabs.com/oauth-server/internal/tools"
+)
+
+// ProtocolVersions are the MCP revisions the server speaks, newest first
+var ProtocolVersions = []string{"2025-06-18", "2025-03-26", "2024-11-05"}
+
+// maxMessageBytes caps the body of a request, a message or batch of them
+const maxMessageBytes = 1 << 20
+
+// JSON-RPC error codes
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+)
+
+// Toolbox is what one caller of the server can see and call
+type Toolbox interface {
+	Tools() []*tools.Tool
+	// Call runs tool, its error means the arguments do not fit the tool
+	Call(tool *tools.Tool, args map[string]interface{}) (*tools.Result, error)
+}
+
+// Server answers MCP requests over the streamable HTTP transport. It is stateless: every POST carries
+// its own authentication, so no Mcp-Session-Id is issued and there is no server initiated stream.
+type Server struct {
+	Name    string
+	Version string
+}
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Serve handles one MCP HTTP request for the caller owning toolbox
+func (s *Server) Serve(w http.ResponseWriter, r *http.Request, toolbox Toolbox) {
+	if r.Method != http.MethodPost {
+		// clients open a GET stream for server initiated messages, which this server never sends
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageBytes)).Decode(&raw); err != nil {
+		s.write(w, r, response{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{codeParseError, "Parse error: " + err.Error()}})
+		return
+	}
+
+	// 2025-03-26 clients may batch messages in an array
+	batch := bytes.HasPrefix(bytes.TrimSpace(raw), []byte("["))
+	var messages []json.RawMessage
+	if batch {
+		if err := json.Unmarshal(raw, &messages); err != nil || len(messages) == 0 {
+			s.write(w, r, response{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{codeInvalidRequest, "Invalid batch"}})
+			return
+		}
+	} else {
+		messages = []json.RawMessage{raw}
+	}
+
+	var responses []response
+	for _, message := range messages {
+		if resp := s.handle(message, toolbox); resp != nil {
+			responses = append(responses, *resp)
+		}
+	}
+
+	switch {
+	case len(responses) == 0:
+		// only notifications and responses, which need no answer
+		w.WriteHeader(http.StatusAccepted)
+	case batch:
+		s.write(w, r, responses)
+	default:
+		s.write(w, r, responses[0])
+	}
+}
+
+// handle answers one message, returning nil for notifications and for responses from the client
+func (s *Server) handle(message json.RawMessage, toolbox Toolbox) *response {
+	var req request
+	if err := json.Unmarshal(message, &req); err != nil || req.JSONRPC != "2.0" {
+		return &response{JSONRPC: "2.0", ID: json.RawMessage("null"), Error: &rpcError{codeInvalidRequest, "Invalid request"}}
+	}
+	if req.Method == "" || req.ID == nil || string(req.ID) == "null" {
+		return nil
+	}
+
+	result, rpcErr := s.dispatch(req, toolbox)
+	if rpcErr != nil {
+		return &response{JSONRPC: "2.0", ID: req.ID, Error: rpcErr}
+	}
+	return &response{JSONRPC: "2.0", ID: req.ID, Result: result}
+}
+
+func (s *Server) dispatch(req request, toolbox Toolbox) (interface{}, *rpcError) {
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		if err := unmarshalParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"protocolVersion": negotiate(params.ProtocolVersion),
+			"capabilities":    map[string]interface{}{"tools": map[string]interface{}{"listChanged": false}},
+			"serverInfo":      map[string]string{"name": s.Name, "version": s.Version},
+		}, nil
+
+	case "ping":
+		return struct{}{}, nil
+
+	case "tools/list":
+		available := toolbox.Tools()
+		list := make([]map[string]interface{}, len(available))
+		for i, tool := range available {
+			list[i] = map[string]interface{}{
+				"name":        tool.Name,
+				"description": tool.Description,
+				"inputSchema": tool.Parameters,
+				"annotations": map[string]interface{}{
+					"readOnlyHint":   tool.Operation.Method == http.MethodGet || tool.Operation.Method == http.MethodHead,
+					"idempotentHint": tool.Operation.Idempotent(),
+					"openWorldHint":  true,
+				},
+			}
+		}
+		return map[string]interface{}{"tools": list}, nil
+
+	case "tools/call":
+		var params struct {
+			Name      string                 `json:"name"`
+			Arguments map[string]interface{} `json:"arguments"`
+		}
+		if err := unmarshalParams(req.Params, &params); err != nil {
+			return nil, err
+		}
+		var tool *tools.Tool
+		for _, t := range toolbox.Tools() {
+			if t.Name == params.Name {
+				tool = t
+				break
+			}
+		}
+		if tool == nil {
+			return nil, &rpcError{codeInvalidParams, "Unknown tool " + params.Name}
+		}
+		if params.Arguments == nil {
+			params.Arguments = make(map[string]interface{})
+		}
+
+		result, err := toolbox.Call(tool, params.Arguments)
+		if err != nil {
+			// argument errors go back to the model as a failed call so it can correct itself
+			return callResult("Invalid tool arguments: "+err.Error(), nil, true), nil
+		}
+		return toCallResult(result), nil
+	}
+	return nil, &rpcError{codeMethodNotFound, "Method not found: " + req.Method}
+}
+
+// toCallResult formats the outcome of an execute request as MCP tool call content
+func toCallResult(result *tools.Result) map[string]interface{} {
+	text, ok := result.Content.(string)
+	var structured interface{}
+	if !ok {
+		raw, err := json.Marshal(result.Content)
+		if err != nil {
+			return callResult(err.Error(), nil, true)
+		}
+		text = string(raw)
+		// structured content must be an object
+		if _, isObject := result.Content.(map[string]interface{}); isObject {
+			structured = result.Content
+		}
+	}
+	if result.IsError {
+		text = fmt.Sprintf("%s responded %d %s: %s", result.Name, result.Status, http.StatusText(result.Status), text)
+	}
+	return callResult(text, structured, result.IsError)
+}
+
+func callResult(text string, structured interface{}, isError bool) map[string]interface{} {
+	result := map[string]interface{}{
+		"content": []map[string]string{{"type": "text", "text": text}},
+		"isError": isError,
+	}
+	if structured != nil {
+		result["structuredContent"] = structured
+	}
+	return result
+}
+
+// negotiate answers with the client's protocol version if the server speaks it, or else its latest one
+func negotiate(requested string) string {
+	for _, version := range ProtocolVersions {
+		if version == requested {
+			return version
+		}
+	}
+	return ProtocolVersions[0]
+}
+
+func unmarshalParams(raw json.RawMessage, params interface{}) *rpcError {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(raw, params); err != nil {
+		return &rpcError{codeInvalidParams, "Invalid params: " + err.Error()}
+	}
+	return nil
+}
+
+// write sends body as JSON, or as a single event stream message to clients that only accept streams
+func (s *Server) write(w http.ResponseWriter, r *http.Request, body interface{}) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !acceptsJSON(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprintf(w, "event: message\ndata: %s\n\n", raw)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(raw); err != nil {
+		log.Printf("Failed to write MCP response: %v", err)
+	}
+}
+
+// acceptsJSON reports whether the Accept header allows a plain JSON response, which the transport
+// requires clients to, but older stream only clients do not
+func acceptsJSON(accept string) bool {
+	if accept == "" {
+		return true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mediaType == "application/json" || mediaType == "application/*" || mediaType == "*/*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+package mcp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"lorallabs.com/oauth-server/internal/apispec"
+	"lorallabs.com/oauth-server/internal/tools"
+)
+
+// fakeToolbox offers a single GET tool whose calls answer result, or fail with err
+type fakeToolbox struct {
+	tool   *tools.Tool
+	result *tools.Result
+	err    error
+}
+
+func newFakeToolbox(result *tools.Result, err error) *fakeToolbox {
+	op := openapi3.NewOperation()
+	op.OperationID = "listProducts"
+	tool := tools.FromOperation(&apispec.Operation{
+		Provider: "shop", Path: "/products", Method: http.MethodGet, PathItem: &openapi3.PathItem{}, Operation: op,
+	})
+	return &fakeToolbox{tool: tool, result: result, err: err}
+}
+
+func (f *fakeToolbox) Tools() []*tools.Tool { return []*tools.Tool{f.tool} }
+
+func (f *fakeToolbox) Call(tool *tools.Tool, args map[string]interface{}) (*tools.Result, error) {
+	return f.result, f.err
+}
+
+func serve(t *testing.T, toolbox Toolbox, method, body, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, "/mcp", strings.NewReader(body))
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+	w := httptest.NewRecorder()
+	(&Server{Name: "loral", Version: "test"}).Serve(w, r, toolbox)
+	return w
+}
+
+// assertJSON fails unless got and want hold the same JSON value
+func assertJSON(t *testing.T, got []byte, want string) {
+	t.Helper()
+	var gotValue, wantValue interface{}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("response %q is not JSON: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("response = %s, want %s", got, want)
+	}
+}
+
+func TestServeMessages(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantBody   string // empty when nothing is written
+	}{
+		{"request", `{"jsonrpc":"2.0","id":1,"method":"ping"}`, http.StatusOK, `{"jsonrpc":"2.0","id":1,"result":{}}`},
+		{"string id", `{"jsonrpc":"2.0","id":"a","method":"ping"}`, http.StatusOK, `{"jsonrpc":"2.0","id":"a","result":{}}`},
+		{"notification", `{"jsonrpc":"2.0","method":"notifications/initialized"}`, http.StatusAccepted, ""},
+		{"null id is a notification", `{"jsonrpc":"2.0","id":null,"method":"ping"}`, http.StatusAccepted, ""},
+		{"client response", `{"jsonrpc":"2.0","id":7,"result":{}}`, http.StatusAccepted, ""},
+		{"batch", `[{"jsonrpc":"2.0","id":1,"method":"ping"},{"jsonrpc":"2.0","method":"notifications/initialized"},{"jsonrpc":"2.0","id":2,"method":"ping"}]`,
+			http.StatusOK, `[{"jsonrpc":"2.0","id":1,"result":{}},{"jsonrpc":"2.0","id":2,"result":{}}]`},
+		{"batch of one request", `[{"jsonrpc":"2.0","id":1,"method":"ping"}]`, http.StatusOK, `[{"jsonrpc":"2.0","id":1,"result":{}}]`},
+		{"batch of notifications", `[{"jsonrpc":"2.0","method":"notifications/initialized"},{"jsonrpc":"2.0","method":"notifications/cancelled"}]`,
+			http.StatusAccepted, ""},
+		{"batch with an invalid message", `[{"jsonrpc":"2.0","id":1,"method":"ping"},1]`,
+			http.StatusOK, `[{"jsonrpc":"2.0","id":1,"result":{}},{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"Invalid request"}}]`},
+		{"empty batch", `[]`, http.StatusOK, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"Invalid batch"}}`},
+		{"wrong version", `{"jsonrpc":"1.0","id":1,"method":"ping"}`, http.StatusOK, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"Invalid request"}}`},
+		{"unknown method", `{"jsonrpc":"2.0","id":1,"method":"resources/list"}`,
+			http.StatusOK, `{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"Method not found: resources/list"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(t, newFakeToolbox(nil, nil), http.MethodPost, tt.body, "application/json, text/event-stream")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody == "" {
+				if w.Body.Len() != 0 {
+					t.Errorf("body = %q, want none", w.Body.String())
+				}
+				return
+			}
+			assertJSON(t, w.Body.Bytes(), tt.wantBody)
+		})
+	}
+}
+
+func TestServeRejectsUnreadableBodies(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"malformed", `{"jsonrpc":`},
+		{"empty", ``},
+		{"too large", `"` + strings.Repeat("a", maxMessageBytes) + `"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(t, newFakeToolbox(nil, nil), http.MethodPost, tt.body, "application/json")
+			var resp response
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("response %q is not JSON: %v", w.Body.String(), err)
+			}
+			if resp.Error == nil || resp.Error.Code != codeParseError {
+				t.Errorf("error = %+v, want code %d", resp.Error, codeParseError)
+			}
+			if string(resp.ID) != "null" {
+				t.Errorf("id = %s, want null", resp.ID)
+			}
+		})
+	}
+}
+
+func TestInvalidParams(t *testing.T) {
+	for _, method := range []string{"initialize", "tools/call"} {
+		t.Run(method, func(t *testing.T) {
+			w := serve(t, newFakeToolbox(nil, nil), http.MethodPost, `{"jsonrpc":"2.0","id":1,"method":"`+method+`","params":[]}`, "application/json")
+			var resp response
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error == nil || resp.Error.Code != codeInvalidParams {
+				t.Errorf("error = %+v, want code %d", resp.Error, codeInvalidParams)
+			}
+		})
+	}
+}
+
+func TestServeOnlyPosts(t *testing.T) {
+	w := serve(t, newFakeToolbox(nil, nil), http.MethodGet, "", "text/event-stream")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if got := w.Header().Get("Allow"); got != http.MethodPost {
+		t.Errorf("Allow = %q, want %q", got, http.MethodPost)
+	}
+}
+
+func TestServeEventStream(t *testing.T) {
+	tests := []struct {
+		accept     string
+		wantStream bool
+	}{
+		{"", false},
+		{"application/json, text/event-stream", false},
+		{"*/*", false},
+		{"text/event-stream", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			w := serve(t, newFakeToolbox(nil, nil), http.MethodPost, `{"jsonrpc":"2.0","id":1,"method":"ping"}`, tt.accept)
+			body := w.Body.String()
+			if tt.wantStream {
+				if got := w.Header().Get("Content-Type"); got != "text/event-stream" {
+					t.Errorf("Content-Type = %q, want text/event-stream", got)
+				}
+				if want := "event: message\ndata: {\"jsonrpc\":\"2.0\",\"id\":1,\"result\":{}}\n\n"; body != want {
+					t.Errorf("body = %q, want %q", body, want)
+				}
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			assertJSON(t, w.Body.Bytes(), `{"jsonrpc":"2.0","id":1,"result":{}}`)
+		})
+	}
+}
+
+func TestInitializeNegotiatesVersion(t *testing.T) {
+	tests := []struct {
+		requested string
+		want      string
+	}{
+		{"2025-03-26", "2025-03-26"},
+		{"2024-11-05", "2024-11-05"},
+		{"1999-01-01", ProtocolVersions[0]},
+		{"", ProtocolVersions[0]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.requested, func(t *testing.T) {
+			body := `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"` + tt.requested + `"}}`
+			w := serve(t, newFakeToolbox(nil, nil), http.MethodPost, body, "application/json")
+			var resp struct {
+				Result struct {
+					ProtocolVersion string `json:"protocolVersion"`
+				} `json:"result"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Result.ProtocolVersion != tt.want {
+				t.Errorf("protocolVersion = %q, want %q", resp.Result.ProtocolVersion, tt.want)
+			}
+		})
+	}
+}
+
+func TestToolsList(t *testing.T) {
+	toolbox := newFakeToolbox(nil, nil)
+	w := serve(t, toolbox, http.MethodPost, `{"jsonrpc":"2.0","id":1,"method":"tools/list"}`, "application/json")
+	assertJSON(t, w.Body.Bytes(), `{"jsonrpc":"2.0","id":1,"result":{"tools":[{
+		"name":"shop_listProducts",
+		"description":"GET /products on shop.",
+		"inputSchema":{"type":"object","properties":{}},
+		"annotations":{"readOnlyHint":true,"idempotentHint":true,"openWorldHint":true}
+	}]}}`)
+}
+
+func TestToolsCall(t *testing.T) {
+	tests := []struct {
+		name     string
+		tool     string
+		result   *tools.Result
+		err      error
+		wantBody string
+	}{
+		{"object result", "shop_listProducts", &tools.Result{Name: "shop_listProducts", Status: 200, Content: map[string]interface{}{"total": 2}}, nil,
+			`{"jsonrpc":"2.0","id":1,"result":{"content":[{"type":"text","text":"{\"total\":2}"}],"structuredContent":{"total":2},"isError":false}}`},
+		{"array result", "shop_listProducts", &tools.Result{Name: "shop_listProducts", Status: 200, Content: []interface{}{"a"}}, nil,
+			`{"jsonrpc":"2.0","id":1,"result":{"content":[{"type":"text","text":"[\"a\"]"}],"isError":false}}`},
+		{"text result", "shop_listProducts", &tools.Result{Name: "shop_listProducts", Status: 200, Content: "plain"}, nil,
+			`{"jsonrpc":"2.0","id":1,"result":{"content":[{"type":"text","text":"plain"}],"isError":false}}`},
+		{"upstream error", "shop_listProducts", &tools.Result{Name: "shop_listProducts", Status: 404, IsError: true, Content: "gone"}, nil,
+			`{"jsonrpc":"2.0","id":1,"result":{"content":[{"type":"text","text":"shop_listProducts responded 404 Not Found: gone"}],"isError":true}}`},
+		{"invalid arguments", "shop_listProducts", nil, errors.New(`unknown argument "x"`),
+			`{"jsonrpc":"2.0","id":1,"result":{"content":[{"type":"text","text":"Invalid tool arguments: unknown argument \"x\""}],"isError":true}}`},
+		{"unknown tool", "shop_deleteEverything", nil, nil,
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"Unknown tool shop_deleteEverything"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"` + tt.tool + `"}}`
+			w := serve(t, newFakeToolbox(tt.result, tt.err), http.MethodPost, body, "application/json")
+			assertJSON(t, w.Body.Bytes(), tt.wantBody)
+		})
+	}
+}
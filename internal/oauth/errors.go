@@ -0,0 +1,65 @@
+package oauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"lorallabs.com/oauth-server/internal/oauth/providers"
+)
+
+var (
+	// ErrNotConnected means the user never authorized Loral to the provider
+	ErrNotConnected = errors.New("user has not connected this provider")
+	// ErrRefreshRevoked means the provider rejected the stored refresh token and the user must consent again
+	ErrRefreshRevoked = errors.New("provider authorization was revoked or has expired")
+	// ErrProviderUnavailable means the provider token endpoint failed or could not be reached
+	ErrProviderUnavailable = errors.New("provider is unavailable")
+	// ErrUnsupportedProvider means the provider is not configured on this server
+	ErrUnsupportedProvider = errors.New("unsupported provider")
+)
+
+// classifyRefreshError maps a provider refresh failure onto ErrRefreshRevoked or ErrProviderUnavailable
+func classifyRefreshError(err error) error {
+	var tokenErr *providers.TokenError
+	if errors.As(err, &tokenErr) && tokenErr.Code == "invalid_grant" {
+		return fmt.Errorf("%w: %v", ErrRefreshRevoked, err)
+	}
+	return fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+}
+
+// WriteTokenError writes a JSON error for a failed HandleGetToken, telling the client
+// when it should send the user back through /{provider}/auth. The cause is logged, the client only gets
+// a fixed message, since it can carry database or provider details.
+func WriteTokenError(w http.ResponseWriter, providerName string, err error) {
+	status, code := http.StatusInternalServerError, "internal_error"
+	message, authURL := "Failed to get a token for the provider", ""
+	switch {
+	case errors.Is(err, ErrNotConnected):
+		status, code, authURL = http.StatusFailedDependency, "provider_not_connected", "/"+providerName+"/auth"
+		message = ErrNotConnected.Error()
+	case errors.Is(err, ErrRefreshRevoked):
+		status, code, authURL = http.StatusUnauthorized, "provider_reauthorization_required", "/"+providerName+"/auth"
+		message = ErrRefreshRevoked.Error()
+	case errors.Is(err, ErrUnsupportedProvider):
+		status, code = http.StatusForbidden, "unsupported_provider"
+		message = ErrUnsupportedProvider.Error()
+	case errors.Is(err, ErrProviderUnavailable):
+		status, code = http.StatusBadGateway, "provider_unavailable"
+		message = ErrProviderUnavailable.Error()
+	}
+	log.Printf("Error getting %s token: %v", providerName, err)
+
+	body, _ := json.Marshal(struct {
+		Error    string `json:"error"`
+		Message  string `json:"message"`
+		Provider string `json:"provider"`
+		AuthURL  string `json:"auth_url,omitempty"`
+	}{code, message, providerName, authURL})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
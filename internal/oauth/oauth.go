@@ -1,40 +1,70 @@
 package oauth
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"time"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 	"lorallabs.com/oauth-server/internal/config"
 	"lorallabs.com/oauth-server/internal/oauth/providers"
-	"lorallabs.com/oauth-server/internal/oauth/providers/google"
-	"lorallabs.com/oauth-server/internal/oauth/providers/kroger"
+	"lorallabs.com/oauth-server/internal/oauth/providers/generic"
+	"lorallabs.com/oauth-server/internal/oauth/state"
+	"lorallabs.com/oauth-server/internal/oauthserver"
 	"lorallabs.com/oauth-server/internal/store"
 	"lorallabs.com/oauth-server/internal/types"
+	"lorallabs.com/oauth-server/internal/upstream"
 	schema "lorallabs.com/oauth-server/pkg/db"
 )
 
+// refreshTimeout bounds a shared token refresh, which outlives the requests waiting for it
+const refreshTimeout = 30 * time.Second
+
 type OAuthHandler struct {
 	ProviderMap map[string]providers.Provider
 	Store       *store.Store
+	State       *state.Signer
+	Identity    oauthserver.IdentityProvider
+	ExpirySkew  time.Duration // tokens are refreshed this long before they actually expire
+
+	refreshes refreshGroup
 }
 
-func NewOAuthHandler(config *config.Config, store *store.Store) *OAuthHandler {
-	providerMap := InitializeProviders(config)
+func NewOAuthHandler(config *config.Config, store *store.Store, identity oauthserver.IdentityProvider, clients *upstream.Clients) *OAuthHandler {
+	providerMap := InitializeProviders(config, clients)
 	return &OAuthHandler{
 		ProviderMap: providerMap,
 		Store:       store,
+		State:       state.NewSigner([]byte(config.StateSecret), config.StateTTL),
+		Identity:    identity,
+		ExpirySkew:  config.TokenExpirySkew,
 	}
 }
 
-// InitializeProviders sets up OAuth providers
-func InitializeProviders(config *config.Config) map[string]providers.Provider {
-	providers := map[string]providers.Provider{
-		"kroger": &kroger.KrogerProvider{ClientID: config.KrogerClientID, ClientSecret: config.KrogerClientSecret, RedirectURI: config.KrogerRedirectURI, Scopes: config.KrogerScopes},
-		"google": &google.GoogleProvider{ClientID: config.GoogleClientID, ClientSecret: config.GoogleClientSecret, RedirectURI: config.GoogleRedirectURI, Scopes: config.GoogleScopes},
-		// Initialize other providers similarly
+// InitializeProviders sets up an OAuth provider for every configured provider, calling it with the provider's client
+func InitializeProviders(config *config.Config, clients *upstream.Clients) map[string]providers.Provider {
+	providerMap := make(map[string]providers.Provider, len(config.Providers))
+	for _, p := range config.Providers {
+		providerMap[p.Name] = &generic.GenericProvider{
+			Name:           p.Name,
+			ClientID:       p.OAuth.ClientID,
+			ClientSecret:   p.OAuth.ClientSecret,
+			RedirectURI:    p.OAuth.RedirectURI,
+			Scopes:         p.OAuth.Scopes,
+			AuthURL:        p.OAuth.AuthURL,
+			TokenURL:       p.OAuth.TokenURL,
+			AuthStyle:      generic.AuthStyle(p.OAuth.AuthStyle),
+			AuthParams:     p.OAuth.AuthParams,
+			ScopeSeparator: p.OAuth.ScopeSeparator,
+			PKCE:           providers.PKCEMethod(p.OAuth.PKCE),
+			HTTPClient:     clients.For(p.Name),
+		}
 	}
-	return providers
+	return providerMap
 }
 
 // HandleAuth initiates the OAuth flow for a given provider
@@ -48,6 +78,19 @@ func (h *OAuthHandler) HandleAuth(providerName string, w http.ResponseWriter, r
 	}
 
 	userId := ctx.Value(types.OryUserIDKey).(uuid.UUID)
+	clientID := ctx.Value(types.OryClientIDKey).(string)
+
+	// only send the user back to a redirect URI the calling client registered
+	registered, err := h.isRegisteredRedirectURI(clientID, clientRedirectURI)
+	if err != nil {
+		log.Printf("Error looking up client %s: %v", clientID, err)
+		http.Error(w, "Unable to verify redirect_uri, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	if !registered {
+		http.Error(w, fmt.Sprintf("redirect_uri %q is not registered for client %q, add it with /client/edit/redirectUris", clientRedirectURI, clientID), http.StatusBadRequest)
+		return
+	}
 
 	provider, exists := h.ProviderMap[providerName]
 	if !exists {
@@ -55,7 +98,32 @@ func (h *OAuthHandler) HandleAuth(providerName string, w http.ResponseWriter, r
 		return
 	}
 
-	url := provider.GetAuthURL(userId, clientRedirectURI)
+	// sign the state and keep who it belongs to server-side, so the callback cannot be forged
+	stateEnvelope, claims, err := h.State.Sign(providerName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	codeVerifier, err := providers.NewCodeVerifier()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = h.Store.CreateOAuthState(&schema.OAuthState{
+		Nonce:             claims.Nonce,
+		ProviderName:      providerName,
+		UserID:            userId,
+		ClientID:          clientID,
+		ClientRedirectURI: clientRedirectURI,
+		CodeVerifier:      codeVerifier,
+		ExpiresAt:         claims.ExpiresAt,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	url := provider.GetAuthURL(stateEnvelope, codeVerifier)
 	// respond with the redirect URL in the response rather than redirecting
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(url))
@@ -68,24 +136,49 @@ func (h *OAuthHandler) HandleCallback(providerName string, w http.ResponseWriter
 		http.Error(w, "Unsupported provider", http.StatusBadRequest)
 		return
 	}
-	provider.URLParser(r.URL)
 
-	// get userID from query params
-	userId, err := uuid.Parse(r.URL.Query().Get("userID"))
+	// verify the state and consume its nonce so it can only be used once
+	claims, err := h.State.Verify(r.URL.Query().Get("state"), providerName)
+	if err != nil {
+		http.Error(w, "Invalid state: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	pending, err := h.Store.ConsumeOAuthState(claims.Nonce)
+	if errors.Is(err, store.ErrStateNotFound) {
+		http.Error(w, "Invalid state: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Missing userID", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if pending.ProviderName != providerName || time.Now().Unix() > pending.ExpiresAt {
+		http.Error(w, "Invalid state: "+state.ErrExpired.Error(), http.StatusBadRequest)
 		return
 	}
 
+	userId := pending.UserID
+	clientRedirectURI := pending.ClientRedirectURI
+	// the client may have changed its redirect URIs since the flow started
+	registered, err := h.isRegisteredRedirectURI(pending.ClientID, clientRedirectURI)
+	if err != nil {
+		log.Printf("Error looking up client %s: %v", pending.ClientID, err)
+		oauthserver.WriteErrorPage(w, http.StatusServiceUnavailable, "Temporarily unavailable", "We could not check where to send you back to.")
+		return
+	}
+	if !registered {
+		oauthserver.WriteErrorPage(w, http.StatusBadRequest, "Unrecognized redirect", "The application you came from no longer allows redirects to "+clientRedirectURI+".")
+		return
+	}
 	code := r.URL.Query().Get("code")
-	clientRedirectURI := r.URL.Query().Get("clientRedirectURI")
 
-	token, err := provider.ExchangeCodeForToken(code)
+	token, err := provider.ExchangeCodeForToken(r.Context(), code, pending.CodeVerifier)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if (token.AccessToken == "") || (token.RefreshToken == "") {
+	// providers like GitHub OAuth apps and Notion issue no refresh token, their tokens do not expire
+	if token.AccessToken == "" {
 		http.Error(w, "Invalid token", http.StatusInternalServerError)
 		return
 	}
@@ -102,26 +195,15 @@ func (h *OAuthHandler) HandleCallback(providerName string, w http.ResponseWriter
 	providerToken := &schema.ProviderToken{
 		AccessToken:  token.AccessToken,
 		RefreshToken: token.RefreshToken,
-		Expiry:       time.Now().Add(time.Duration(token.Expiry) * time.Second).Unix(),
+		Expiry:       expiresAt(token.Expiry),
+		Scope:        token.Scope,
+		TokenType:    token.TokenType,
 		UserID:       userId,
 		ProviderID:   dbProvider.ID,
 	}
 
-	// If a token already exists for the user and provider, update it
-	var existingToken schema.ProviderToken
-	err = h.Store.DB.Where("user_id = ? AND provider_id = ?", providerToken.UserID, providerToken.ProviderID).First(&existingToken).Error
-	if err == nil {
-		providerToken.ID = existingToken.ID
-		err = h.Store.DB.Save(providerToken).Error
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		http.Redirect(w, r, clientRedirectURI, http.StatusTemporaryRedirect)
-		return
-	}
-
-	err = h.Store.DB.Create(providerToken).Error
+	// Encrypt and store it, replacing any token the user already has for the provider
+	err = h.Store.SaveProviderToken(providerToken)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -130,41 +212,140 @@ func (h *OAuthHandler) HandleCallback(providerName string, w http.ResponseWriter
 	http.Redirect(w, r, clientRedirectURI, http.StatusTemporaryRedirect)
 }
 
-func (h *OAuthHandler) HandleGetToken(providerName string, userID uuid.UUID) string {
-	// Find the provider in the database
-	dbProvider := &schema.Provider{}
-	err := h.Store.DB.Where("name = ?", providerName).First(&dbProvider).Error
-	if err != nil {
-		return err.Error()
+// HandleGetToken returns a valid access token of userID for providerName, refreshing it if needed.
+// Errors wrap ErrNotConnected, ErrRefreshRevoked, ErrProviderUnavailable or ErrUnsupportedProvider
+// when the cause is known, see WriteTokenError.
+func (h *OAuthHandler) HandleGetToken(ctx context.Context, providerName string, userID uuid.UUID) (string, error) {
+	if _, exists := h.ProviderMap[providerName]; !exists {
+		return "", ErrUnsupportedProvider
 	}
 
 	// Find the token for the user and provider
-	var providerToken schema.ProviderToken
-	err = h.Store.DB.Where("user_id = ? AND provider_id = ?", userID, dbProvider.ID).First(&providerToken).Error
+	providerToken, err := h.Store.GetProviderToken(userID, providerName)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrNotConnected
+	}
 	if err != nil {
-		return err.Error()
+		return "", err
+	}
+	if providerToken.NeedsReconsent {
+		return "", fmt.Errorf("%w: %s", ErrRefreshRevoked, providerToken.LastRefreshError)
 	}
 
-	// check if the token is expired
-	if time.Now().Unix() > providerToken.Expiry {
-		// refresh the token
-		provider, exists := h.ProviderMap[providerName]
-		if !exists {
-			return err.Error()
+	// check if the token is expired, or will be within the skew window. An Expiry of 0 never expires.
+	refreshBefore := time.Now().Add(h.ExpirySkew).Unix()
+	if providerToken.Expiry != 0 && providerToken.Expiry <= refreshBefore {
+		providerToken, err = h.refreshToken(ctx, providerName, userID, refreshBefore)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", ErrNotConnected
 		}
-		token, err := provider.RefreshToken(providerToken.RefreshToken)
 		if err != nil {
-			return err.Error()
+			return "", err
 		}
-		// update the token in the database
-		providerToken.AccessToken = token.AccessToken
-		providerToken.RefreshToken = token.RefreshToken
-		providerToken.Expiry = time.Now().Add(time.Duration(token.Expiry) * time.Second).Unix()
-		err = h.Store.DB.Save(&providerToken).Error
-		if err != nil {
-			return err.Error()
+	}
+
+	return providerToken.AccessToken, nil
+}
+
+// refreshToken refreshes the user's token for providerName if it expires at or before the given Unix time.
+// Concurrent callers in this process share one refresh, and the row lock taken by the store makes
+// replicas wait for each other instead of racing with rotating refresh tokens.
+// The shared refresh runs detached from ctx, bounded by refreshTimeout, so a caller going away cannot
+// abort it after a provider with rotating refresh tokens has already rotated them; ctx only bounds the wait.
+func (h *OAuthHandler) refreshToken(ctx context.Context, providerName string, userID uuid.UUID, before int64) (*schema.ProviderToken, error) {
+	provider, exists := h.ProviderMap[providerName]
+	if !exists {
+		return nil, ErrUnsupportedProvider
+	}
+
+	return h.refreshes.Do(ctx, providerName+"/"+userID.String(), func() (*schema.ProviderToken, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+		defer cancel()
+
+		refreshed, err := h.Store.RefreshProviderToken(userID, providerName, func(current *schema.ProviderToken) (*schema.ProviderToken, error) {
+			return refreshExpiring(ctx, provider, providerName, current, before)
+		})
+
+		// the refresh transaction rolled back, so note the failure separately
+		if errors.Is(err, ErrRefreshRevoked) || errors.Is(err, ErrProviderUnavailable) {
+			recordErr := h.Store.RecordRefreshFailure(userID, providerName, err, errors.Is(err, ErrRefreshRevoked))
+			if recordErr != nil {
+				log.Printf("Error recording %s refresh failure for user %s: %v", providerName, userID, recordErr)
+			}
+		}
+		return refreshed, err
+	})
+}
+
+// refreshExpiring returns current refreshed through provider if it expires at or before the given Unix time,
+// or nil if it can stay in use
+func refreshExpiring(ctx context.Context, provider providers.Provider, providerName string, current *schema.ProviderToken, before int64) (*schema.ProviderToken, error) {
+	// another replica may have refreshed it while we waited for the lock
+	if current.Expiry == 0 || current.Expiry > before {
+		return nil, nil
+	}
+	// without a refresh token it stays in use until it expires, then the user has to connect again
+	if current.RefreshToken == "" {
+		if current.Expiry > time.Now().Unix() {
+			return nil, nil
 		}
+		return nil, fmt.Errorf("%w: the token expired and %s issued no refresh token", ErrRefreshRevoked, providerName)
+	}
+
+	token, err := provider.RefreshToken(ctx, current.RefreshToken)
+	if ctx.Err() != nil {
+		// out of time, which says nothing about the refresh token
+		return nil, fmt.Errorf("%w: refresh timed out", ErrProviderUnavailable)
+	}
+	if err != nil {
+		return nil, classifyRefreshError(err)
+	}
+	updated := *current
+	updated.AccessToken = token.AccessToken
+	updated.Expiry = expiresAt(token.Expiry)
+	// providers like Google only return a refresh token on the first exchange, keep the old one
+	if token.RefreshToken != "" {
+		updated.RefreshToken = token.RefreshToken
+	}
+	if token.Scope != "" {
+		updated.Scope = token.Scope
 	}
+	if token.TokenType != "" {
+		updated.TokenType = token.TokenType
+	}
+	updated.NeedsReconsent = false
+	updated.LastRefreshAttempt = time.Now().Unix()
+	updated.LastRefreshError = ""
+	updated.RefreshFailures = 0
+	return &updated, nil
+}
 
-	return providerToken.AccessToken
+// expiresAt returns the Unix time a token expires at, given the seconds it lasts, or 0 if the provider did
+// not say, for tokens that do not expire
+func expiresAt(seconds int64) int64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Now().Add(time.Duration(seconds) * time.Second).Unix()
+}
+
+// isRegisteredRedirectURI reports whether uri exactly matches one of the redirect URIs registered for the
+// Loral client. It returns an error if the identity backend could not be asked.
+func (h *OAuthHandler) isRegisteredRedirectURI(clientID string, uri string) (bool, error) {
+	if clientID == "" {
+		return false, nil
+	}
+	client, err := h.Identity.GetClient(clientID)
+	if errors.Is(err, oauthserver.ErrClientNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, registered := range client.GetRedirectUris() {
+		if registered == uri {
+			return true, nil
+		}
+	}
+	return false, nil
 }
@@ -0,0 +1,135 @@
+package generic
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"lorallabs.com/oauth-server/internal/oauth/providers"
+)
+
+func TestPKCE(t *testing.T) {
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+	tests := []struct {
+		method        providers.PKCEMethod
+		wantChallenge string
+		wantVerifier  string
+	}{
+		{providers.PKCES256, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", verifier},
+		{providers.PKCEPlain, verifier, verifier},
+		{providers.PKCEDisabled, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(string(test.method), func(t *testing.T) {
+			var form url.Values
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				form = r.PostForm
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"access_token":"token"}`))
+			}))
+			defer server.Close()
+			provider := &GenericProvider{
+				ClientID:    "client",
+				RedirectURI: "https://loral.example.com/github/callback",
+				AuthURL:     "https://github.example.com/authorize",
+				TokenURL:    server.URL,
+				PKCE:        test.method,
+				HTTPClient:  server.Client(),
+			}
+
+			authURL, err := url.Parse(provider.GetAuthURL("state", verifier))
+			if err != nil {
+				t.Fatalf("GetAuthURL() is not a URL: %v", err)
+			}
+			query := authURL.Query()
+			if got := query.Get("code_challenge"); got != test.wantChallenge {
+				t.Errorf("code_challenge = %q, want %q", got, test.wantChallenge)
+			}
+			wantMethod := string(test.method)
+			if test.method == providers.PKCEDisabled {
+				wantMethod = ""
+			}
+			if got := query.Get("code_challenge_method"); got != wantMethod {
+				t.Errorf("code_challenge_method = %q, want %q", got, wantMethod)
+			}
+
+			if _, err := provider.ExchangeCodeForToken(context.Background(), "code", verifier); err != nil {
+				t.Fatalf("ExchangeCodeForToken() error = %v", err)
+			}
+			if got := form.Get("code_verifier"); got != test.wantVerifier {
+				t.Errorf("code_verifier = %q, want %q", got, test.wantVerifier)
+			}
+		})
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    providers.Token
+		wantErr *providers.TokenError
+	}{
+		{
+			name:   "full response",
+			status: http.StatusOK,
+			body:   `{"access_token":"access","refresh_token":"refresh","expires_in":3600,"scope":"repo user","token_type":"bearer"}`,
+			want:   providers.Token{AccessToken: "access", RefreshToken: "refresh", Expiry: 3600, Scope: "repo user", TokenType: "bearer"},
+		},
+		{
+			name:   "refresh token and expiry omitted",
+			status: http.StatusOK,
+			body:   `{"access_token":"access"}`,
+			want:   providers.Token{AccessToken: "access"},
+		},
+		{
+			name:    "revoked",
+			status:  http.StatusBadRequest,
+			body:    `{"error":"invalid_grant","error_description":"revoked"}`,
+			wantErr: &providers.TokenError{StatusCode: http.StatusBadRequest, Code: "invalid_grant", Description: "revoked"},
+		},
+		{
+			name:    "not JSON",
+			status:  http.StatusBadGateway,
+			body:    `<html>bad gateway</html>`,
+			wantErr: &providers.TokenError{StatusCode: http.StatusBadGateway},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var form url.Values
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				form = r.PostForm
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+			provider := &GenericProvider{ClientID: "client", ClientSecret: "secret", TokenURL: server.URL, HTTPClient: server.Client()}
+
+			got, err := provider.RefreshToken(context.Background(), "old refresh")
+			if form.Get("grant_type") != "refresh_token" || form.Get("refresh_token") != "old refresh" {
+				t.Errorf("RefreshToken() sent %v", form)
+			}
+			if test.wantErr != nil {
+				var tokenErr *providers.TokenError
+				if !errors.As(err, &tokenErr) || *tokenErr != *test.wantErr {
+					t.Fatalf("RefreshToken() error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RefreshToken() error = %v", err)
+			}
+			if *got != test.want {
+				t.Errorf("RefreshToken() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package providers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// PKCEMethod is the code_challenge_method sent to a provider (RFC 7636)
+type PKCEMethod string
+
+const (
+	PKCES256     PKCEMethod = "S256"
+	PKCEPlain    PKCEMethod = "plain"
+	PKCEDisabled PKCEMethod = "disabled"
+)
+
+// NewCodeVerifier returns a random 43 character code_verifier
+func NewCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallenge derives the code_challenge for verifier using method
+func CodeChallenge(method PKCEMethod, verifier string) string {
+	if method == PKCEPlain {
+		return verifier
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
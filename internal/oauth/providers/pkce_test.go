@@ -0,0 +1,44 @@
+package providers
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestCodeChallenge(t *testing.T) {
+	// the example from RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+	tests := []struct {
+		method PKCEMethod
+		want   string
+	}{
+		{PKCES256, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"},
+		{PKCEPlain, verifier},
+	}
+	for _, test := range tests {
+		t.Run(string(test.method), func(t *testing.T) {
+			if got := CodeChallenge(test.method, verifier); got != test.want {
+				t.Errorf("CodeChallenge(%s) = %q, want %q", test.method, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewCodeVerifier(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		verifier, err := NewCodeVerifier()
+		if err != nil {
+			t.Fatalf("NewCodeVerifier() error = %v", err)
+		}
+		// RFC 7636 section 4.1 allows 43 to 128 unreserved characters
+		if _, err := base64.RawURLEncoding.DecodeString(verifier); err != nil || len(verifier) != 43 {
+			t.Fatalf("NewCodeVerifier() = %q, want 43 base64url characters", verifier)
+		}
+		if seen[verifier] {
+			t.Fatalf("NewCodeVerifier() repeated %q", verifier)
+		}
+		seen[verifier] = true
+	}
+}
@@ -1,20 +1,37 @@
 package providers
 
 import (
-	"net/url"
-
-	"github.com/google/uuid"
+	"context"
+	"fmt"
 )
 
 type Provider interface {
-	GetAuthURL(userId uuid.UUID, clientRedirectURI string) string
-	ExchangeCodeForToken(code string) (*Token, error)
-	RefreshToken(refreshToken string) (*Token, error)
-	URLParser(*url.URL)
+	// GetAuthURL returns the provider consent URL, echoing state back to the callback unchanged.
+	// codeVerifier is only sent as a challenge if the provider has PKCE enabled.
+	GetAuthURL(state string, codeVerifier string) string
+	// ExchangeCodeForToken and RefreshToken call the provider token endpoint, giving up when ctx is cancelled
+	ExchangeCodeForToken(ctx context.Context, code string, codeVerifier string) (*Token, error)
+	RefreshToken(ctx context.Context, refreshToken string) (*Token, error)
 }
 
 type Token struct {
 	AccessToken  string
-	RefreshToken string
-	Expiry       int64
+	RefreshToken string // empty if the provider issues none, or on refresh if the previous one stays valid
+	Expiry       int64  // seconds until the access token expires, 0 if the provider did not say
+	Scope        string // granted scopes, if the provider reports them
+	TokenType    string
+}
+
+// TokenError is an error response from a provider token endpoint (RFC 6749 section 5.2)
+type TokenError struct {
+	StatusCode  int
+	Code        string // ie. invalid_grant
+	Description string
+}
+
+func (e *TokenError) Error() string {
+	if e.Description != "" {
+		return fmt.Sprintf("token endpoint returned %d %s: %s", e.StatusCode, e.Code, e.Description)
+	}
+	return fmt.Sprintf("token endpoint returned %d %s", e.StatusCode, e.Code)
 }
@@ -0,0 +1,131 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"lorallabs.com/oauth-server/internal/oauth/providers"
+	schema "lorallabs.com/oauth-server/pkg/db"
+)
+
+// fakeProvider answers refreshes with token or err and counts them
+type fakeProvider struct {
+	token     *providers.Token
+	err       error
+	refreshes int
+}
+
+func (p *fakeProvider) GetAuthURL(state string, codeVerifier string) string { return "" }
+func (p *fakeProvider) ExchangeCodeForToken(ctx context.Context, code string, codeVerifier string) (*providers.Token, error) {
+	return p.token, p.err
+}
+func (p *fakeProvider) RefreshToken(ctx context.Context, refreshToken string) (*providers.Token, error) {
+	p.refreshes++
+	return p.token, p.err
+}
+
+func TestRefreshExpiring(t *testing.T) {
+	now := time.Now().Unix()
+	before := now + 60 // a one minute skew
+	stored := schema.ProviderToken{AccessToken: "old access", RefreshToken: "old refresh", Scope: "repo", TokenType: "bearer", RefreshFailures: 2, LastRefreshError: "timeout"}
+	withExpiry := func(expiry int64, refreshToken string) *schema.ProviderToken {
+		token := stored
+		token.Expiry = expiry
+		token.RefreshToken = refreshToken
+		return &token
+	}
+
+	tests := []struct {
+		name        string
+		current     *schema.ProviderToken
+		token       *providers.Token
+		err         error
+		wantRefresh bool
+		wantErr     error
+		want        *schema.ProviderToken // nil if the current token stays in use
+	}{
+		{
+			name:    "not expiring",
+			current: withExpiry(now+3600, "old refresh"),
+		},
+		{
+			name:    "never expires",
+			current: withExpiry(0, "old refresh"),
+		},
+		{
+			name:    "within the skew without a refresh token",
+			current: withExpiry(now+30, ""),
+		},
+		{
+			name:    "expired without a refresh token",
+			current: withExpiry(now-30, ""),
+			wantErr: ErrRefreshRevoked,
+		},
+		{
+			name:        "within the skew",
+			current:     withExpiry(now+30, "old refresh"),
+			token:       &providers.Token{AccessToken: "new access", RefreshToken: "new refresh", Expiry: 3600, Scope: "repo user", TokenType: "Bearer"},
+			wantRefresh: true,
+			want:        &schema.ProviderToken{AccessToken: "new access", RefreshToken: "new refresh", Expiry: now + 3600, Scope: "repo user", TokenType: "Bearer"},
+		},
+		{
+			name:        "refresh token, scope and type omitted",
+			current:     withExpiry(now-30, "old refresh"),
+			token:       &providers.Token{AccessToken: "new access", Expiry: 3600},
+			wantRefresh: true,
+			want:        &schema.ProviderToken{AccessToken: "new access", RefreshToken: "old refresh", Expiry: now + 3600, Scope: "repo", TokenType: "bearer"},
+		},
+		{
+			name:        "expires_in omitted",
+			current:     withExpiry(now-30, "old refresh"),
+			token:       &providers.Token{AccessToken: "new access"},
+			wantRefresh: true,
+			want:        &schema.ProviderToken{AccessToken: "new access", RefreshToken: "old refresh", Expiry: 0, Scope: "repo", TokenType: "bearer"},
+		},
+		{
+			name:        "refresh token revoked",
+			current:     withExpiry(now-30, "old refresh"),
+			err:         &providers.TokenError{StatusCode: 400, Code: "invalid_grant"},
+			wantRefresh: true,
+			wantErr:     ErrRefreshRevoked,
+		},
+		{
+			name:        "provider down",
+			current:     withExpiry(now-30, "old refresh"),
+			err:         &providers.TokenError{StatusCode: 503},
+			wantRefresh: true,
+			wantErr:     ErrProviderUnavailable,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := &fakeProvider{token: test.token, err: test.err}
+			got, err := refreshExpiring(context.Background(), provider, "github", test.current, before)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("refreshExpiring() error = %v, want %v", err, test.wantErr)
+			}
+			if refreshed := provider.refreshes > 0; refreshed != test.wantRefresh {
+				t.Errorf("refreshExpiring() called the provider = %v, want %v", refreshed, test.wantRefresh)
+			}
+			if test.want == nil {
+				if got != nil {
+					t.Errorf("refreshExpiring() = %+v, want the current token kept", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("refreshExpiring() = nil, want %+v", test.want)
+			}
+			// the expiry is computed from time.Now, so allow for a second passing
+			if got.AccessToken != test.want.AccessToken || got.RefreshToken != test.want.RefreshToken || got.Scope != test.want.Scope ||
+				got.TokenType != test.want.TokenType || got.Expiry < test.want.Expiry || got.Expiry > test.want.Expiry+1 {
+				t.Errorf("refreshExpiring() = %+v, want %+v", got, test.want)
+			}
+			if got.RefreshFailures != 0 || got.LastRefreshError != "" || got.NeedsReconsent {
+				t.Errorf("refreshExpiring() kept the failures of the previous token: %+v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"lorallabs.com/oauth-server/internal/config"
+)
+
+// Refresher proactively refreshes provider tokens shortly before they expire, so proxied requests rarely
+// pay for a refresh and revoked refresh tokens are noticed before the user needs them
+type Refresher struct {
+	Handler *OAuthHandler
+	Config  config.RefresherConfig
+}
+
+func NewRefresher(handler *OAuthHandler, config config.RefresherConfig) *Refresher {
+	return &Refresher{Handler: handler, Config: config}
+}
+
+// Run scans for expiring tokens every Interval until ctx is cancelled
+func (r *Refresher) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Config.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.refreshExpiring(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshExpiring refreshes one batch of tokens expiring within Window, at most Concurrency at a time
+func (r *Refresher) refreshExpiring(ctx context.Context) {
+	now := time.Now()
+	before := now.Add(r.Config.Window).Unix()
+	retryAfter := now.Add(-r.Config.RetryBackoff).Unix()
+	refs, err := r.Handler.Store.ListExpiringProviderTokens(before, retryAfter, r.Config.BatchSize)
+	if err != nil {
+		log.Printf("Token refresher: error listing expiring tokens: %v", err)
+		return
+	}
+	if len(refs) == 0 {
+		return
+	}
+	log.Printf("Token refresher: refreshing %d expiring tokens", len(refs))
+
+	sem := make(chan struct{}, r.Config.Concurrency)
+	var wg sync.WaitGroup
+	for _, ref := range refs {
+		ref := ref
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// spread refreshes out so a batch does not hit a provider all at once
+			if r.Config.Jitter > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(time.Duration(rand.Int63n(int64(r.Config.Jitter)))):
+				}
+			}
+
+			_, err := r.Handler.refreshToken(ctx, ref.ProviderName, ref.UserID, before)
+			switch {
+			case errors.Is(err, ErrRefreshRevoked):
+				log.Printf("Token refresher: %s connection for user %s needs re-consent: %v", ref.ProviderName, ref.UserID, err)
+			case ctx.Err() != nil:
+				// shutting down, the refresh was cancelled rather than failed
+			case err != nil:
+				log.Printf("Token refresher: error refreshing %s token for user %s: %v", ref.ProviderName, ref.UserID, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
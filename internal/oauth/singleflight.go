@@ -0,0 +1,52 @@
+package oauth
+
+import (
+	"context"
+	"sync"
+
+	schema "lorallabs.com/oauth-server/pkg/db"
+)
+
+// refreshGroup collapses concurrent refreshes of the same token within this process,
+// so callers racing on an expired token share a single provider round trip
+type refreshGroup struct {
+	mu    sync.Mutex
+	calls map[string]*refreshCall
+}
+
+type refreshCall struct {
+	done  chan struct{}
+	token *schema.ProviderToken
+	err   error
+}
+
+// Do runs fn once for key, making any concurrent callers with the same key share its result. fn runs in
+// its own goroutine, so a caller whose ctx is cancelled stops waiting without cutting fn short for the others.
+func (g *refreshGroup) Do(ctx context.Context, key string, fn func() (*schema.ProviderToken, error)) (*schema.ProviderToken, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*refreshCall)
+	}
+	call, ok := g.calls[key]
+	if !ok {
+		call = &refreshCall{done: make(chan struct{})}
+		g.calls[key] = call
+		go func() {
+			defer func() {
+				g.mu.Lock()
+				delete(g.calls, key)
+				g.mu.Unlock()
+				close(call.done)
+			}()
+			call.token, call.err = fn()
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,88 @@
+package state
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrMalformed        = errors.New("malformed state")
+	ErrInvalidSignature = errors.New("invalid state signature")
+	ErrExpired          = errors.New("state has expired")
+	ErrWrongProvider    = errors.New("state was issued for a different provider")
+)
+
+// Claims is the signed payload carried in the OAuth state param. Everything
+// else about the flow (user, client redirect) stays server-side keyed by Nonce.
+type Claims struct {
+	Nonce     string `json:"n"`
+	Provider  string `json:"p"`
+	ExpiresAt int64  `json:"exp"` // Unix time
+}
+
+// Signer issues and verifies HMAC-SHA256 signed state envelopes
+type Signer struct {
+	key []byte
+	ttl time.Duration
+}
+
+func NewSigner(key []byte, ttl time.Duration) *Signer {
+	return &Signer{key: key, ttl: ttl}
+}
+
+// Sign creates a fresh nonce for provider and returns the encoded envelope
+func (s *Signer) Sign(provider string) (string, *Claims, error) {
+	claims := &Claims{
+		Nonce:     uuid.New().String(),
+		Provider:  provider,
+		ExpiresAt: time.Now().Add(s.ttl).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + s.sign(encoded), claims, nil
+}
+
+// Verify checks the signature, expiry and provider of an envelope returned by the provider callback
+func (s *Signer) Verify(envelope string, provider string) (*Claims, error) {
+	encoded, signature, found := strings.Cut(envelope, ".")
+	if !found {
+		return nil, ErrMalformed
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.sign(encoded))) {
+		return nil, ErrInvalidSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrMalformed
+	}
+
+	if time.Now().Unix() > claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+	if claims.Provider != provider {
+		return nil, ErrWrongProvider
+	}
+	return &claims, nil
+}
+
+func (s *Signer) sign(encoded string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,73 @@
+package state
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// envelope signs claims with signer the way Sign does, so tests can choose the payload
+func envelope(signer *Signer, claims Claims) string {
+	payload, _ := json.Marshal(claims)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + signer.sign(encoded)
+}
+
+func TestVerify(t *testing.T) {
+	signer := NewSigner([]byte("state key"), time.Minute)
+	other := NewSigner([]byte("another key"), time.Minute)
+	signed, claims, err := signer.Sign("github")
+	if err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	encoded, signature, _ := strings.Cut(signed, ".")
+	swapped, _, _ := strings.Cut(envelope(signer, Claims{Nonce: claims.Nonce, Provider: "google", ExpiresAt: claims.ExpiresAt}), ".")
+	otherSigned, _, _ := other.Sign("github")
+
+	tests := []struct {
+		name     string
+		envelope string
+		provider string
+		wantErr  error
+	}{
+		{"valid", signed, "github", nil},
+		{"no signature", encoded, "github", ErrMalformed},
+		{"empty", "", "github", ErrMalformed},
+		{"signed with another key", otherSigned, "github", ErrInvalidSignature},
+		{"payload swapped", swapped + "." + signature, "google", ErrInvalidSignature},
+		{"signature from another key", encoded + "." + other.sign(encoded), "github", ErrInvalidSignature},
+		{"payload not base64", "!!!." + signer.sign("!!!"), "github", ErrMalformed},
+		{"payload not JSON", "bm90IGpzb24." + signer.sign("bm90IGpzb24"), "github", ErrMalformed},
+		{"expired", envelope(signer, Claims{Nonce: "n", Provider: "github", ExpiresAt: time.Now().Add(-time.Minute).Unix()}), "github", ErrExpired},
+		{"wrong provider", signed, "google", ErrWrongProvider},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := signer.Verify(test.envelope, test.provider)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Verify() error = %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr == nil && *got != *claims {
+				t.Errorf("Verify() = %+v, want %+v", got, claims)
+			}
+		})
+	}
+}
+
+func TestSignFreshNonce(t *testing.T) {
+	signer := NewSigner([]byte("state key"), time.Minute)
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		_, claims, err := signer.Sign("github")
+		if err != nil {
+			t.Fatalf("Sign() error = %v", err)
+		}
+		if seen[claims.Nonce] {
+			t.Fatalf("Sign() reused nonce %q", claims.Nonce)
+		}
+		seen[claims.Nonce] = true
+	}
+}
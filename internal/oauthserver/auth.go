@@ -16,7 +16,6 @@ import (
 // token string | The string value of the token. For access tokens, this is the \\\"access_token\\\" value returned from the token endpoint defined in OAuth 2.0. For refresh tokens, this is the \\\"refresh_token\\\" value returned.
 // scope string | An optional, space separated list of required scopes. If the access token was not granted one of the scopes, the result of active will be false. (optional)
 func (o *OryClient) IntrospectToken(token string, scope string) *ory.IntrospectedOAuth2Token {
-
 	resp, r, err := o.ory.OAuth2API.IntrospectOAuth2Token(o.ctx).Token(token).Scope(scope).Execute()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error when calling `OAuth2API.IntrospectOAuth2Token``: %v\n", err)
@@ -25,7 +24,7 @@ func (o *OryClient) IntrospectToken(token string, scope string) *ory.Introspecte
 	return resp
 }
 
-func (o *OryClient) ListAppsHandler(w http.ResponseWriter, r *http.Request) {
+func (s *AuthorizationServer) ListAppsHandler(w http.ResponseWriter, r *http.Request) {
 	// get the bearer token from the request
 	authHeader := r.Header.Get("Authorization")
 	parts := strings.Split(authHeader, " ")
@@ -35,8 +34,17 @@ func (o *OryClient) ListAppsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	token := parts[1]
 
-	store := o.ctx.Value(types.StoreKey).(*store.Store)
-	resp := *o.IntrospectToken(token, "")
+	store := s.ctx.Value(types.StoreKey).(*store.Store)
+	introspected := s.IntrospectToken(token, "")
+	if introspected == nil || !introspected.Active {
+		http.Error(w, "Invalid Token", http.StatusUnauthorized)
+		return
+	}
+	if IsClientToken(introspected) {
+		http.Error(w, "Client credentials tokens cannot act for a user", http.StatusForbidden)
+		return
+	}
+	resp := *introspected
 	scope := resp.GetScope()
 	scopes := strings.Split(scope, " ")
 
@@ -0,0 +1,312 @@
+package oauthserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	schema "lorallabs.com/oauth-server/pkg/db"
+)
+
+const (
+	authorizationCodeTTL = time.Minute
+	csrfCookie           = "loral_csrf"
+)
+
+// dummyPasswordHash is compared against when the email is unknown, so a login takes as long either way
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in - Loral</title></head>
+<body style="font-family: sans-serif; max-width: 36rem; margin: 4rem auto;">
+<h1>Sign in to Loral</h1>
+<p><strong>{{.ClientName}}</strong> would like to access{{range .Scopes}} <code>{{.}}</code>{{end}} on your behalf.</p>
+{{if .Error}}<p style="color: #b00020;">{{.Error}}</p>{{end}}
+<form method="post" action="/oauth2/auth">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<input type="hidden" name="csrf_token" value="{{.CSRF}}">
+<p><label>Email<br><input type="email" name="email" value="{{.Email}}" required autofocus></label></p>
+<p><label>Password<br><input type="password" name="password" required></label></p>
+<p><button type="submit">Sign in and allow</button></p>
+</form>
+</body>
+</html>
+`))
+
+// authorizeRequest is a validated authorization request
+type authorizeRequest struct {
+	client              *schema.Client
+	redirectURI         string
+	scopes              []string
+	state               string
+	codeChallenge       string
+	codeChallengeMethod string
+}
+
+// authorizeError is an OAuth error to send back to the client's redirect URI
+type authorizeError struct {
+	code        string
+	description string
+}
+
+// AuthorizeHandler is the authorization endpoint. GET shows the login form for a valid request, and POST
+// signs the user in and redirects back to the client with an authorization code.
+func (l *LocalIdentityProvider) AuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeAuthorizeErrorPage(w, "The authorization request could not be read.")
+		return
+	}
+	// errors are only redirected back once the client and its redirect URI are known to be genuine
+	client, redirectURI, message := l.authorizeClient(r.Form)
+	if message != "" {
+		writeAuthorizeErrorPage(w, message)
+		return
+	}
+	request, authErr := l.parseAuthorizeRequest(r.Form, client, redirectURI)
+	if authErr != nil {
+		redirectAuthorizeError(w, r, redirectURI, r.Form.Get("state"), authErr)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		l.writeLoginPage(w, r, request, "", "")
+		return
+	}
+
+	cookie, err := r.Cookie(csrfCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.PostForm.Get("csrf_token"))) != 1 {
+		l.writeLoginPage(w, r, request, "", "Your sign in form expired, please try again.")
+		return
+	}
+	email := strings.TrimSpace(r.PostForm.Get("email"))
+	user, err := l.authenticateUser(email, r.PostForm.Get("password"))
+	if err != nil {
+		log.Printf("Failed sign in for %q: %v", email, err)
+		l.writeLoginPage(w, r, request, email, "Invalid email or password.")
+		return
+	}
+
+	code, err := randomSecret()
+	if err != nil {
+		redirectAuthorizeError(w, r, redirectURI, request.state, &authorizeError{"server_error", "Failed to issue a code"})
+		return
+	}
+	err = l.store.CreateAuthorizationCode(&schema.AuthorizationCode{
+		Code:                hashSecret(code),
+		ClientID:            client.ID,
+		UserID:              user.ID,
+		RedirectURI:         redirectURI,
+		RedirectURISent:     r.Form.Get("redirect_uri") != "",
+		Scope:               strings.Join(request.scopes, " "),
+		CodeChallenge:       request.codeChallenge,
+		CodeChallengeMethod: request.codeChallengeMethod,
+		ExpiresAt:           time.Now().Add(authorizationCodeTTL).Unix(),
+	})
+	if err != nil {
+		log.Printf("Failed to save authorization code: %v", err)
+		redirectAuthorizeError(w, r, redirectURI, request.state, &authorizeError{"server_error", "Failed to issue a code"})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Path: "/oauth2/auth", MaxAge: -1})
+	redirectWithParams(w, r, redirectURI, url.Values{"code": {code}, "state": {request.state}, "iss": {l.issuer}})
+}
+
+// authorizeClient returns the client of the request and the redirect URI to answer on, or a message for
+// the user if either is missing or unknown
+func (l *LocalIdentityProvider) authorizeClient(form url.Values) (*schema.Client, string, string) {
+	client, err := l.getClient(form.Get("client_id"))
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Failed to get client: %v", err)
+			return nil, "", "Something went wrong on our side."
+		}
+		return nil, "", "The application is not registered with Loral."
+	}
+	redirectURI := form.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	for _, registered := range client.RedirectURIs {
+		if registered == redirectURI {
+			return client, redirectURI, ""
+		}
+	}
+	return nil, "", "The application asked to be sent back to an address it has not registered."
+}
+
+// parseAuthorizeRequest checks the parameters that are reported to the client as OAuth errors
+func (l *LocalIdentityProvider) parseAuthorizeRequest(form url.Values, client *schema.Client, redirectURI string) (*authorizeRequest, *authorizeError) {
+	if form.Get("response_type") != "code" {
+		return nil, &authorizeError{"unsupported_response_type", "Only the code response type is supported"}
+	}
+
+	granted := strings.Fields(client.Scope)
+	scopes := strings.Fields(form.Get("scope"))
+	if len(scopes) == 0 {
+		scopes = granted
+	}
+	for _, scope := range scopes {
+		if !containsString(granted, scope) {
+			return nil, &authorizeError{"invalid_scope", "The client may not request the scope " + scope}
+		}
+	}
+
+	challenge, method := form.Get("code_challenge"), form.Get("code_challenge_method")
+	if challenge == "" && method != "" {
+		return nil, &authorizeError{"invalid_request", "code_challenge_method without a code_challenge"}
+	}
+	if challenge != "" {
+		if method == "" {
+			method = "plain"
+		}
+		if method != "S256" && method != "plain" {
+			return nil, &authorizeError{"invalid_request", "Unsupported code_challenge_method " + method}
+		}
+	}
+
+	return &authorizeRequest{
+		client:              client,
+		redirectURI:         redirectURI,
+		scopes:              scopes,
+		state:               form.Get("state"),
+		codeChallenge:       challenge,
+		codeChallengeMethod: method,
+	}, nil
+}
+
+func (l *LocalIdentityProvider) authenticateUser(email string, password string) (*schema.User, error) {
+	user, err := l.store.GetUserByEmail(email)
+	if err != nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, err
+	}
+	if user.Password == "" {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, errors.New("user has no password")
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// writeLoginPage renders the login form for request, with a fresh CSRF token tied to a cookie
+func (l *LocalIdentityProvider) writeLoginPage(w http.ResponseWriter, r *http.Request, request *authorizeRequest, email string, message string) {
+	csrf, err := randomSecret()
+	if err != nil {
+		writeAuthorizeErrorPage(w, "Something went wrong on our side.")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    csrf,
+		Path:     "/oauth2/auth",
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(l.issuer, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	params := map[string]string{
+		"response_type": "code",
+		"client_id":     request.client.ID.String(),
+		"redirect_uri":  request.redirectURI,
+		"scope":         strings.Join(request.scopes, " "),
+	}
+	for name, value := range map[string]string{
+		"state":                 request.state,
+		"code_challenge":        request.codeChallenge,
+		"code_challenge_method": request.codeChallengeMethod,
+	} {
+		if value != "" {
+			params[name] = value
+		}
+	}
+
+	status := http.StatusOK
+	if message != "" {
+		status = http.StatusUnauthorized
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	err = loginPage.Execute(w, struct {
+		ClientName string
+		Scopes     []string
+		Params     map[string]string
+		CSRF       string
+		Email      string
+		Error      string
+	}{request.client.Name, request.scopes, params, csrf, email, message})
+	if err != nil {
+		log.Printf("Error rendering login page: %v", err)
+	}
+}
+
+func writeAuthorizeErrorPage(w http.ResponseWriter, message string) {
+	WriteErrorPage(w, http.StatusBadRequest, "Authorization failed", message)
+}
+
+func redirectAuthorizeError(w http.ResponseWriter, r *http.Request, redirectURI string, state string, authErr *authorizeError) {
+	redirectWithParams(w, r, redirectURI, url.Values{
+		"error":             {authErr.code},
+		"error_description": {authErr.description},
+		"state":             {state},
+	})
+}
+
+// redirectWithParams sends the user to redirectURI with params added to its query, leaving out empty ones
+func redirectWithParams(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		writeAuthorizeErrorPage(w, "The application's redirect address is invalid.")
+		return
+	}
+	query := target.Query()
+	for name, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query.Set(name, values[0])
+		}
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// SetPasswordHandler sets the password users sign in to the authorization server with, creating the user if
+// needed. It must only be reachable by admins.
+func (l *LocalIdentityProvider) SetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Email == "" || len(request.Password) < 8 || len(request.Password) > 72 {
+		http.Error(w, "email is required and password must be 8 to 72 bytes long", http.StatusBadRequest)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(request.Password), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	user, err := l.store.SetUserPassword(request.Email, string(hash))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]uuid.UUID{"user_id": user.ID})
+}
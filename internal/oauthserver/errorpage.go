@@ -0,0 +1,31 @@
+package oauthserver
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+)
+
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}} - Loral</title></head>
+<body style="font-family: sans-serif; max-width: 36rem; margin: 4rem auto;">
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<p>Please return to the application you came from and try again.</p>
+</body>
+</html>
+`))
+
+// WriteErrorPage renders a human readable error for flows that end in the user's browser
+func WriteErrorPage(w http.ResponseWriter, status int, title string, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := errorPage.Execute(w, struct {
+		Title   string
+		Message string
+	}{title, message})
+	if err != nil {
+		log.Printf("Error rendering error page: %v", err)
+	}
+}
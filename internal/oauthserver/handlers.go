@@ -2,12 +2,14 @@ package oauthserver
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 
 	"github.com/gorilla/mux"
 )
 
-func (o *OryClient) RegisterOAuthServerHandlers(handler *mux.Router) {
+func (s *AuthorizationServer) RegisterOAuthServerHandlers(handler *mux.Router) {
 	handler.HandleFunc("/client/create", func(w http.ResponseWriter, r *http.Request) {
 		type CreateClientRequest struct {
 			Name         string   `json:"name"`
@@ -20,7 +22,7 @@ func (o *OryClient) RegisterOAuthServerHandlers(handler *mux.Router) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		clientID, clientSecret := o.CreateClient(request.Name, request.RedirectUris, request.Scopes)
+		clientID, clientSecret := s.CreateClient(request.Name, request.RedirectUris, request.Scopes)
 		client := struct {
 			ID     string `json:"id"`
 			Secret string `json:"secret"`
@@ -49,7 +51,7 @@ func (o *OryClient) RegisterOAuthServerHandlers(handler *mux.Router) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		o.ReplaceName(request.ID, request.Secret, request.Name)
+		writePatchResult(w, s.ReplaceName(request.ID, request.Secret, request.Name))
 	})
 
 	handler.HandleFunc("/client/edit/scope", func(w http.ResponseWriter, r *http.Request) {
@@ -67,10 +69,11 @@ func (o *OryClient) RegisterOAuthServerHandlers(handler *mux.Router) {
 			return
 		}
 		if request.Add {
-			o.AddScope(request.ID, request.Secret, request.Scope)
+			err = s.AddScope(request.ID, request.Secret, request.Scope)
 		} else {
-			o.RemoveScope(request.ID, request.Secret, request.Scope)
+			err = s.RemoveScope(request.ID, request.Secret, request.Scope)
 		}
+		writePatchResult(w, err)
 	})
 
 	handler.HandleFunc("/client/edit/redirectUris", func(w http.ResponseWriter, r *http.Request) {
@@ -86,6 +89,23 @@ func (o *OryClient) RegisterOAuthServerHandlers(handler *mux.Router) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		o.ReplaceRedirectUris(request.ID, request.Secret, request.Uris)
+		writePatchResult(w, s.ReplaceRedirectUris(request.ID, request.Secret, request.Uris))
 	})
 }
+
+// writePatchResult answers a client edit, with the status of the error if the change was rejected
+func writePatchResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusOK)
+	case errors.Is(err, ErrClientNotFound):
+		http.Error(w, "Unknown client", http.StatusNotFound)
+	case errors.Is(err, ErrInvalidClientSecret):
+		http.Error(w, "Client secret does not match", http.StatusUnauthorized)
+	case errors.Is(err, ErrUnsupportedPatch):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Printf("Failed to edit client: %v", err)
+		http.Error(w, "Failed to edit client", http.StatusInternalServerError)
+	}
+}
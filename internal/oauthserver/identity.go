@@ -0,0 +1,104 @@
+package oauthserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	ory "github.com/ory/client-go"
+	"lorallabs.com/oauth-server/internal/config"
+	"lorallabs.com/oauth-server/internal/store"
+	"lorallabs.com/oauth-server/internal/types"
+)
+
+var (
+	// ErrClientNotFound means there is no Loral OAuth client with the ID
+	ErrClientNotFound = errors.New("client not found")
+	// ErrInvalidClientSecret means the secret sent to change a client is not the client's
+	ErrInvalidClientSecret = errors.New("client secret does not match")
+	// ErrUnsupportedPatch means the backend cannot apply the patch operation
+	ErrUnsupportedPatch = errors.New("unsupported client patch")
+)
+
+// IdentityProvider is the backend that holds Loral OAuth clients and vouches for their access tokens.
+// Ory's models are the common currency, so callers do not care which backend is in use.
+type IdentityProvider interface {
+	// IntrospectToken reports whether token is active and, if scope is not empty, granted every scope in it.
+	// It returns nil if the backend could not be asked.
+	IntrospectToken(token string, scope string) *ory.IntrospectedOAuth2Token
+	CreateClient(clientName string, redirectUris []string, providerScopes []string) (clientID string, clientSecret string)
+	// GetClient returns ErrClientNotFound if there is no client with id, and other errors if the backend
+	// could not be asked
+	GetClient(id string) (*ory.OAuth2Client, error)
+	ListClients(clientName string) []ory.OAuth2Client
+	// PatchClient applies a JSON patch operation to a client, after checking its secret. Errors wrap
+	// ErrClientNotFound, ErrInvalidClientSecret or ErrUnsupportedPatch when the cause is known.
+	PatchClient(id string, clientSecret string, op types.Operation, path string, value interface{}) error
+}
+
+// NewIdentityProvider returns the backend picked by IDENTITY_BACKEND
+func NewIdentityProvider(ctx context.Context) (IdentityProvider, error) {
+	config := ctx.Value(types.ConfigKey).(*config.Config)
+	switch config.IdentityBackend {
+	case "ory":
+		return NewOryClient(ctx, config.OryURL), nil
+	case "local":
+		return NewLocalIdentityProvider(ctx.Value(types.StoreKey).(*store.Store), config)
+	}
+	return nil, fmt.Errorf("unknown identity backend %q", config.IdentityBackend)
+}
+
+// AuthorizationServer is the identity backend as the rest of the server uses it: it validates JWT access
+// tokens locally and caches introspections if configured, and serves the client management endpoints.
+type AuthorizationServer struct {
+	IdentityProvider
+	ctx context.Context
+
+	// local validation of JWT access tokens, nil when every token is introspected
+	keys     *KeySet
+	issuer   string
+	audience string
+	// introspections caches introspection results, nil when off
+	introspections *introspectionCache
+}
+
+func NewAuthorizationServer(ctx context.Context, identity IdentityProvider) *AuthorizationServer {
+	config := ctx.Value(types.ConfigKey).(*config.Config)
+	server := &AuthorizationServer{IdentityProvider: identity, ctx: ctx}
+
+	validation := config.TokenValidation
+	if validation.LocalJWT {
+		server.keys = NewKeySet(validation.JWKSURL)
+		server.issuer = config.IssuerURL
+		server.audience = validation.Audience
+	}
+	server.introspections = newIntrospectionCache(validation.IntrospectionCacheTTL, validation.IntrospectionCacheSize)
+	return server
+}
+
+// IntrospectToken asks the identity backend about token. With local validation on, JWT access tokens are
+// verified against the issuer's JWKS instead and only opaque tokens are introspected. Active introspection
+// results are cached if configured.
+func (s *AuthorizationServer) IntrospectToken(token string, scope string) *ory.IntrospectedOAuth2Token {
+	if s.keys != nil {
+		if introspected, ok := introspectJWT(s.ctx, s.keys, s.issuer, s.audience, token, scope); ok {
+			return introspected
+		}
+	}
+	if cached := s.introspections.get(token, scope); cached != nil {
+		return cached
+	}
+	introspected := s.IdentityProvider.IntrospectToken(token, scope)
+	s.introspections.put(token, scope, introspected)
+	return introspected
+}
+
+// RefreshSigningKeys keeps the JWKS used to validate JWT access tokens current until ctx is cancelled.
+// It returns right away if tokens are not validated locally.
+func (s *AuthorizationServer) RefreshSigningKeys(ctx context.Context) {
+	if s.keys == nil {
+		return
+	}
+	config := s.ctx.Value(types.ConfigKey).(*config.Config)
+	s.keys.Run(ctx, config.TokenValidation.JWKSRefreshInterval)
+}
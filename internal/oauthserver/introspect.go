@@ -0,0 +1,181 @@
+package oauthserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	ory "github.com/ory/client-go"
+)
+
+// clockSkew is the leeway given to the exp and nbf claims of JWT access tokens
+const clockSkew = 30 * time.Second
+
+// IsClientToken reports whether an active token was issued to a client for itself, by the client_credentials
+// grant, rather than for a user. Ory Hydra and the built-in authorization server both make the client its
+// subject. Such tokens must not reach provider connections, which are keyed by user.
+func IsClientToken(introspected *ory.IntrospectedOAuth2Token) bool {
+	return introspected.GetSub() == "" || introspected.GetSub() == introspected.GetClientId()
+}
+
+// introspectJWT validates a JWT access token locally, with the same outcome introspection would have:
+// an expired, not yet valid or out of scope token comes back inactive with its claims, a token that
+// fails verification comes back inactive without any. It returns false if the token has to be
+// introspected instead, because it is opaque or no signing keys could be loaded. Only JWTs typed as access
+// tokens with a client_id are accepted, so ID tokens are not, and if audience is set it must be in their aud
+// claim, so tokens the issuer minted for other resources are not either.
+func introspectJWT(ctx context.Context, keys *KeySet, issuer string, audience string, token string, scope string) (*ory.IntrospectedOAuth2Token, bool) {
+	if !isJWT(token) {
+		return nil, false
+	}
+	claims, err := VerifyJWT(ctx, keys, token)
+	if errors.Is(err, errNoKeys) {
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Rejected JWT access token: %v", err)
+		return ory.NewIntrospectedOAuth2Token(false), true
+	}
+	if strings.TrimSuffix(claims.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		log.Printf("Rejected JWT access token from issuer %q", claims.Issuer)
+		return ory.NewIntrospectedOAuth2Token(false), true
+	}
+	if claims.ClientID == "" {
+		log.Printf("Rejected JWT without a client_id, it is not an access token")
+		return ory.NewIntrospectedOAuth2Token(false), true
+	}
+	if audience != "" && !containsString(claims.Audience, audience) {
+		log.Printf("Rejected JWT access token for audience %v", claims.Audience)
+		return ory.NewIntrospectedOAuth2Token(false), true
+	}
+
+	scopes := claims.Scopes()
+	introspected := ory.NewIntrospectedOAuth2Token(true)
+	introspected.SetSub(claims.Subject)
+	introspected.SetClientId(claims.ClientID)
+	introspected.SetScope(strings.Join(scopes, " "))
+	introspected.SetIss(claims.Issuer)
+	introspected.SetAud(claims.Audience)
+	introspected.SetTokenUse("access_token")
+	introspected.SetTokenType("Bearer")
+	if claims.ExpiresAt != 0 {
+		introspected.SetExp(claims.ExpiresAt)
+	}
+	if claims.IssuedAt != 0 {
+		introspected.SetIat(claims.IssuedAt)
+	}
+	if claims.NotBefore != 0 {
+		introspected.SetNbf(claims.NotBefore)
+	}
+	if claims.Ext != nil {
+		introspected.SetExt(claims.Ext)
+	}
+
+	now := time.Now()
+	expired := claims.ExpiresAt == 0 || now.Add(-clockSkew).Unix() >= claims.ExpiresAt
+	early := claims.NotBefore != 0 && now.Add(clockSkew).Unix() < claims.NotBefore
+	if expired || early {
+		introspected.Active = false
+	}
+	// like introspection, every requested scope must have been granted
+	for _, required := range strings.Fields(scope) {
+		if !containsString(scopes, required) {
+			introspected.Active = false
+		}
+	}
+	return introspected, true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// introspectionCache keeps active introspection results by a hash of the token and the requested scope,
+// so the token itself is never held in memory longer than the request
+type introspectionCache struct {
+	ttl  time.Duration
+	size int
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]cachedIntrospection
+}
+
+type cachedIntrospection struct {
+	token   *ory.IntrospectedOAuth2Token
+	expires time.Time
+}
+
+// newIntrospectionCache returns nil, a cache that stores nothing, if ttl is not positive
+func newIntrospectionCache(ttl time.Duration, size int) *introspectionCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &introspectionCache{ttl: ttl, size: size, entries: make(map[[sha256.Size]byte]cachedIntrospection)}
+}
+
+func introspectionKey(token string, scope string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(scope + "\x00" + token))
+}
+
+func (c *introspectionCache) get(token string, scope string) *ory.IntrospectedOAuth2Token {
+	if c == nil {
+		return nil
+	}
+	key := introspectionKey(token, scope)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return entry.token
+}
+
+// put caches an active result until the ttl passes or the token expires, whichever comes first.
+// Inactive results are not cached, so a token is usable as soon as the authorization server says so.
+func (c *introspectionCache) put(token string, scope string, introspected *ory.IntrospectedOAuth2Token) {
+	if c == nil || introspected == nil || !introspected.Active {
+		return
+	}
+	now := time.Now()
+	expires := now.Add(c.ttl)
+	if exp, ok := introspected.GetExpOk(); ok {
+		if tokenExpires := time.Unix(*exp, 0); tokenExpires.Before(expires) {
+			expires = tokenExpires
+		}
+	}
+	if !expires.After(now) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		for key, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+	}
+	// still full of live entries, make room by dropping arbitrary ones
+	for key := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, key)
+	}
+	c.entries[introspectionKey(token, scope)] = cachedIntrospection{token: introspected, expires: expires}
+}
@@ -0,0 +1,367 @@
+package oauthserver
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// minKeyRefetch limits how often an unknown key ID can trigger a JWKS fetch, so tokens with made up
+// key IDs cannot hammer the issuer
+const minKeyRefetch = 30 * time.Second
+
+var errNoKeys = errors.New("no signing keys loaded")
+
+// KeySet holds the issuer's token signing keys, fetched from its JWKS URL
+type KeySet struct {
+	url    string
+	client *http.Client
+	// fetching lets a single request at a time fetch the JWKS for an unknown key ID, the rest wait for it
+	// and then look the key up again
+	fetching sync.Mutex
+
+	mu          sync.RWMutex
+	keys        map[string]crypto.PublicKey // by key ID
+	lastAttempt time.Time
+}
+
+func NewKeySet(url string) *KeySet {
+	return &KeySet{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// staticKeySet holds keys that are known up front and never fetched
+func staticKeySet(keys map[string]crypto.PublicKey) *KeySet {
+	return &KeySet{keys: keys}
+}
+
+// Run fetches the keys now and then every interval until ctx is cancelled
+func (k *KeySet) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := k.Refresh(ctx); err != nil {
+			log.Printf("Failed to refresh token signing keys from %s: %v", k.url, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh replaces the keys with the current JWKS. The previous keys stay in use if it cannot be fetched.
+func (k *KeySet) Refresh(ctx context.Context) error {
+	k.mu.Lock()
+	k.lastAttempt = time.Now()
+	k.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS responded %s", resp.Status)
+	}
+	var jwks JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS has no usable signing keys")
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// key returns the key with the ID kid, fetching the JWKS again if it is unknown, since the issuer may
+// have rotated its keys since the last refresh
+func (k *KeySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	k.mu.RLock()
+	key, ok := k.lookup(kid)
+	k.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	if k.url != "" {
+		// a fetch may be under way already, wait for it and look again before fetching
+		k.fetching.Lock()
+		k.mu.RLock()
+		_, ok = k.lookup(kid)
+		stale := time.Since(k.lastAttempt) > minKeyRefetch
+		k.mu.RUnlock()
+		if !ok && stale {
+			if err := k.Refresh(ctx); err != nil {
+				log.Printf("Failed to refresh token signing keys from %s: %v", k.url, err)
+			}
+		}
+		k.fetching.Unlock()
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+	if k.keys == nil {
+		return nil, errNoKeys
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookup finds a key by ID, a token without one can only use the key of a single key set
+func (k *KeySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if key, ok := k.keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// PublicKey decodes an RSA or EC public key
+func (j JWK) PublicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil || len(raw) == 0 {
+		return nil, errors.New("invalid base64url integer")
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// jwtHeader is the JOSE header of a signed JWT
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// AccessTokenClaims are the claims of a JWT access token issued by Ory Hydra or the built-in authorization server
+type AccessTokenClaims struct {
+	Issuer    string                 `json:"iss"`
+	Subject   string                 `json:"sub"`
+	Audience  audience               `json:"aud,omitempty"`
+	ExpiresAt int64                  `json:"exp"`
+	NotBefore int64                  `json:"nbf,omitempty"`
+	IssuedAt  int64                  `json:"iat,omitempty"`
+	ID        string                 `json:"jti,omitempty"`
+	ClientID  string                 `json:"client_id"`
+	Scp       []string               `json:"scp,omitempty"`   // Hydra's scope claim
+	Scope     string                 `json:"scope,omitempty"` // RFC 9068's scope claim
+	Ext       map[string]interface{} `json:"ext,omitempty"`
+}
+
+// Scopes returns the granted scopes from whichever claim the issuer uses
+func (c *AccessTokenClaims) Scopes() []string {
+	if len(c.Scp) > 0 {
+		return c.Scp
+	}
+	return strings.Fields(c.Scope)
+}
+
+// audience is the aud claim, a single string or an array of them
+type audience []string
+
+func (a *audience) UnmarshalJSON(raw []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte(`"`)) {
+		var single string
+		if err := json.Unmarshal(raw, &single); err != nil {
+			return err
+		}
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(raw, (*[]string)(a))
+}
+
+// isJWT reports whether token has the shape of a compact JWS, opaque tokens do not
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// VerifyJWT checks the signature of a compact JWS against keys and returns its claims. Only the access token
+// types of RFC 9068 and Hydra (at+jwt and JWT) are accepted; it does not check the claims themselves.
+func VerifyJWT(ctx context.Context, keys *KeySet, token string) (*AccessTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed JWT header")
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, errors.New("malformed JWT header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed JWT signature")
+	}
+
+	if !isAccessTokenType(header.Typ) {
+		return nil, fmt.Errorf("JWT of type %q is not an access token", header.Typ)
+	}
+	hash, err := signatureHash(header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	key, err := keys.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(header.Alg, key, hash, h.Sum(nil), signature); err != nil {
+		return nil, err
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed JWT claims")
+	}
+	var claims AccessTokenClaims
+	if err := json.Unmarshal(rawClaims, &claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT claims: %w", err)
+	}
+	return &claims, nil
+}
+
+// isAccessTokenType reports whether typ is RFC 9068's at+jwt or the plain JWT type Hydra gives its access
+// tokens. Hydra's ID tokens are typed JWT as well, they are told apart by their lack of a client_id.
+func isAccessTokenType(typ string) bool {
+	switch strings.TrimPrefix(strings.ToLower(typ), "application/") {
+	case "at+jwt", "jwt":
+		return true
+	}
+	return false
+}
+
+// signatureHash returns the hash of an asymmetric JWS algorithm. Symmetric and unsigned algorithms
+// are refused, since a public key must never be usable as an HMAC secret.
+func signatureHash(alg string) (crypto.Hash, error) {
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		return crypto.SHA256, nil
+	case "RS384", "PS384", "ES384":
+		return crypto.SHA384, nil
+	case "RS512", "PS512", "ES512":
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported JWT algorithm %q", alg)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, hash crypto.Hash, digest, signature []byte) error {
+	invalid := errors.New("invalid JWT signature")
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		var err error
+		switch alg[:2] {
+		case "RS":
+			err = rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		case "PS":
+			err = rsa.VerifyPSS(k, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		default:
+			return fmt.Errorf("%s JWT signed with an RSA key", alg)
+		}
+		if err != nil {
+			return invalid
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			return fmt.Errorf("%s JWT signed with an EC key", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return invalid
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return invalid
+		}
+		return nil
+	}
+	return errors.New("unsupported signing key")
+}
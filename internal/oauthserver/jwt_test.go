@@ -0,0 +1,359 @@
+package oauthserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://auth.example.com"
+	testAudience = "https://api.example.com"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// testRSAKey returns an RSA key shared by the package's tests, generating one is slow
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	testKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		testKey = key
+	})
+	return testKey
+}
+
+// signJWT builds a compact JWS with any header, signed by key with alg. alg none gets an empty
+// signature and HS256 uses key as the HMAC secret, as an attacker would.
+func signJWT(t *testing.T, header map[string]string, claims interface{}, key interface{}) string {
+	t.Helper()
+	rawHeader, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawClaims, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(rawHeader) + "." + base64.RawURLEncoding.EncodeToString(rawClaims)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch header["alg"] {
+	case "none":
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case "PS256":
+		signature, err = rsa.SignPSS(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256":
+		r, s, signErr := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		err = signErr
+		signature = make([]byte, 64)
+		if err == nil {
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	default:
+		t.Fatalf("signJWT does not support %s", header["alg"])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validClaims() *AccessTokenClaims {
+	now := time.Now()
+	return &AccessTokenClaims{
+		Issuer:    testIssuer,
+		Subject:   "user",
+		Audience:  audience{testAudience},
+		ExpiresAt: now.Add(time.Hour).Unix(),
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+		ClientID:  "client",
+		Scp:       []string{"github", "offline_access"},
+	}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	rsaKey := testRSAKey(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := staticKeySet(map[string]crypto.PublicKey{"rsa": &rsaKey.PublicKey, "ec": &ecKey.PublicKey})
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		key    interface{}
+		valid  bool
+	}{
+		{"RS256", map[string]string{"alg": "RS256", "kid": "rsa", "typ": "at+jwt"}, rsaKey, true},
+		{"PS256", map[string]string{"alg": "PS256", "kid": "rsa", "typ": "at+jwt"}, rsaKey, true},
+		{"ES256", map[string]string{"alg": "ES256", "kid": "ec", "typ": "at+jwt"}, ecKey, true},
+		{"Hydra JWT type", map[string]string{"alg": "RS256", "kid": "rsa", "typ": "JWT"}, rsaKey, true},
+		{"media type", map[string]string{"alg": "RS256", "kid": "rsa", "typ": "application/at+jwt"}, rsaKey, true},
+		{"HS256 with the public key as secret", map[string]string{"alg": "HS256", "kid": "rsa", "typ": "at+jwt"}, publicDER, false},
+		{"HS256 with the modulus as secret", map[string]string{"alg": "HS256", "kid": "rsa", "typ": "at+jwt"}, rsaKey.N.Bytes(), false},
+		{"unsigned", map[string]string{"alg": "none", "kid": "rsa", "typ": "at+jwt"}, nil, false},
+		{"RS256 against an EC key", map[string]string{"alg": "RS256", "kid": "ec", "typ": "at+jwt"}, rsaKey, false},
+		{"ES256 against an RSA key", map[string]string{"alg": "ES256", "kid": "rsa", "typ": "at+jwt"}, ecKey, false},
+		{"unknown kid", map[string]string{"alg": "RS256", "kid": "other", "typ": "at+jwt"}, rsaKey, false},
+		{"no kid with several keys", map[string]string{"alg": "RS256", "typ": "at+jwt"}, rsaKey, false},
+		{"ID token type", map[string]string{"alg": "RS256", "kid": "rsa", "typ": "id_token+jwt"}, rsaKey, false},
+		{"no type", map[string]string{"alg": "RS256", "kid": "rsa"}, rsaKey, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := signJWT(t, test.header, validClaims(), test.key)
+			claims, err := VerifyJWT(context.Background(), keys, token)
+			if test.valid {
+				if err != nil {
+					t.Fatalf("VerifyJWT() error = %v", err)
+				}
+				if claims.Subject != "user" || claims.ClientID != "client" {
+					t.Errorf("VerifyJWT() claims = %+v", claims)
+				}
+			} else if err == nil {
+				t.Errorf("VerifyJWT() accepted the token")
+			}
+		})
+	}
+
+	t.Run("tampered claims", func(t *testing.T) {
+		token := signJWT(t, map[string]string{"alg": "RS256", "kid": "rsa", "typ": "at+jwt"}, validClaims(), rsaKey)
+		forged := validClaims()
+		forged.Subject = "admin"
+		rawClaims, _ := json.Marshal(forged)
+		parts := strings.Split(token, ".")
+		parts[1] = base64.RawURLEncoding.EncodeToString(rawClaims)
+		if _, err := VerifyJWT(context.Background(), keys, parts[0]+"."+parts[1]+"."+parts[2]); err == nil {
+			t.Errorf("VerifyJWT() accepted forged claims")
+		}
+	})
+
+	t.Run("signer", func(t *testing.T) {
+		signer := newSigner(rsaKey)
+		token, err := signer.Sign(validClaims())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := VerifyJWT(context.Background(), signer.KeySet(), token); err != nil {
+			t.Errorf("VerifyJWT() error = %v", err)
+		}
+		// the signer's key set is keyed by thumbprint, the other key set does not know it
+		if _, err := VerifyJWT(context.Background(), keys, token); err == nil {
+			t.Errorf("VerifyJWT() accepted a token signed with an unknown kid")
+		}
+	})
+}
+
+func TestIntrospectJWT(t *testing.T) {
+	signer := newSigner(testRSAKey(t))
+	keys := signer.KeySet()
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		modify func(claims *AccessTokenClaims)
+		scope  string
+		active bool
+	}{
+		{"valid", func(claims *AccessTokenClaims) {}, "", true},
+		{"granted scope", func(claims *AccessTokenClaims) {}, "github", true},
+		{"scope not granted", func(claims *AccessTokenClaims) {}, "google", false},
+		{"RFC 9068 scope claim", func(claims *AccessTokenClaims) { claims.Scp, claims.Scope = nil, "github" }, "github", true},
+		{"expired", func(claims *AccessTokenClaims) { claims.ExpiresAt = now.Add(-time.Minute).Unix() }, "", false},
+		{"expired within the skew", func(claims *AccessTokenClaims) { claims.ExpiresAt = now.Add(-clockSkew / 2).Unix() }, "", true},
+		{"no exp", func(claims *AccessTokenClaims) { claims.ExpiresAt = 0 }, "", false},
+		{"not yet valid", func(claims *AccessTokenClaims) { claims.NotBefore = now.Add(time.Minute).Unix() }, "", false},
+		{"not yet valid within the skew", func(claims *AccessTokenClaims) { claims.NotBefore = now.Add(clockSkew / 2).Unix() }, "", true},
+		{"issuer with a trailing slash", func(claims *AccessTokenClaims) { claims.Issuer = testIssuer + "/" }, "", true},
+		{"other issuer", func(claims *AccessTokenClaims) { claims.Issuer = "https://evil.example.com" }, "", false},
+		{"no issuer", func(claims *AccessTokenClaims) { claims.Issuer = "" }, "", false},
+		{"one of several audiences", func(claims *AccessTokenClaims) { claims.Audience = audience{"other", testAudience} }, "", true},
+		{"other audience", func(claims *AccessTokenClaims) { claims.Audience = audience{"https://other.example.com"} }, "", false},
+		{"no audience", func(claims *AccessTokenClaims) { claims.Audience = nil }, "", false},
+		{"no client_id", func(claims *AccessTokenClaims) { claims.ClientID = "" }, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := validClaims()
+			test.modify(claims)
+			token, err := signer.Sign(claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			introspected, ok := introspectJWT(context.Background(), keys, testIssuer, testAudience, token, test.scope)
+			if !ok {
+				t.Fatalf("introspectJWT() did not handle the token")
+			}
+			if introspected.Active != test.active {
+				t.Errorf("introspectJWT() active = %v, want %v", introspected.Active, test.active)
+			}
+		})
+	}
+
+	t.Run("bad signature has no claims", func(t *testing.T) {
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := signJWT(t, map[string]string{"alg": "RS256", "kid": signer.kid, "typ": "at+jwt"}, validClaims(), other)
+		introspected, ok := introspectJWT(context.Background(), keys, testIssuer, testAudience, token, "")
+		if !ok || introspected.Active || introspected.GetSub() != "" {
+			t.Errorf("introspectJWT() = %+v, %v, want an inactive token without claims", introspected, ok)
+		}
+	})
+
+	t.Run("opaque token", func(t *testing.T) {
+		if _, ok := introspectJWT(context.Background(), keys, testIssuer, testAudience, "ory_at_opaque", ""); ok {
+			t.Errorf("introspectJWT() handled an opaque token")
+		}
+	})
+
+	t.Run("no keys loaded", func(t *testing.T) {
+		token, err := signer.Sign(validClaims())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := introspectJWT(context.Background(), staticKeySet(nil), testIssuer, testAudience, token, ""); ok {
+			t.Errorf("introspectJWT() handled a token without keys to verify it")
+		}
+	})
+}
+
+// TestIntrospectHydraJWT checks tokens shaped like Ory Hydra's, which are typed JWT and carry an empty aud
+// unless the client requested an audience
+func TestIntrospectHydraJWT(t *testing.T) {
+	key := testRSAKey(t)
+	keys := staticKeySet(map[string]crypto.PublicKey{"public:hydra.jwt.access-token": &key.PublicKey})
+	header := map[string]string{"alg": "RS256", "kid": "public:hydra.jwt.access-token", "typ": "JWT"}
+	now := time.Now().Unix()
+	accessToken := func(aud []string) map[string]interface{} {
+		return map[string]interface{}{
+			"aud":       aud,
+			"client_id": "3f0c7a4e-5d0b-4a8e-9c55-6f2a1f2b9c10",
+			"exp":       now + 3600,
+			"ext":       map[string]interface{}{},
+			"iat":       now,
+			"iss":       testIssuer + "/",
+			"jti":       "0b9f2e55-2f54-4d6e-a3c8-2d4b3b1d7e0f",
+			"nbf":       now,
+			"scp":       []string{"github", "offline_access"},
+			"sub":       "6a3c1e2d-8b7f-4c59-9d0e-1f2a3b4c5d6e",
+		}
+	}
+	idToken := map[string]interface{}{
+		"aud":       []string{"3f0c7a4e-5d0b-4a8e-9c55-6f2a1f2b9c10"},
+		"exp":       now + 3600,
+		"iat":       now,
+		"iss":       testIssuer + "/",
+		"sub":       "6a3c1e2d-8b7f-4c59-9d0e-1f2a3b4c5d6e",
+		"auth_time": now,
+	}
+
+	tests := []struct {
+		name     string
+		claims   map[string]interface{}
+		audience string
+		active   bool
+	}{
+		{"no audience configured", accessToken([]string{}), "", true},
+		{"requested audience", accessToken([]string{testAudience}), testAudience, true},
+		{"audience configured but not requested", accessToken([]string{}), testAudience, false},
+		{"ID token", idToken, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token := signJWT(t, header, test.claims, key)
+			introspected, ok := introspectJWT(context.Background(), keys, testIssuer, test.audience, token, "github")
+			if !ok {
+				t.Fatalf("introspectJWT() did not handle the token")
+			}
+			if introspected.Active != test.active {
+				t.Errorf("introspectJWT() active = %v, want %v", introspected.Active, test.active)
+			}
+			if test.active && (introspected.GetSub() != test.claims["sub"] || introspected.GetClientId() != test.claims["client_id"]) {
+				t.Errorf("introspectJWT() = %+v", introspected)
+			}
+		})
+	}
+}
+
+func TestKeySetFetchesUnknownKeyOnce(t *testing.T) {
+	signer := newSigner(testRSAKey(t))
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(50 * time.Millisecond)
+		writeJSON(w, http.StatusOK, JWKS{Keys: []JWK{signer.JWK()}})
+	}))
+	defer server.Close()
+
+	keys := NewKeySet(server.URL)
+	token, err := signer.Sign(validClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := VerifyJWT(context.Background(), keys, token)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("VerifyJWT() error = %v", err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("fetched the JWKS %d times, want 1", fetches)
+	}
+
+	// a made up key ID right after a fetch does not trigger another one
+	forged := signJWT(t, map[string]string{"alg": "RS256", "kid": "made-up", "typ": "at+jwt"}, validClaims(), testRSAKey(t))
+	if _, err := VerifyJWT(context.Background(), keys, forged); err == nil {
+		t.Errorf("VerifyJWT() accepted an unknown kid")
+	}
+	if fetches != 1 {
+		t.Errorf("fetched the JWKS %d times after an unknown kid, want 1", fetches)
+	}
+}
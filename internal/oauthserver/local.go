@@ -0,0 +1,342 @@
+package oauthserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	ory "github.com/ory/client-go"
+	"gorm.io/gorm"
+	"lorallabs.com/oauth-server/internal/config"
+	"lorallabs.com/oauth-server/internal/store"
+	"lorallabs.com/oauth-server/internal/types"
+	schema "lorallabs.com/oauth-server/pkg/db"
+)
+
+// LocalIdentityProvider keeps clients in Postgres and runs the authorization server itself, so the server
+// runs without an Ory project. It accepts the JWT access tokens it issued and API keys minted for clients.
+type LocalIdentityProvider struct {
+	store localStore
+
+	signer          *Signer
+	keys            *KeySet // the signer's public key
+	issuer          string
+	audience        string
+	scopes          []string // every scope a client can be granted
+	accessTokenTTL  time.Duration
+	refreshTokenTTL time.Duration
+}
+
+// localStore is the part of store.Store the local identity backend uses
+type localStore interface {
+	CreateClient(client *schema.Client) error
+	GetClient(id uuid.UUID) (*schema.Client, error)
+	ListClients(name string) ([]schema.Client, error)
+	UpdateClient(client *schema.Client) error
+	CreateAPIKey(key *schema.APIKey) error
+	GetAPIKey(secretHash string) (*schema.APIKey, error)
+	GetOrCreateUser(email string) (*schema.User, error)
+	GetUserByEmail(email string) (*schema.User, error)
+	SetUserPassword(email string, passwordHash string) (*schema.User, error)
+	CreateAuthorizationCode(code *schema.AuthorizationCode) error
+	ConsumeAuthorizationCode(codeHash string, clientID uuid.UUID) (*schema.AuthorizationCode, error)
+	CreateRefreshToken(token *schema.RefreshToken) error
+	ConsumeRefreshToken(tokenHash string, clientID uuid.UUID) (*schema.RefreshToken, error)
+}
+
+func NewLocalIdentityProvider(store *store.Store, config *config.Config) (*LocalIdentityProvider, error) {
+	signer, err := LoadSigner(config.AuthorizationServer.SigningKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	// the tokens this server issues always name an audience, this server unless another is configured
+	tokenAudience := config.TokenValidation.Audience
+	if tokenAudience == "" {
+		tokenAudience = config.PublicURL
+	}
+	scopes := []string{"openid", "offline_access"}
+	for _, provider := range config.Providers {
+		scopes = append(scopes, provider.Name)
+	}
+	return &LocalIdentityProvider{
+		store:           store,
+		signer:          signer,
+		keys:            signer.KeySet(),
+		issuer:          strings.TrimSuffix(config.IssuerURL, "/"),
+		audience:        tokenAudience,
+		scopes:          scopes,
+		accessTokenTTL:  config.AuthorizationServer.AccessTokenTTL,
+		refreshTokenTTL: config.AuthorizationServer.RefreshTokenTTL,
+	}, nil
+}
+
+func (l *LocalIdentityProvider) IntrospectToken(token string, scope string) *ory.IntrospectedOAuth2Token {
+	if introspected, ok := introspectJWT(context.Background(), l.keys, l.issuer, l.audience, token, scope); ok {
+		return introspected
+	}
+
+	key, err := l.store.GetAPIKey(hashSecret(token))
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Failed to look up API key: %v", err)
+			return nil
+		}
+		return ory.NewIntrospectedOAuth2Token(false)
+	}
+	client, err := l.store.GetClient(key.ClientID)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Failed to look up client %s: %v", key.ClientID, err)
+			return nil
+		}
+		return ory.NewIntrospectedOAuth2Token(false)
+	}
+
+	// a key keeps no scope its client has since lost
+	granted := strings.Fields(client.Scope)
+	if key.Scope != "" {
+		var narrowed []string
+		for _, s := range strings.Fields(key.Scope) {
+			if containsString(granted, s) {
+				narrowed = append(narrowed, s)
+			}
+		}
+		granted = narrowed
+	}
+	for _, required := range strings.Fields(scope) {
+		if !containsString(granted, required) {
+			return ory.NewIntrospectedOAuth2Token(false)
+		}
+	}
+
+	introspected := ory.NewIntrospectedOAuth2Token(true)
+	introspected.SetSub(key.UserID.String())
+	introspected.SetClientId(client.ID.String())
+	introspected.SetScope(strings.Join(granted, " "))
+	introspected.SetIat(key.CreatedAt.Unix())
+	introspected.SetTokenUse("access_token")
+	introspected.SetTokenType("Bearer")
+	if key.ExpiresAt != nil {
+		introspected.SetExp(key.ExpiresAt.Unix())
+	}
+	return introspected
+}
+
+func (l *LocalIdentityProvider) CreateClient(clientName string, redirectUris []string, providerScopes []string) (clientID string, clientSecret string) {
+	secret, err := randomSecret()
+	if err != nil {
+		log.Printf("Failed to generate client secret: %v", err)
+		return "", ""
+	}
+	// only scopes a token can be granted, the configured providers plus openid and offline_access
+	var scopes []string
+	for _, scope := range append(providerScopes, "openid", "offline_access") {
+		if !containsString(l.scopes, scope) {
+			log.Printf("Ignoring unknown scope %q for client %q", scope, clientName)
+			continue
+		}
+		if !containsString(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	client := &schema.Client{
+		Name:         clientName,
+		SecretHash:   hashSecret(secret),
+		Scope:        strings.Join(scopes, " "),
+		RedirectURIs: redirectUris,
+	}
+	if err := l.store.CreateClient(client); err != nil {
+		log.Printf("Failed to create client %q: %v", clientName, err)
+		return "", ""
+	}
+	return client.ID.String(), secret
+}
+
+func (l *LocalIdentityProvider) GetClient(id string) (*ory.OAuth2Client, error) {
+	client, err := l.getClient(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrClientNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return toOAuth2Client(client), nil
+}
+
+func (l *LocalIdentityProvider) ListClients(clientName string) []ory.OAuth2Client {
+	clients, err := l.store.ListClients(clientName)
+	if err != nil {
+		log.Printf("Failed to list clients: %v", err)
+		return nil
+	}
+	list := make([]ory.OAuth2Client, len(clients))
+	for i := range clients {
+		list[i] = *toOAuth2Client(&clients[i])
+	}
+	return list
+}
+
+// PatchClient supports the replace operations the client management endpoints send
+func (l *LocalIdentityProvider) PatchClient(id string, clientSecret string, op types.Operation, path string, value interface{}) error {
+	client, err := l.getClient(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrClientNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(clientSecret)), []byte(client.SecretHash)) != 1 {
+		return ErrInvalidClientSecret
+	}
+	if op != types.Replace {
+		return fmt.Errorf("%w: operation %q", ErrUnsupportedPatch, op)
+	}
+
+	switch path {
+	case "/client_name":
+		name, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%w: %s must be a string", ErrUnsupportedPatch, path)
+		}
+		client.Name = name
+	case "/scope":
+		scope, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%w: %s must be a string", ErrUnsupportedPatch, path)
+		}
+		// a client may keep scopes of providers since removed from the config, but not gain unknown ones
+		scopes := strings.Fields(scope)
+		for _, scope := range scopes {
+			if !containsString(l.scopes, scope) && !containsString(strings.Fields(client.Scope), scope) {
+				return fmt.Errorf("%w: unknown scope %q", ErrUnsupportedPatch, scope)
+			}
+		}
+		client.Scope = strings.Join(scopes, " ")
+	case "/redirect_uris":
+		uris, ok := value.([]string)
+		if !ok {
+			return fmt.Errorf("%w: %s must be a list of strings", ErrUnsupportedPatch, path)
+		}
+		client.RedirectURIs = uris
+	default:
+		return fmt.Errorf("%w: path %q", ErrUnsupportedPatch, path)
+	}
+	return l.store.UpdateClient(client)
+}
+
+// CreateAPIKey mints an access token for the user with email, creating the user if needed, through the
+// client with clientID. scope narrows the client's scopes, and ttl of 0 makes a key that never expires.
+func (l *LocalIdentityProvider) CreateAPIKey(clientID string, email string, scope string, ttl time.Duration) (string, *schema.APIKey, error) {
+	client, err := l.getClient(clientID)
+	if err != nil {
+		return "", nil, err
+	}
+	user, err := l.store.GetOrCreateUser(email)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randomSecret()
+	if err != nil {
+		return "", nil, err
+	}
+	key := &schema.APIKey{
+		Secret:   hashSecret(secret),
+		ClientID: client.ID,
+		UserID:   user.ID,
+		Scope:    strings.Join(strings.Fields(scope), " "),
+	}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl)
+		key.ExpiresAt = &expires
+	}
+	if err := l.store.CreateAPIKey(key); err != nil {
+		return "", nil, err
+	}
+	return secret, key, nil
+}
+
+// CreateAPIKeyHandler mints an API key, see CreateAPIKey. It must only be reachable by admins.
+func (l *LocalIdentityProvider) CreateAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ClientID  string `json:"client_id"`
+		Email     string `json:"email"`
+		Scope     string `json:"scope"`
+		ExpiresIn int64  `json:"expires_in"` // seconds
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Email == "" || request.ExpiresIn < 0 {
+		http.Error(w, "email is required and expires_in cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	secret, key, err := l.CreateAPIKey(request.ClientID, request.Email, request.Scope, time.Duration(request.ExpiresIn)*time.Second)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		http.Error(w, "Unknown client", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response, err := json.Marshal(struct {
+		APIKey    string     `json:"api_key"`
+		UserID    uuid.UUID  `json:"user_id"`
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	}{secret, key.UserID, key.ExpiresAt})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+func (l *LocalIdentityProvider) getClient(id string) (*schema.Client, error) {
+	clientID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return l.store.GetClient(clientID)
+}
+
+func toOAuth2Client(client *schema.Client) *ory.OAuth2Client {
+	c := ory.NewOAuth2Client()
+	c.SetClientId(client.ID.String())
+	c.SetClientName(client.Name)
+	c.SetScope(client.Scope)
+	c.SetRedirectUris(client.RedirectURIs)
+	c.SetGrantTypes([]string{"authorization_code", "refresh_token"})
+	c.SetResponseTypes([]string{"code"})
+	c.SetCreatedAt(client.CreatedAt)
+	c.SetUpdatedAt(client.UpdatedAt)
+	return c
+}
+
+// hashSecret is how client secrets and API keys are stored, they are random enough not to need a slow hash
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
@@ -4,22 +4,39 @@ import (
 	"strings"
 )
 
-func (o *OryClient) AddScope(id string, clientSecret string, scope string) {
-	client := o.GetClient(id)
-	scope = *client.Scope + " " + scope
-	o.PatchClient(id, clientSecret, "replace", "/scope", scope)
+func (s *AuthorizationServer) AddScope(id string, clientSecret string, scope string) error {
+	client, err := s.GetClient(id)
+	if err != nil {
+		return err
+	}
+	scopes := strings.Fields(client.GetScope())
+	for _, added := range strings.Fields(scope) {
+		if !containsString(scopes, added) {
+			scopes = append(scopes, added)
+		}
+	}
+	return s.PatchClient(id, clientSecret, "replace", "/scope", strings.Join(scopes, " "))
 }
 
-func (o *OryClient) RemoveScope(id string, clientSecret string, scope string) {
-	client := o.GetClient(id)
-	scope = strings.Replace(*client.Scope, scope, "", -1)
-	o.PatchClient(id, clientSecret, "replace", "/scope", scope)
+func (s *AuthorizationServer) RemoveScope(id string, clientSecret string, scope string) error {
+	client, err := s.GetClient(id)
+	if err != nil {
+		return err
+	}
+	removed := strings.Fields(scope)
+	var scopes []string
+	for _, kept := range strings.Fields(client.GetScope()) {
+		if !containsString(removed, kept) {
+			scopes = append(scopes, kept)
+		}
+	}
+	return s.PatchClient(id, clientSecret, "replace", "/scope", strings.Join(scopes, " "))
 }
 
-func (o *OryClient) ReplaceName(id string, clientSecret string, name string) {
-	o.PatchClient(id, clientSecret, "replace", "/client_name", name)
+func (s *AuthorizationServer) ReplaceName(id string, clientSecret string, name string) error {
+	return s.PatchClient(id, clientSecret, "replace", "/client_name", name)
 }
 
-func (o *OryClient) ReplaceRedirectUris(id string, clientSecret string, redirectUris []string) {
-	o.PatchClient(id, clientSecret, "replace", "/redirect_uris", redirectUris)
+func (s *AuthorizationServer) ReplaceRedirectUris(id string, clientSecret string, redirectUris []string) error {
+	return s.PatchClient(id, clientSecret, "replace", "/redirect_uris", redirectUris)
 }
@@ -0,0 +1,61 @@
+package oauthserver
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestScopeEdits(t *testing.T) {
+	tests := []struct {
+		name    string
+		scope   string // the client's scope before the edit
+		add     bool
+		edit    string
+		want    string
+		wantErr error
+	}{
+		{"add provider", "openid github", true, "google", "openid github google", nil},
+		{"add several", "openid", true, "github google", "openid github google", nil},
+		{"add granted", "openid github", true, "github", "openid github", nil},
+		{"add unknown", "openid github", true, "admin", "openid github", ErrUnsupportedPatch},
+		{"add unknown among known", "openid", true, "google admin", "openid", ErrUnsupportedPatch},
+		{"keep a removed provider", "openid dropbox", true, "github", "openid dropbox github", nil},
+		{"remove", "openid github google", false, "github", "openid google", nil},
+		{"remove several", "openid github google", false, "github google", "openid", nil},
+		{"remove a prefix of another scope", "read read:all", false, "read", "read:all", nil},
+		{"remove missing", "openid github", false, "google", "openid github", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tt := newTokenTest(t)
+			client := tt.store.clients[tt.client.ID]
+			client.Scope = test.scope
+			tt.store.clients[tt.client.ID] = client
+			server := &AuthorizationServer{IdentityProvider: tt.provider}
+
+			var err error
+			if test.add {
+				err = server.AddScope(client.ID.String(), testClientSecret, test.edit)
+			} else {
+				err = server.RemoveScope(client.ID.String(), testClientSecret, test.edit)
+			}
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("edit error = %v, want %v", err, test.wantErr)
+			}
+			if got := tt.store.clients[tt.client.ID].Scope; got != test.want {
+				t.Errorf("scope = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestScopeEditWrongSecret(t *testing.T) {
+	tt := newTokenTest(t)
+	server := &AuthorizationServer{IdentityProvider: tt.provider}
+	if err := server.AddScope(tt.client.ID.String(), "wrong", "github"); !errors.Is(err, ErrInvalidClientSecret) {
+		t.Errorf("AddScope() error = %v, want ErrInvalidClientSecret", err)
+	}
+	if err := server.AddScope("not a client", testClientSecret, "github"); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("AddScope() error = %v, want ErrClientNotFound", err)
+	}
+}
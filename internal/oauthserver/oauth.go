@@ -14,16 +14,18 @@ import (
 	"lorallabs.com/oauth-server/internal/types"
 )
 
+// OryClient is the identity backend of an Ory Network project
 type OryClient struct {
 	ory *ory.APIClient
 	ctx context.Context
 }
 
-func NewOryClient(ctx context.Context) *OryClient {
+// NewOryClient talks to the Ory project at url, authenticated with the Ory API key in ctx
+func NewOryClient(ctx context.Context, url string) *OryClient {
 	configuration := ory.NewConfiguration()
 	configuration.Servers = []ory.ServerConfiguration{
 		{
-			URL: "https://fervent-cori-shm6sflkse.projects.oryapis.com", // Public API URL
+			URL: url, // Public API URL
 		},
 	}
 	ory := ory.NewAPIClient(configuration)
@@ -41,6 +43,9 @@ type JWK struct {
 	Kid string `json:"kid"`
 	Alg string `json:"alg"`
 	N   string `json:"n"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
 }
 
 func (o *OryClient) CreateClient(clientName string, redirectUris []string, providerScopes []string) (clientID string, clientSecret string) {
@@ -78,7 +83,7 @@ func (o *OryClient) CreateClient(clientName string, redirectUris []string, provi
 	return resp.GetClientId(), resp.GetClientSecret()
 }
 
-func (o *OryClient) ListClients(clientName string) {
+func (o *OryClient) ListClients(clientName string) []ory.OAuth2Client {
 	oryAuthedContext := o.ctx
 
 	clients, r, err := o.ory.OAuth2API.ListOAuth2Clients(oryAuthedContext).ClientName(clientName).Execute()
@@ -86,11 +91,7 @@ func (o *OryClient) ListClients(clientName string) {
 		fmt.Fprintf(os.Stderr, "Error when calling `AdminApi.ListOAuth2Clients``: %v\n", err)
 		fmt.Fprintf(os.Stderr, "Full HTTP response: %v\n", r)
 	}
-	fmt.Fprintf(os.Stdout, "We have %d clients\n", len(clients))
-	for i, client := range clients {
-		fmt.Fprintf(os.Stdout, "Client %d id: %s, name: %s\n", i+1, *client.ClientId, client.GetClientName())
-		// Add any additional information you want to display about the client
-	}
+	return clients
 }
 
 func (o *OryClient) PatchClient(id string, clientSecret string, op types.Operation, path string, value interface{}) error {
@@ -100,7 +101,10 @@ func (o *OryClient) PatchClient(id string, clientSecret string, op types.Operati
 	jsonPatch[0].SetValue(value)
 
 	// verify the client secret
-	client := o.GetClient(id)
+	client, err := o.GetClient(id)
+	if err != nil {
+		return err
+	}
 	jwksMap := client.GetJwks()
 	jwksBytes, err := json.Marshal(jwksMap)
 	if err != nil {
@@ -113,26 +117,33 @@ func (o *OryClient) PatchClient(id string, clientSecret string, op types.Operati
 		return err
 	}
 
-	trueClientSecret := jwks.Keys[0].N
-	if trueClientSecret != clientSecret {
-		log.Printf("Client secret does not match: %s, %s", trueClientSecret, clientSecret)
-		return fmt.Errorf("client secret does not match")
+	if len(jwks.Keys) == 0 || jwks.Keys[0].N != clientSecret {
+		log.Printf("Client secret does not match for client %s", id)
+		return ErrInvalidClientSecret
 	}
 
 	resp, r, err := o.ory.OAuth2API.PatchOAuth2Client(oryAuthedContext, id).JsonPatch(jsonPatch).Execute()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error when calling `AdminApi.UpdateOAuth2Client``: %v\n", err)
 		fmt.Fprintf(os.Stderr, "Full HTTP response: %v\n", r)
+		if r != nil && r.StatusCode == http.StatusBadRequest {
+			return fmt.Errorf("%w: %v", ErrUnsupportedPatch, err)
+		}
+		return err
 	}
 	fmt.Fprintf(os.Stdout, "Updated client with name %s\n", resp.GetClientName())
 	return nil
 }
 
-func (o *OryClient) GetClient(id string) *ory.OAuth2Client {
+func (o *OryClient) GetClient(id string) (*ory.OAuth2Client, error) {
 	resp, r, err := o.ory.OAuth2API.GetOAuth2Client(o.ctx, id).Execute()
 	if err != nil {
+		if r != nil && r.StatusCode == http.StatusNotFound {
+			return nil, ErrClientNotFound
+		}
 		fmt.Fprintf(os.Stderr, "Error when calling `OAuth2API.GetOAuth2Client``: %v\n", err)
 		fmt.Fprintf(os.Stderr, "Full HTTP response: %v\n", r)
+		return nil, err
 	}
-	return resp
+	return resp, nil
 }
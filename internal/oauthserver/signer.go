@@ -0,0 +1,102 @@
+package oauthserver
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+)
+
+// Signer signs the JWT access tokens of the built-in authorization server with RS256
+type Signer struct {
+	key *rsa.PrivateKey
+	kid string // RFC 7638 thumbprint of the public key
+}
+
+// LoadSigner reads a PEM encoded RSA private key, in PKCS #1 or PKCS #8 form. Without a file it generates
+// a key, which is fine for local development only.
+func LoadSigner(file string) (*Signer, error) {
+	if file == "" {
+		log.Printf("No OAUTH_SIGNING_KEY_FILE, signing access tokens with a generated key that is lost on restart")
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return newSigner(key), nil
+	}
+
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, errors.New("signing key file is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return newSigner(key), nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key must be an RSA key")
+	}
+	return newSigner(key), nil
+}
+
+func newSigner(key *rsa.PrivateKey) *Signer {
+	signer := &Signer{key: key}
+	jwk := signer.JWK()
+	// the thumbprint covers the required members only, in lexicographic order
+	thumbprint := sha256.Sum256([]byte(`{"e":"` + jwk.E + `","kty":"RSA","n":"` + jwk.N + `"}`))
+	signer.kid = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+	return signer
+}
+
+// JWK returns the public key for the JWKS endpoint
+func (s *Signer) JWK() JWK {
+	return JWK{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		Kid: s.kid,
+		N:   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+	}
+}
+
+// KeySet returns the public key as a key set tokens can be verified against
+func (s *Signer) KeySet() *KeySet {
+	return staticKeySet(map[string]crypto.PublicKey{s.kid: &s.key.PublicKey})
+}
+
+// Sign returns claims as a compact JWS, typed as an RFC 9068 access token
+func (s *Signer) Sign(claims *AccessTokenClaims) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": s.kid, "typ": "at+jwt"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
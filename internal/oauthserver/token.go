@@ -0,0 +1,274 @@
+package oauthserver
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"lorallabs.com/oauth-server/internal/store"
+	schema "lorallabs.com/oauth-server/pkg/db"
+)
+
+// tokenError is an RFC 6749 error response of the token endpoint
+type tokenError struct {
+	status      int
+	code        string
+	description string
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"` // seconds
+	Scope        string `json:"scope"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// RegisterAuthorizationHandlers serves the built-in authorization server
+func (l *LocalIdentityProvider) RegisterAuthorizationHandlers(handler *mux.Router) {
+	handler.HandleFunc("/oauth2/auth", l.AuthorizeHandler).Methods("GET", "POST")
+	handler.HandleFunc("/oauth2/token", l.TokenHandler).Methods("POST")
+	handler.HandleFunc("/.well-known/oauth-authorization-server", l.MetadataHandler).Methods("GET")
+	handler.HandleFunc("/.well-known/jwks.json", l.JWKSHandler).Methods("GET")
+}
+
+// TokenHandler is the token endpoint, for the authorization_code, refresh_token and client_credentials grants
+func (l *LocalIdentityProvider) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	if err := r.ParseForm(); err != nil {
+		writeTokenError(w, &tokenError{http.StatusBadRequest, "invalid_request", "The request body could not be read"})
+		return
+	}
+	client, tokenErr := l.authenticateClient(r)
+	if tokenErr != nil {
+		writeTokenError(w, tokenErr)
+		return
+	}
+
+	var response *tokenResponse
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		response, tokenErr = l.exchangeCode(r.PostForm, client)
+	case "refresh_token":
+		response, tokenErr = l.exchangeRefreshToken(r.PostForm, client)
+	case "client_credentials":
+		response, tokenErr = l.clientCredentials(r.PostForm, client)
+	default:
+		tokenErr = &tokenError{http.StatusBadRequest, "unsupported_grant_type", "Supported grants are authorization_code, refresh_token and client_credentials"}
+	}
+	if tokenErr != nil {
+		writeTokenError(w, tokenErr)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// authenticateClient checks the client's credentials, sent with HTTP Basic authentication or in the form
+func (l *LocalIdentityProvider) authenticateClient(r *http.Request) (*schema.Client, *tokenError) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 form encodes the credentials before they are base64 encoded
+		var errID, errSecret error
+		id, errID = url.QueryUnescape(id)
+		secret, errSecret = url.QueryUnescape(secret)
+		if errID != nil || errSecret != nil {
+			return nil, &tokenError{http.StatusUnauthorized, "invalid_client", "Malformed client credentials"}
+		}
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	client, err := l.getClient(id)
+	if err != nil || subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(client.SecretHash)) != 1 {
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Failed to get client: %v", err)
+			return nil, &tokenError{http.StatusInternalServerError, "server_error", "Failed to authenticate the client"}
+		}
+		return nil, &tokenError{http.StatusUnauthorized, "invalid_client", "Unknown client or wrong secret"}
+	}
+	return client, nil
+}
+
+func (l *LocalIdentityProvider) exchangeCode(form url.Values, client *schema.Client) (*tokenResponse, *tokenError) {
+	code, err := l.store.ConsumeAuthorizationCode(hashSecret(form.Get("code")), client.ID)
+	if errors.Is(err, store.ErrAuthorizationCodeNotFound) {
+		return nil, &tokenError{http.StatusBadRequest, "invalid_grant", "The code is invalid, expired or already used"}
+	}
+	if err != nil {
+		log.Printf("Failed to consume authorization code: %v", err)
+		return nil, &tokenError{http.StatusInternalServerError, "server_error", "Failed to exchange the code"}
+	}
+	// RFC 6749 4.1.3, redirect_uri is required if the authorization request had one
+	if redirectURI := form.Get("redirect_uri"); (redirectURI != "" || code.RedirectURISent) && redirectURI != code.RedirectURI {
+		return nil, &tokenError{http.StatusBadRequest, "invalid_grant", "redirect_uri does not match the authorization request"}
+	}
+	if !verifyCodeChallenge(code.CodeChallenge, code.CodeChallengeMethod, form.Get("code_verifier")) {
+		return nil, &tokenError{http.StatusBadRequest, "invalid_grant", "code_verifier does not match the code_challenge"}
+	}
+	scopes := strings.Fields(code.Scope)
+	return l.issueTokens(client, code.UserID.String(), scopes, scopes)
+}
+
+func (l *LocalIdentityProvider) exchangeRefreshToken(form url.Values, client *schema.Client) (*tokenResponse, *tokenError) {
+	refresh, err := l.store.ConsumeRefreshToken(hashSecret(form.Get("refresh_token")), client.ID)
+	if errors.Is(err, store.ErrRefreshTokenNotFound) {
+		return nil, &tokenError{http.StatusBadRequest, "invalid_grant", "The refresh token is invalid, expired or already used"}
+	}
+	if err != nil {
+		log.Printf("Failed to consume refresh token: %v", err)
+		return nil, &tokenError{http.StatusInternalServerError, "server_error", "Failed to refresh the token"}
+	}
+
+	// the grant keeps its scopes, less any the client has since lost, and a request may narrow them down
+	// for the access token only
+	var granted []string
+	for _, scope := range strings.Fields(refresh.Scope) {
+		if containsString(strings.Fields(client.Scope), scope) {
+			granted = append(granted, scope)
+		}
+	}
+	scopes := granted
+	if requested := strings.Fields(form.Get("scope")); len(requested) > 0 {
+		for _, scope := range requested {
+			if !containsString(granted, scope) {
+				return nil, &tokenError{http.StatusBadRequest, "invalid_scope", "The scope " + scope + " was not granted"}
+			}
+		}
+		scopes = requested
+	}
+	return l.issueTokens(client, refresh.UserID.String(), scopes, granted)
+}
+
+// clientCredentials issues a token for the client itself, its subject is the client ID and it never
+// carries openid or offline_access. Endpoints that act for a user refuse it, see IsClientToken.
+func (l *LocalIdentityProvider) clientCredentials(form url.Values, client *schema.Client) (*tokenResponse, *tokenError) {
+	var granted []string
+	for _, scope := range strings.Fields(client.Scope) {
+		if scope != "openid" && scope != "offline_access" {
+			granted = append(granted, scope)
+		}
+	}
+	scopes := granted
+	if requested := strings.Fields(form.Get("scope")); len(requested) > 0 {
+		for _, scope := range requested {
+			if !containsString(granted, scope) {
+				return nil, &tokenError{http.StatusBadRequest, "invalid_scope", "The client may not request the scope " + scope}
+			}
+		}
+		scopes = requested
+	}
+	return l.issueTokens(client, client.ID.String(), scopes, nil)
+}
+
+// issueTokens signs an access token for scopes and, if the grant's scopes include offline_access, stores a
+// refresh token for the grant
+func (l *LocalIdentityProvider) issueTokens(client *schema.Client, subject string, scopes []string, grant []string) (*tokenResponse, *tokenError) {
+	now := time.Now()
+	claims := &AccessTokenClaims{
+		Issuer:    l.issuer,
+		Subject:   subject,
+		ExpiresAt: now.Add(l.accessTokenTTL).Unix(),
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        uuid.NewString(),
+		ClientID:  client.ID.String(),
+		Scp:       scopes,
+	}
+	if l.audience != "" {
+		claims.Audience = audience{l.audience}
+	}
+	accessToken, err := l.signer.Sign(claims)
+	if err != nil {
+		log.Printf("Failed to sign access token: %v", err)
+		return nil, &tokenError{http.StatusInternalServerError, "server_error", "Failed to issue a token"}
+	}
+	response := &tokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(l.accessTokenTTL / time.Second),
+		Scope:       strings.Join(scopes, " "),
+	}
+
+	if !containsString(grant, "offline_access") {
+		return response, nil
+	}
+	refreshToken, err := randomSecret()
+	if err == nil {
+		userID, _ := uuid.Parse(subject)
+		err = l.store.CreateRefreshToken(&schema.RefreshToken{
+			Token:     hashSecret(refreshToken),
+			ClientID:  client.ID,
+			UserID:    userID,
+			Scope:     strings.Join(grant, " "),
+			ExpiresAt: now.Add(l.refreshTokenTTL).Unix(),
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to save refresh token: %v", err)
+		return nil, &tokenError{http.StatusInternalServerError, "server_error", "Failed to issue a token"}
+	}
+	response.RefreshToken = refreshToken
+	return response, nil
+}
+
+// verifyCodeChallenge checks the PKCE verifier against the challenge of the authorization request
+func verifyCodeChallenge(challenge string, method string, verifier string) bool {
+	if challenge == "" {
+		return verifier == ""
+	}
+	if method == "S256" {
+		sum := sha256.Sum256([]byte(verifier))
+		verifier = base64.RawURLEncoding.EncodeToString(sum[:])
+	}
+	return subtle.ConstantTimeCompare([]byte(verifier), []byte(challenge)) == 1
+}
+
+// MetadataHandler serves the RFC 8414 authorization server metadata
+func (l *LocalIdentityProvider) MetadataHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                         l.issuer,
+		"authorization_endpoint":                         l.issuer + "/oauth2/auth",
+		"token_endpoint":                                 l.issuer + "/oauth2/token",
+		"jwks_uri":                                       l.issuer + "/.well-known/jwks.json",
+		"scopes_supported":                               l.scopes,
+		"response_types_supported":                       []string{"code"},
+		"grant_types_supported":                          []string{"authorization_code", "refresh_token", "client_credentials"},
+		"token_endpoint_auth_methods_supported":          []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":               []string{"S256", "plain"},
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+// JWKSHandler serves the public key access tokens are signed with
+func (l *LocalIdentityProvider) JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, JWKS{Keys: []JWK{l.signer.JWK()}})
+}
+
+func writeTokenError(w http.ResponseWriter, tokenErr *tokenError) {
+	if tokenErr.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="loral"`)
+	}
+	writeJSON(w, tokenErr.status, map[string]string{"error": tokenErr.code, "error_description": tokenErr.description})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
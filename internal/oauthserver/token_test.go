@@ -0,0 +1,417 @@
+package oauthserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"lorallabs.com/oauth-server/internal/store"
+	schema "lorallabs.com/oauth-server/pkg/db"
+)
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	s256 := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name      string
+		challenge string
+		method    string
+		verifier  string
+		want      bool
+	}{
+		{"S256", s256, "S256", verifier, true},
+		{"S256 wrong verifier", s256, "S256", verifier + "x", false},
+		{"S256 challenge sent as verifier", s256, "S256", s256, false},
+		{"S256 no verifier", s256, "S256", "", false},
+		{"plain", verifier, "plain", verifier, true},
+		{"plain wrong verifier", verifier, "plain", "other", false},
+		{"no method means plain", verifier, "", verifier, true},
+		{"no challenge", "", "", "", true},
+		{"verifier without challenge", "", "", verifier, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := verifyCodeChallenge(test.challenge, test.method, test.verifier); got != test.want {
+				t.Errorf("verifyCodeChallenge() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// memoryStore keeps the clients, codes and refresh tokens of the token endpoint in memory, consuming
+// them the way store.Store does. The other methods are not used by the tests.
+type memoryStore struct {
+	localStore
+
+	mu      sync.Mutex
+	clients map[uuid.UUID]schema.Client
+	codes   map[string]schema.AuthorizationCode
+	refresh map[string]schema.RefreshToken
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		clients: make(map[uuid.UUID]schema.Client),
+		codes:   make(map[string]schema.AuthorizationCode),
+		refresh: make(map[string]schema.RefreshToken),
+	}
+}
+
+func (m *memoryStore) GetClient(id uuid.UUID) (*schema.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	client, ok := m.clients[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &client, nil
+}
+
+func (m *memoryStore) UpdateClient(client *schema.Client) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.clients[client.ID]; !ok {
+		return gorm.ErrRecordNotFound
+	}
+	m.clients[client.ID] = *client
+	return nil
+}
+
+func (m *memoryStore) CreateAuthorizationCode(code *schema.AuthorizationCode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.codes[code.Code] = *code
+	return nil
+}
+
+func (m *memoryStore) ConsumeAuthorizationCode(codeHash string, clientID uuid.UUID) (*schema.AuthorizationCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code, ok := m.codes[codeHash]
+	if !ok || code.ClientID != clientID {
+		return nil, store.ErrAuthorizationCodeNotFound
+	}
+	delete(m.codes, codeHash)
+	if code.ExpiresAt < time.Now().Unix() {
+		return nil, store.ErrAuthorizationCodeNotFound
+	}
+	return &code, nil
+}
+
+func (m *memoryStore) CreateRefreshToken(token *schema.RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refresh[token.Token] = *token
+	return nil
+}
+
+func (m *memoryStore) ConsumeRefreshToken(tokenHash string, clientID uuid.UUID) (*schema.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, ok := m.refresh[tokenHash]
+	if !ok || token.ClientID != clientID {
+		return nil, store.ErrRefreshTokenNotFound
+	}
+	delete(m.refresh, tokenHash)
+	if token.ExpiresAt < time.Now().Unix() {
+		return nil, store.ErrRefreshTokenNotFound
+	}
+	return &token, nil
+}
+
+type tokenTest struct {
+	t        *testing.T
+	provider *LocalIdentityProvider
+	store    *memoryStore
+	client   schema.Client // the client the code was issued to
+	other    schema.Client
+	user     uuid.UUID
+}
+
+const testClientSecret = "secret"
+
+func newTokenTest(t *testing.T) *tokenTest {
+	memory := newMemoryStore()
+	signer := newSigner(testRSAKey(t))
+	test := &tokenTest{
+		t: t,
+		provider: &LocalIdentityProvider{
+			store:           memory,
+			signer:          signer,
+			keys:            signer.KeySet(),
+			issuer:          testIssuer,
+			audience:        testAudience,
+			scopes:          []string{"openid", "offline_access", "github", "google"},
+			accessTokenTTL:  time.Hour,
+			refreshTokenTTL: 24 * time.Hour,
+		},
+		store: memory,
+		user:  uuid.New(),
+	}
+	for _, client := range []*schema.Client{&test.client, &test.other} {
+		*client = schema.Client{
+			ID:           uuid.New(),
+			SecretHash:   hashSecret(testClientSecret),
+			Scope:        "openid offline_access github google",
+			RedirectURIs: []string{"https://app.example.com/callback"},
+		}
+		memory.clients[client.ID] = *client
+	}
+	return test
+}
+
+// issueCode stores a code for the user and client, as the authorization endpoint would
+func (tt *tokenTest) issueCode(code schema.AuthorizationCode) string {
+	tt.t.Helper()
+	secret, err := randomSecret()
+	if err != nil {
+		tt.t.Fatal(err)
+	}
+	code.Code = hashSecret(secret)
+	code.ClientID = tt.client.ID
+	code.UserID = tt.user
+	if code.ExpiresAt == 0 {
+		code.ExpiresAt = time.Now().Add(time.Minute).Unix()
+	}
+	if err := tt.store.CreateAuthorizationCode(&code); err != nil {
+		tt.t.Fatal(err)
+	}
+	return secret
+}
+
+// token posts form to the token endpoint as client and decodes the response
+func (tt *tokenTest) token(client schema.Client, form url.Values) (int, *tokenResponse, string) {
+	tt.t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/oauth2/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(client.ID.String(), testClientSecret)
+	rec := httptest.NewRecorder()
+	tt.provider.TokenHandler(rec, req)
+
+	if rec.Code != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			tt.t.Fatalf("token endpoint responded %d %s", rec.Code, rec.Body)
+		}
+		return rec.Code, nil, body.Error
+	}
+	var response tokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		tt.t.Fatal(err)
+	}
+	return rec.Code, &response, ""
+}
+
+func (tt *tokenTest) expectError(client schema.Client, form url.Values, code string) {
+	tt.t.Helper()
+	status, _, got := tt.token(client, form)
+	if status != http.StatusBadRequest || got != code {
+		tt.t.Errorf("token endpoint responded %d %q, want 400 %q", status, got, code)
+	}
+}
+
+func (tt *tokenTest) expectTokens(client schema.Client, form url.Values) *tokenResponse {
+	tt.t.Helper()
+	status, response, code := tt.token(client, form)
+	if status != http.StatusOK {
+		tt.t.Fatalf("token endpoint responded %d %q", status, code)
+	}
+	return response
+}
+
+func codeForm(code string, redirectURI string) url.Values {
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}}
+	if redirectURI != "" {
+		form.Set("redirect_uri", redirectURI)
+	}
+	return form
+}
+
+func refreshForm(refreshToken string) url.Values {
+	return url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}}
+}
+
+func TestAuthorizationCodeSingleUse(t *testing.T) {
+	tt := newTokenTest(t)
+	code := tt.issueCode(schema.AuthorizationCode{Scope: "openid github"})
+
+	response := tt.expectTokens(tt.client, codeForm(code, ""))
+	if response.Scope != "openid github" || response.RefreshToken != "" {
+		t.Errorf("exchange responded scope %q and refresh token %q", response.Scope, response.RefreshToken)
+	}
+	introspected := tt.provider.IntrospectToken(response.AccessToken, "github")
+	if !introspected.Active || introspected.GetSub() != tt.user.String() || IsClientToken(introspected) {
+		t.Errorf("access token introspected as %+v", introspected)
+	}
+
+	tt.expectError(tt.client, codeForm(code, ""), "invalid_grant")
+}
+
+func TestAuthorizationCodeOtherClient(t *testing.T) {
+	tt := newTokenTest(t)
+	code := tt.issueCode(schema.AuthorizationCode{Scope: "github"})
+
+	tt.expectError(tt.other, codeForm(code, ""), "invalid_grant")
+	// another client's attempt does not use the code up
+	tt.expectTokens(tt.client, codeForm(code, ""))
+}
+
+func TestAuthorizationCodeExpired(t *testing.T) {
+	tt := newTokenTest(t)
+	code := tt.issueCode(schema.AuthorizationCode{Scope: "github", ExpiresAt: time.Now().Add(-time.Second).Unix()})
+
+	tt.expectError(tt.client, codeForm(code, ""), "invalid_grant")
+}
+
+func TestAuthorizationCodeRedirectURI(t *testing.T) {
+	redirectURI := "https://app.example.com/callback"
+	tests := []struct {
+		name     string
+		code     schema.AuthorizationCode
+		redirect string
+		ok       bool
+	}{
+		{"sent and repeated", schema.AuthorizationCode{RedirectURI: redirectURI, RedirectURISent: true}, redirectURI, true},
+		{"sent and left out", schema.AuthorizationCode{RedirectURI: redirectURI, RedirectURISent: true}, "", false},
+		{"sent and changed", schema.AuthorizationCode{RedirectURI: redirectURI, RedirectURISent: true}, "https://evil.example.com/", false},
+		{"defaulted and left out", schema.AuthorizationCode{RedirectURI: redirectURI}, "", true},
+		{"defaulted and repeated", schema.AuthorizationCode{RedirectURI: redirectURI}, redirectURI, true},
+		{"defaulted and changed", schema.AuthorizationCode{RedirectURI: redirectURI}, "https://evil.example.com/", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tt := newTokenTest(t)
+			test.code.Scope = "github"
+			code := tt.issueCode(test.code)
+			if test.ok {
+				tt.expectTokens(tt.client, codeForm(code, test.redirect))
+			} else {
+				tt.expectError(tt.client, codeForm(code, test.redirect), "invalid_grant")
+			}
+		})
+	}
+}
+
+func TestAuthorizationCodePKCE(t *testing.T) {
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := schema.AuthorizationCode{
+		Scope:               "github",
+		CodeChallenge:       base64.RawURLEncoding.EncodeToString(sum[:]),
+		CodeChallengeMethod: "S256",
+	}
+
+	tt := newTokenTest(t)
+	code := tt.issueCode(challenge)
+	form := codeForm(code, "")
+	form.Set("code_verifier", "wrong")
+	tt.expectError(tt.client, form, "invalid_grant")
+	// the failed attempt used the code up, so a stolen code cannot be retried with guesses
+	form.Set("code_verifier", verifier)
+	tt.expectError(tt.client, form, "invalid_grant")
+
+	code = tt.issueCode(challenge)
+	form = codeForm(code, "")
+	form.Set("code_verifier", verifier)
+	tt.expectTokens(tt.client, form)
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	tt := newTokenTest(t)
+	code := tt.issueCode(schema.AuthorizationCode{Scope: "openid offline_access github google"})
+	first := tt.expectTokens(tt.client, codeForm(code, ""))
+	if first.RefreshToken == "" {
+		t.Fatalf("exchange with offline_access issued no refresh token")
+	}
+
+	// narrowing the scope applies to the access token only, the grant keeps its scopes
+	form := refreshForm(first.RefreshToken)
+	form.Set("scope", "github")
+	second := tt.expectTokens(tt.client, form)
+	if second.Scope != "github" || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh responded scope %q and refresh token %q", second.Scope, second.RefreshToken)
+	}
+	if introspected := tt.provider.IntrospectToken(second.AccessToken, "google"); introspected.Active {
+		t.Errorf("narrowed access token is active for a scope it was not given")
+	}
+
+	// the replaced token is used up
+	tt.expectError(tt.client, refreshForm(first.RefreshToken), "invalid_grant")
+
+	third := tt.expectTokens(tt.client, refreshForm(second.RefreshToken))
+	if third.Scope != "openid offline_access github google" {
+		t.Errorf("refresh after narrowing responded scope %q, want the whole grant", third.Scope)
+	}
+
+	form = refreshForm(third.RefreshToken)
+	form.Set("scope", "github admin")
+	tt.expectError(tt.client, form, "invalid_scope")
+}
+
+func TestRefreshTokenOtherClient(t *testing.T) {
+	tt := newTokenTest(t)
+	code := tt.issueCode(schema.AuthorizationCode{Scope: "offline_access github"})
+	response := tt.expectTokens(tt.client, codeForm(code, ""))
+
+	tt.expectError(tt.other, refreshForm(response.RefreshToken), "invalid_grant")
+	// another client's attempt does not use the token up
+	tt.expectTokens(tt.client, refreshForm(response.RefreshToken))
+}
+
+func TestRefreshTokenLostScope(t *testing.T) {
+	tt := newTokenTest(t)
+	code := tt.issueCode(schema.AuthorizationCode{Scope: "offline_access github google"})
+	response := tt.expectTokens(tt.client, codeForm(code, ""))
+
+	client := tt.store.clients[tt.client.ID]
+	client.Scope = "offline_access github"
+	tt.store.clients[tt.client.ID] = client
+
+	refreshed := tt.expectTokens(tt.client, refreshForm(response.RefreshToken))
+	if refreshed.Scope != "offline_access github" {
+		t.Errorf("refresh responded scope %q, want the scopes the client still has", refreshed.Scope)
+	}
+}
+
+func TestClientCredentials(t *testing.T) {
+	tt := newTokenTest(t)
+	response := tt.expectTokens(tt.client, url.Values{"grant_type": {"client_credentials"}})
+	if response.Scope != "github google" || response.RefreshToken != "" {
+		t.Errorf("client_credentials responded scope %q and refresh token %q", response.Scope, response.RefreshToken)
+	}
+	introspected, ok := introspectJWT(context.Background(), tt.provider.keys, testIssuer, testAudience, response.AccessToken, "")
+	if !ok || !introspected.Active || !IsClientToken(introspected) {
+		t.Errorf("client_credentials token introspected as %+v", introspected)
+	}
+
+	tt.expectError(tt.client, url.Values{"grant_type": {"client_credentials"}, "scope": {"offline_access"}}, "invalid_scope")
+}
+
+func TestTokenWrongSecret(t *testing.T) {
+	tt := newTokenTest(t)
+	code := tt.issueCode(schema.AuthorizationCode{Scope: "github"})
+
+	req := httptest.NewRequest(http.MethodPost, "/oauth2/token", strings.NewReader(codeForm(code, "").Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(tt.client.ID.String(), "wrong")
+	rec := httptest.NewRecorder()
+	tt.provider.TokenHandler(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("token endpoint responded %d to a wrong secret, want 401", rec.Code)
+	}
+	tt.expectTokens(tt.client, codeForm(code, ""))
+}
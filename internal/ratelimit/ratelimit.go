@@ -0,0 +1,178 @@
+package ratelimit
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"lorallabs.com/oauth-server/internal/config"
+	"lorallabs.com/oauth-server/internal/store"
+)
+
+// pruneInterval is how often idle buckets are dropped
+const pruneInterval = 10 * time.Minute
+
+// Limit is a token bucket holding up to Burst tokens, refilled at Rate tokens per second
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// NewLimit converts a configured limit, which must be enabled
+func NewLimit(c config.RateLimit) Limit {
+	burst := c.Burst
+	if burst == 0 {
+		burst = c.Requests
+	}
+	return Limit{Rate: float64(c.Requests) / c.Per.Seconds(), Burst: burst}
+}
+
+// fillTime is how long an empty bucket takes to fill up
+func (l Limit) fillTime() time.Duration {
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+// Result describes the bucket after a request was counted against it
+type Result struct {
+	Allowed    bool
+	Limit      int           // bucket size
+	Remaining  int           // requests allowed right now
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next request is allowed, when denied
+}
+
+func newResult(limit Limit, tokens float64, allowed bool) Result {
+	result := Result{
+		Allowed:   allowed,
+		Limit:     limit.Burst,
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+		Reset:     time.Duration((float64(limit.Burst) - tokens) / limit.Rate * float64(time.Second)),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	}
+	return result
+}
+
+// Limiter counts requests against named token buckets
+type Limiter interface {
+	Allow(key string, limit Limit) (Result, error)
+	// Refund returns the token an allowed request took, for a request another bucket then denied
+	Refund(key string, limit Limit) error
+}
+
+// New returns the limiter for the configured backend
+func New(backend string, store *store.Store) Limiter {
+	if backend == "postgres" {
+		return NewPostgresLimiter(store)
+	}
+	return NewMemoryLimiter()
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// MemoryLimiter keeps buckets in process, so each replica enforces its own limits
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	maxFill   time.Duration
+	lastPrune time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{buckets: make(map[string]*bucket), lastPrune: time.Now()}
+}
+
+func (m *MemoryLimiter) Allow(key string, limit Limit) (Result, error) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if fill := limit.fillTime(); fill > m.maxFill {
+		m.maxFill = fill
+	}
+	if now.Sub(m.lastPrune) > pruneInterval {
+		m.prune(now)
+	}
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		m.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+	b.updated = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return newResult(limit, b.tokens, allowed), nil
+}
+
+func (m *MemoryLimiter) Refund(key string, limit Limit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b, ok := m.buckets[key]; ok {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+1)
+	}
+	return nil
+}
+
+// prune drops buckets idle long enough to have filled up, which behave the same as missing ones
+func (m *MemoryLimiter) prune(now time.Time) {
+	for key, b := range m.buckets {
+		if now.Sub(b.updated) > m.maxFill {
+			delete(m.buckets, key)
+		}
+	}
+	m.lastPrune = now
+}
+
+// PostgresLimiter keeps buckets in the rate_limit_buckets table, so limits hold across replicas
+type PostgresLimiter struct {
+	Store *store.Store
+
+	mu        sync.Mutex
+	maxFill   time.Duration
+	lastPrune time.Time
+}
+
+func NewPostgresLimiter(store *store.Store) *PostgresLimiter {
+	return &PostgresLimiter{Store: store, lastPrune: time.Now()}
+}
+
+func (p *PostgresLimiter) Allow(key string, limit Limit) (Result, error) {
+	tokens, allowed, err := p.Store.TakeRateLimitToken(key, limit.Rate, limit.Burst)
+	if err != nil {
+		return Result{}, err
+	}
+
+	p.mu.Lock()
+	if fill := limit.fillTime(); fill > p.maxFill {
+		p.maxFill = fill
+	}
+	prune := time.Since(p.lastPrune) > pruneInterval
+	if prune {
+		p.lastPrune = time.Now()
+	}
+	maxFill := p.maxFill
+	p.mu.Unlock()
+
+	if prune {
+		go func() {
+			if err := p.Store.DeleteIdleRateLimitBuckets(time.Now().Add(-maxFill)); err != nil {
+				log.Printf("Error deleting idle rate limit buckets: %v", err)
+			}
+		}()
+	}
+	return newResult(limit, tokens, allowed), nil
+}
+
+func (p *PostgresLimiter) Refund(key string, limit Limit) error {
+	return p.Store.ReturnRateLimitToken(key, limit.Burst)
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"lorallabs.com/oauth-server/internal/config"
+)
+
+func TestNewLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		in   config.RateLimit
+		want Limit
+	}{
+		{"burst defaults to requests", config.RateLimit{Requests: 60, Per: time.Minute}, Limit{Rate: 1, Burst: 60}},
+		{"explicit burst", config.RateLimit{Requests: 10, Per: time.Second, Burst: 20}, Limit{Rate: 10, Burst: 20}},
+		{"hourly", config.RateLimit{Requests: 5000, Per: time.Hour}, Limit{Rate: 5000.0 / 3600, Burst: 5000}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := NewLimit(test.in); got != test.want {
+				t.Errorf("NewLimit() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMemoryLimiter(t *testing.T) {
+	limit := Limit{Rate: 1, Burst: 2} // one request a second, two at once
+
+	tests := []struct {
+		name  string
+		steps []string // allow, deny (expect a denied allow), refund or wait (a second passes)
+	}{
+		{"burst then deny", []string{"allow", "allow", "deny", "deny"}},
+		{"refills over time", []string{"allow", "allow", "deny", "wait", "allow", "deny"}},
+		{"never above the burst", []string{"wait", "wait", "wait", "allow", "allow", "deny"}},
+		{"refund", []string{"allow", "allow", "refund", "allow", "deny"}},
+		{"refund never above the burst", []string{"refund", "refund", "allow", "allow", "deny"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := NewMemoryLimiter()
+			for i, step := range test.steps {
+				switch step {
+				case "allow", "deny":
+					result, err := limiter.Allow("key", limit)
+					if err != nil {
+						t.Fatalf("step %d: Allow() error = %v", i, err)
+					}
+					if result.Allowed != (step == "allow") {
+						t.Fatalf("step %d: Allow() = %+v, want allowed %v", i, result, step == "allow")
+					}
+					if !result.Allowed && (result.RetryAfter <= 0 || result.RetryAfter > time.Second) {
+						t.Errorf("step %d: RetryAfter = %v, want up to a second", i, result.RetryAfter)
+					}
+				case "refund":
+					if err := limiter.Refund("key", limit); err != nil {
+						t.Fatalf("step %d: Refund() error = %v", i, err)
+					}
+				case "wait":
+					limiter.mu.Lock()
+					for _, b := range limiter.buckets {
+						b.updated = b.updated.Add(-time.Second)
+					}
+					limiter.mu.Unlock()
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryLimiterResult(t *testing.T) {
+	limiter := NewMemoryLimiter()
+	limit := Limit{Rate: 0.5, Burst: 3}
+
+	first, _ := limiter.Allow("a", limit)
+	if first.Limit != 3 || first.Remaining != 2 || first.Reset <= time.Second || first.Reset > 2*time.Second {
+		t.Errorf("Allow() = %+v, want 2 of 3 remaining and a 2s reset", first)
+	}
+	if other, _ := limiter.Allow("b", limit); other.Remaining != 2 {
+		t.Errorf("Allow() of another key = %+v, want its own bucket", other)
+	}
+}
+
+func TestMemoryLimiterPrune(t *testing.T) {
+	limiter := NewMemoryLimiter()
+	limit := Limit{Rate: 1, Burst: 2}
+	limiter.Allow("idle", limit)
+	limiter.Allow("busy", limit)
+
+	limiter.mu.Lock()
+	limiter.buckets["idle"].updated = time.Now().Add(-time.Hour)
+	limiter.lastPrune = time.Now().Add(-2 * pruneInterval)
+	limiter.mu.Unlock()
+
+	limiter.Allow("busy", limit)
+	if _, ok := limiter.buckets["idle"]; ok {
+		t.Errorf("prune kept a bucket idle long enough to be full")
+	}
+	if _, ok := limiter.buckets["busy"]; !ok {
+		t.Errorf("prune dropped a bucket in use")
+	}
+}
@@ -0,0 +1,61 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm/clause"
+	schema "lorallabs.com/oauth-server/pkg/db"
+)
+
+var (
+	ErrAuthorizationCodeNotFound = errors.New("authorization code not found, expired or already used")
+	ErrRefreshTokenNotFound      = errors.New("refresh token not found, expired or already used")
+)
+
+// CreateAuthorizationCode persists a code and clears out expired ones
+func (s *Store) CreateAuthorizationCode(code *schema.AuthorizationCode) error {
+	err := s.DB.Where("expires_at < ?", time.Now().Unix()).Delete(&schema.AuthorizationCode{}).Error
+	if err != nil {
+		return err
+	}
+	return s.DB.Create(code).Error
+}
+
+// ConsumeAuthorizationCode atomically deletes and returns the unexpired code with the hash issued to
+// clientID, so a code can only ever be exchanged once and only by its client
+func (s *Store) ConsumeAuthorizationCode(codeHash string, clientID uuid.UUID) (*schema.AuthorizationCode, error) {
+	var codes []schema.AuthorizationCode
+	result := s.DB.Clauses(clause.Returning{}).Where("code = ? AND client_id = ?", codeHash, clientID).Delete(&codes)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 || len(codes) == 0 || codes[0].ExpiresAt < time.Now().Unix() {
+		return nil, ErrAuthorizationCodeNotFound
+	}
+	return &codes[0], nil
+}
+
+// CreateRefreshToken persists a refresh token and clears out expired ones
+func (s *Store) CreateRefreshToken(token *schema.RefreshToken) error {
+	err := s.DB.Where("expires_at < ?", time.Now().Unix()).Delete(&schema.RefreshToken{}).Error
+	if err != nil {
+		return err
+	}
+	return s.DB.Create(token).Error
+}
+
+// ConsumeRefreshToken atomically deletes and returns the unexpired refresh token with the hash issued
+// to clientID
+func (s *Store) ConsumeRefreshToken(tokenHash string, clientID uuid.UUID) (*schema.RefreshToken, error) {
+	var tokens []schema.RefreshToken
+	result := s.DB.Clauses(clause.Returning{}).Where("token = ? AND client_id = ?", tokenHash, clientID).Delete(&tokens)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 || len(tokens) == 0 || tokens[0].ExpiresAt < time.Now().Unix() {
+		return nil, ErrRefreshTokenNotFound
+	}
+	return &tokens[0], nil
+}
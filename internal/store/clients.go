@@ -0,0 +1,87 @@
+package store
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	schema "lorallabs.com/oauth-server/pkg/db"
+)
+
+// CreateClient registers a client with the local identity backend
+func (s *Store) CreateClient(client *schema.Client) error {
+	return s.DB.Create(client).Error
+}
+
+// GetClient returns the client with id, or gorm.ErrRecordNotFound
+func (s *Store) GetClient(id uuid.UUID) (*schema.Client, error) {
+	var client schema.Client
+	if err := s.DB.Where("id = ?", id).First(&client).Error; err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// ListClients returns every client, or the ones named name if it is not empty
+func (s *Store) ListClients(name string) ([]schema.Client, error) {
+	query := s.DB.Order("created_at")
+	if name != "" {
+		query = query.Where("name = ?", name)
+	}
+	var clients []schema.Client
+	err := query.Find(&clients).Error
+	return clients, err
+}
+
+// UpdateClient saves the name, scope and redirect URIs of client
+func (s *Store) UpdateClient(client *schema.Client) error {
+	return s.DB.Model(client).Select("name", "scope", "redirect_uris").Updates(client).Error
+}
+
+// CreateAPIKey stores a key whose Secret is already hashed
+func (s *Store) CreateAPIKey(key *schema.APIKey) error {
+	return s.DB.Create(key).Error
+}
+
+// GetAPIKey returns the unexpired key with the hashed secret, or gorm.ErrRecordNotFound
+func (s *Store) GetAPIKey(secretHash string) (*schema.APIKey, error) {
+	var key schema.APIKey
+	err := s.DB.Where("secret = ?", secretHash).
+		Where("expires_at IS NULL OR expires_at > ?", time.Now()).
+		First(&key).Error
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// GetOrCreateUser returns the user with email, creating it if there is none
+func (s *Store) GetOrCreateUser(email string) (*schema.User, error) {
+	user := schema.User{Username: email, Email: email}
+	err := s.DB.Where("email = ?", email).FirstOrCreate(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUserByEmail returns the user with email, or gorm.ErrRecordNotFound
+func (s *Store) GetUserByEmail(email string) (*schema.User, error) {
+	var user schema.User
+	if err := s.DB.Where("email = ?", email).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// SetUserPassword sets the password hash of the user with email, creating the user if there is none
+func (s *Store) SetUserPassword(email string, passwordHash string) (*schema.User, error) {
+	user, err := s.GetOrCreateUser(email)
+	if err != nil {
+		return nil, err
+	}
+	user.Password = passwordHash
+	if err := s.DB.Model(user).Update("password", passwordHash).Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"gorm.io/gorm"
+	schema "lorallabs.com/oauth-server/pkg/db"
+)
+
+// takeRateLimitToken refills the bucket for the time since its last update and takes a token if one
+// is left, in a single statement so concurrent replicas never both take the last token
+const takeRateLimitToken = `
+INSERT INTO rate_limit_buckets AS b (key, tokens, allowed, updated_at)
+VALUES (@key, @burst::float8 - 1, true, now())
+ON CONFLICT (key) DO UPDATE SET
+	allowed = LEAST(@burst::float8, b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at)::float8 * @rate::float8) >= 1,
+	tokens = LEAST(@burst::float8, b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at)::float8 * @rate::float8)
+		- CASE WHEN LEAST(@burst::float8, b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at)::float8 * @rate::float8) >= 1 THEN 1 ELSE 0 END,
+	updated_at = now()
+RETURNING tokens, allowed`
+
+// TakeRateLimitToken takes one token from the bucket at key, which holds up to burst tokens and
+// refills at rate tokens per second. It returns the tokens left and whether one was taken.
+func (s *Store) TakeRateLimitToken(key string, rate float64, burst int) (float64, bool, error) {
+	var bucket schema.RateLimitBucket
+	err := s.DB.Raw(takeRateLimitToken,
+		sql.Named("key", key),
+		sql.Named("burst", float64(burst)),
+		sql.Named("rate", rate),
+	).Scan(&bucket).Error
+	if err != nil {
+		return 0, false, err
+	}
+	return bucket.Tokens, bucket.Allowed, nil
+}
+
+// ReturnRateLimitToken puts back a token taken from the bucket at key, up to burst
+func (s *Store) ReturnRateLimitToken(key string, burst int) error {
+	return s.DB.Model(&schema.RateLimitBucket{}).
+		Where("key = ?", key).
+		Update("tokens", gorm.Expr("LEAST(?::float8, tokens + 1)", float64(burst))).Error
+}
+
+// DeleteIdleRateLimitBuckets removes buckets untouched since before, which would be full by now anyway
+func (s *Store) DeleteIdleRateLimitBuckets(before time.Time) error {
+	return s.DB.Where("updated_at < ?", before).Delete(&schema.RateLimitBucket{}).Error
+}
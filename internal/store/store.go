@@ -1,21 +1,27 @@
 package store
 
 import (
+	"errors"
 	"log"
+	"time"
 
 	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"lorallabs.com/oauth-server/internal/keyring"
 	schema "lorallabs.com/oauth-server/pkg/db"
 )
 
 // Store encapsulates DB operations
 type Store struct {
-	DB *gorm.DB
+	DB      *gorm.DB
+	Keyring *keyring.Keyring // encrypts provider tokens at rest
 }
 
-// NewStore creates a new instance of Store with a database connection
-func NewStore(connectionString string) (*Store, error) {
+// NewStore creates a new instance of Store with a database connection.
+// keyring may be nil for tools that never read or write provider tokens.
+func NewStore(connectionString string, keyring *keyring.Keyring) (*Store, error) {
 	db, err := gorm.Open(postgres.Open(connectionString), &gorm.Config{})
 	if err != nil {
 		return nil, err
@@ -27,6 +33,31 @@ func NewStore(connectionString string) (*Store, error) {
 		log.Fatalf("Failed to create UUID extension: %v", err)
 	}
 
+	// Rows that got the refresh columns as NULLs from an earlier migration need values before
+	// AutoMigrate can make them NOT NULL
+	if db.Migrator().HasColumn(&schema.ProviderToken{}, "NeedsReconsent") {
+		err = db.Exec(`UPDATE provider_tokens SET
+			needs_reconsent = COALESCE(needs_reconsent, false),
+			last_refresh_attempt = COALESCE(last_refresh_attempt, 0),
+			refresh_failures = COALESCE(refresh_failures, 0)
+			WHERE needs_reconsent IS NULL OR last_refresh_attempt IS NULL OR refresh_failures IS NULL`).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Concurrent callbacks could create several tokens for a user and provider before they got a unique
+	// index, keep the latest one of each so the index can be built
+	if db.Migrator().HasTable(&schema.ProviderToken{}) && !db.Migrator().HasIndex(&schema.ProviderToken{}, "idx_provider_tokens_user_provider") {
+		err = db.Exec(`DELETE FROM provider_tokens a USING provider_tokens b
+			WHERE a.user_id = b.user_id AND a.provider_id = b.provider_id
+			AND a.deleted_at IS NULL AND b.deleted_at IS NULL
+			AND (a.updated_at < b.updated_at OR (a.updated_at = b.updated_at AND a.id < b.id))`).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// AutoMigrate your schema here
 	err = db.AutoMigrate(
 		&schema.User{},
@@ -35,12 +66,16 @@ func NewStore(connectionString string) (*Store, error) {
 		&schema.APIKey{},
 		&schema.Client{},
 		&schema.ClientGrants{},
+		&schema.OAuthState{},
+		&schema.RateLimitBucket{},
+		&schema.AuthorizationCode{},
+		&schema.RefreshToken{},
 	)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Store{DB: db}, nil
+	return &Store{DB: db, Keyring: keyring}, nil
 }
 
 func (s *Store) CheckValidProviderToken(userId uuid.UUID, providerName string) (bool, error) {
@@ -49,6 +84,7 @@ func (s *Store) CheckValidProviderToken(userId uuid.UUID, providerName string) (
 	err := s.DB.Joins("JOIN providers ON providers.id = provider_tokens.provider_id").
 		Where("provider_tokens.user_id = ?", userId.String()).
 		Where("providers.name = ?", providerName).
+		Where("provider_tokens.needs_reconsent = ?", false).
 		First(&token).Error
 
 	if err != nil {
@@ -62,3 +98,28 @@ func (s *Store) CheckValidProviderToken(userId uuid.UUID, providerName string) (
 
 	return true, nil
 }
+
+var ErrStateNotFound = errors.New("oauth state not found or already used")
+
+// CreateOAuthState persists a pending authorization and clears out expired ones
+func (s *Store) CreateOAuthState(state *schema.OAuthState) error {
+	err := s.DB.Where("expires_at < ?", time.Now().Unix()).Delete(&schema.OAuthState{}).Error
+	if err != nil {
+		return err
+	}
+	return s.DB.Create(state).Error
+}
+
+// ConsumeOAuthState atomically deletes and returns the pending authorization for nonce,
+// so a state can only ever complete one callback
+func (s *Store) ConsumeOAuthState(nonce string) (*schema.OAuthState, error) {
+	var states []schema.OAuthState
+	result := s.DB.Clauses(clause.Returning{}).Where("nonce = ?", nonce).Delete(&states)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 || len(states) == 0 {
+		return nil, ErrStateNotFound
+	}
+	return &states[0], nil
+}
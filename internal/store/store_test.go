@@ -0,0 +1,136 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	schema "lorallabs.com/oauth-server/pkg/db"
+)
+
+// stateDB is a database/sql driver that answers the DELETE ... RETURNING sent by ConsumeOAuthState
+// from an in-memory o_auth_states table
+type stateDB struct {
+	mu     sync.Mutex
+	states map[string]schema.OAuthState
+}
+
+func (d *stateDB) Connect(context.Context) (driver.Conn, error) { return &stateConn{d}, nil }
+func (d *stateDB) Driver() driver.Driver                        { return nil }
+
+type stateConn struct{ db *stateDB }
+
+func (c *stateConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c *stateConn) Close() error                        { return nil }
+func (c *stateConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+
+func (c *stateConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.HasPrefix(query, `DELETE FROM "o_auth_states"`) || !strings.HasSuffix(query, "RETURNING *") || len(args) != 1 {
+		return nil, errors.New("unexpected query: " + query)
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	rows := &stateRows{}
+	if state, ok := c.db.states[args[0].Value.(string)]; ok {
+		delete(c.db.states, state.Nonce)
+		rows.values = append(rows.values, []driver.Value{state.Nonce, state.ProviderName, state.UserID.String(), state.ClientID,
+			state.ClientRedirectURI, state.CodeVerifier, state.ExpiresAt, state.CreatedAt})
+	}
+	return rows, nil
+}
+
+type stateRows struct{ values [][]driver.Value }
+
+func (r *stateRows) Columns() []string {
+	return []string{"nonce", "provider_name", "user_id", "client_id", "client_redirect_uri", "code_verifier", "expires_at", "created_at"}
+}
+func (r *stateRows) Close() error { return nil }
+func (r *stateRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func newStateStore(t *testing.T, states ...schema.OAuthState) *Store {
+	t.Helper()
+	fake := &stateDB{states: make(map[string]schema.OAuthState)}
+	for _, state := range states {
+		fake.states[state.Nonce] = state
+	}
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sql.OpenDB(fake)}), &gorm.Config{DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	if err != nil {
+		t.Fatalf("gorm.Open() error = %v", err)
+	}
+	return &Store{DB: db}
+}
+
+func TestConsumeOAuthState(t *testing.T) {
+	pending := schema.OAuthState{
+		Nonce:             "nonce",
+		ProviderName:      "github",
+		UserID:            uuid.New(),
+		ClientID:          "client",
+		ClientRedirectURI: "https://app.example.com/callback",
+		CodeVerifier:      "verifier",
+		ExpiresAt:         time.Now().Add(time.Minute).Unix(),
+		CreatedAt:         time.Now().UTC().Truncate(time.Second),
+	}
+	store := newStateStore(t, pending)
+
+	tests := []struct {
+		name    string
+		nonce   string
+		wantErr error
+	}{
+		{"first callback", "nonce", nil},
+		{"nonce reused", "nonce", ErrStateNotFound},
+		{"unknown nonce", "other", ErrStateNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := store.ConsumeOAuthState(test.nonce)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("ConsumeOAuthState() error = %v, want %v", err, test.wantErr)
+			}
+			if test.wantErr == nil && (got.Nonce != pending.Nonce || got.UserID != pending.UserID || got.CodeVerifier != pending.CodeVerifier ||
+				got.ClientRedirectURI != pending.ClientRedirectURI || !got.CreatedAt.Equal(pending.CreatedAt)) {
+				t.Errorf("ConsumeOAuthState() = %+v, want %+v", got, pending)
+			}
+		})
+	}
+}
+
+func TestConsumeOAuthStateConcurrently(t *testing.T) {
+	store := newStateStore(t, schema.OAuthState{Nonce: "nonce", UserID: uuid.New(), ExpiresAt: time.Now().Add(time.Minute).Unix()})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	consumed := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := store.ConsumeOAuthState("nonce"); err == nil {
+				mu.Lock()
+				consumed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if consumed != 1 {
+		t.Errorf("%d callbacks consumed the same nonce, want 1", consumed)
+	}
+}
@@ -0,0 +1,273 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"lorallabs.com/oauth-server/internal/keyring"
+	schema "lorallabs.com/oauth-server/pkg/db"
+)
+
+var ErrNoKeyring = errors.New("store has no token keyring configured")
+
+// SaveProviderToken encrypts token and creates or replaces the row for its user and provider in a single
+// upsert, so concurrent callbacks for the same connection leave one row. Replacing a token clears its
+// refresh failures. token itself is left in plaintext for the caller.
+func (s *Store) SaveProviderToken(token *schema.ProviderToken) error {
+	encrypted, err := s.encryptProviderToken(token)
+	if err != nil {
+		return err
+	}
+	encrypted.ID = uuid.Nil
+	err = s.DB.Clauses(clause.OnConflict{
+		Columns:     []clause.Column{{Name: "user_id"}, {Name: "provider_id"}},
+		TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "deleted_at IS NULL"}}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"access_token":         gorm.Expr("EXCLUDED.access_token"),
+			"refresh_token":        gorm.Expr("EXCLUDED.refresh_token"),
+			"key_id":               gorm.Expr("EXCLUDED.key_id"),
+			"wrapped_key":          gorm.Expr("EXCLUDED.wrapped_key"),
+			"expiry":               gorm.Expr("EXCLUDED.expiry"),
+			"scope":                gorm.Expr("EXCLUDED.scope"),
+			"token_type":           gorm.Expr("EXCLUDED.token_type"),
+			"needs_reconsent":      false,
+			"last_refresh_attempt": 0,
+			"last_refresh_error":   "",
+			"refresh_failures":     0,
+			"updated_at":           gorm.Expr("EXCLUDED.updated_at"),
+		}),
+	}).Create(encrypted).Error
+	if err != nil {
+		return err
+	}
+	token.ID = encrypted.ID
+	return nil
+}
+
+// GetProviderToken returns the decrypted token of userID for providerName, or gorm.ErrRecordNotFound
+func (s *Store) GetProviderToken(userID uuid.UUID, providerName string) (*schema.ProviderToken, error) {
+	var token schema.ProviderToken
+	err := s.DB.Joins("JOIN providers ON providers.id = provider_tokens.provider_id").
+		Where("provider_tokens.user_id = ?", userID).
+		Where("providers.name = ?", providerName).
+		First(&token).Error
+	if err != nil {
+		return nil, err
+	}
+	return s.decryptProviderToken(&token)
+}
+
+// ReencryptProviderTokens re-wraps every row that is not encrypted under the active key,
+// including legacy plaintext rows, and returns the number of rows rewritten. Each row is locked while it
+// is rewritten, so it is safe to run against a live deployment that refreshes tokens meanwhile.
+func (s *Store) ReencryptProviderTokens(batchSize int) (int, error) {
+	if s.Keyring == nil {
+		return 0, ErrNoKeyring
+	}
+
+	count := 0
+	for {
+		var ids []uuid.UUID
+		err := s.DB.Model(&schema.ProviderToken{}).
+			Where("key_id IS NULL OR key_id <> ?", s.Keyring.ActiveID()).
+			Limit(batchSize).
+			Pluck("id", &ids).Error
+		if err != nil {
+			return count, err
+		}
+		if len(ids) == 0 {
+			return count, nil
+		}
+
+		for _, id := range ids {
+			rewritten, err := s.reencryptProviderToken(id)
+			if err != nil {
+				return count, err
+			}
+			if rewritten {
+				count++
+			}
+		}
+	}
+}
+
+// reencryptProviderToken re-wraps the row with id under the active key while holding its lock, writing
+// only the credential columns. It returns false if the row was rewritten or removed in the meantime.
+func (s *Store) reencryptProviderToken(id uuid.UUID) (bool, error) {
+	rewritten := false
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var locked schema.ProviderToken
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", id).
+			Where("key_id IS NULL OR key_id <> ?", s.Keyring.ActiveID()).
+			First(&locked).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		token, err := s.decryptProviderToken(&locked)
+		if err != nil {
+			return err
+		}
+		encrypted, err := s.encryptProviderToken(token)
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&locked).Updates(map[string]interface{}{
+			"access_token":  encrypted.AccessToken,
+			"refresh_token": encrypted.RefreshToken,
+			"key_id":        encrypted.KeyID,
+			"wrapped_key":   encrypted.WrappedKey,
+		}).Error
+		if err != nil {
+			return err
+		}
+		rewritten = true
+		return nil
+	})
+	return rewritten, err
+}
+
+// encryptProviderToken returns a copy of token with the credentials sealed under a fresh data key
+func (s *Store) encryptProviderToken(token *schema.ProviderToken) (*schema.ProviderToken, error) {
+	if s.Keyring == nil {
+		return nil, ErrNoKeyring
+	}
+	dataKey, keyID, wrapped, err := s.Keyring.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := *token
+	aad := tokenAAD(token)
+	encrypted.AccessToken, err = keyring.Encrypt(dataKey, token.AccessToken, aad)
+	if err != nil {
+		return nil, err
+	}
+	encrypted.RefreshToken, err = keyring.Encrypt(dataKey, token.RefreshToken, aad)
+	if err != nil {
+		return nil, err
+	}
+	encrypted.KeyID = keyID
+	encrypted.WrappedKey = wrapped
+	return &encrypted, nil
+}
+
+// decryptProviderToken returns a plaintext copy of token; rows without a KeyID predate encryption
+func (s *Store) decryptProviderToken(token *schema.ProviderToken) (*schema.ProviderToken, error) {
+	if token.KeyID == "" {
+		return token, nil
+	}
+	if s.Keyring == nil {
+		return nil, ErrNoKeyring
+	}
+	dataKey, err := s.Keyring.UnwrapDataKey(token.KeyID, token.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted := *token
+	aad := tokenAAD(token)
+	decrypted.AccessToken, err = keyring.Decrypt(dataKey, token.AccessToken, aad)
+	if err != nil {
+		return nil, err
+	}
+	decrypted.RefreshToken, err = keyring.Decrypt(dataKey, token.RefreshToken, aad)
+	if err != nil {
+		return nil, err
+	}
+	return &decrypted, nil
+}
+
+// tokenAAD binds ciphertexts to their row so they cannot be swapped between users or providers
+func tokenAAD(token *schema.ProviderToken) string {
+	return token.UserID.String() + "/" + token.ProviderID.String()
+}
+
+// RefreshProviderToken locks the token row of userID for providerName across all replicas and passes the
+// decrypted token to refresh. refresh returns the replacement to persist, or nil if the current token is
+// still good (ie. another replica refreshed it while we waited for the lock).
+func (s *Store) RefreshProviderToken(userID uuid.UUID, providerName string, refresh func(current *schema.ProviderToken) (*schema.ProviderToken, error)) (*schema.ProviderToken, error) {
+	var result *schema.ProviderToken
+	err := s.DB.Transaction(func(tx *gorm.DB) error {
+		var locked schema.ProviderToken
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Table: clause.Table{Name: "provider_tokens"}}).
+			Joins("JOIN providers ON providers.id = provider_tokens.provider_id").
+			Where("provider_tokens.user_id = ?", userID).
+			Where("providers.name = ?", providerName).
+			First(&locked).Error
+		if err != nil {
+			return err
+		}
+
+		current, err := s.decryptProviderToken(&locked)
+		if err != nil {
+			return err
+		}
+		updated, err := refresh(current)
+		if err != nil {
+			return err
+		}
+		if updated == nil {
+			result = current
+			return nil
+		}
+
+		updated.ID = locked.ID
+		encrypted, err := s.encryptProviderToken(updated)
+		if err != nil {
+			return err
+		}
+		if err := tx.Save(encrypted).Error; err != nil {
+			return err
+		}
+		result = updated
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// TokenRef identifies a user's connection to a provider
+type TokenRef struct {
+	UserID       uuid.UUID
+	ProviderName string
+}
+
+// ListExpiringProviderTokens returns up to limit connections whose token expires before the given Unix time,
+// skipping tokens that do not expire and ones that need re-consent or whose last failed refresh was after retryAfter
+func (s *Store) ListExpiringProviderTokens(before int64, retryAfter int64, limit int) ([]TokenRef, error) {
+	var refs []TokenRef
+	err := s.DB.Model(&schema.ProviderToken{}).
+		Select("provider_tokens.user_id AS user_id, providers.name AS provider_name").
+		Joins("JOIN providers ON providers.id = provider_tokens.provider_id").
+		Where("provider_tokens.expiry <> 0 AND provider_tokens.expiry < ?", before).
+		Where("provider_tokens.needs_reconsent = ?", false).
+		Where("provider_tokens.refresh_failures = 0 OR provider_tokens.last_refresh_attempt < ?", retryAfter).
+		Order("provider_tokens.expiry").
+		Limit(limit).
+		Scan(&refs).Error
+	return refs, err
+}
+
+// RecordRefreshFailure notes a failed refresh on the user's token for providerName. needsReconsent marks
+// the connection as unusable until the user authorizes the provider again.
+func (s *Store) RecordRefreshFailure(userID uuid.UUID, providerName string, refreshErr error, needsReconsent bool) error {
+	return s.DB.Model(&schema.ProviderToken{}).
+		Where("user_id = ?", userID).
+		Where("provider_id = (?)", s.DB.Model(&schema.Provider{}).Select("id").Where("name = ?", providerName)).
+		Updates(map[string]interface{}{
+			"needs_reconsent":      gorm.Expr("needs_reconsent OR ?", needsReconsent),
+			"last_refresh_attempt": time.Now().Unix(),
+			"last_refresh_error":   refreshErr.Error(),
+			"refresh_failures":     gorm.Expr("refresh_failures + 1"),
+		}).Error
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+	"lorallabs.com/oauth-server/internal/keyring"
+	db "lorallabs.com/oauth-server/pkg/db"
+)
+
+func testKeyring(t *testing.T) *keyring.Keyring {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "token_keys.json")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	if err := os.WriteFile(path, []byte(`{"active":"k1","keys":{"k1":"`+key+`"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := keyring.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ring
+}
+
+func TestProviderTokenEncryption(t *testing.T) {
+	store := &Store{Keyring: testKeyring(t)}
+	token := &db.ProviderToken{UserID: uuid.New(), ProviderID: uuid.New(), AccessToken: "access", RefreshToken: "refresh"}
+	encrypted, err := store.encryptProviderToken(token)
+	if err != nil {
+		t.Fatalf("encryptProviderToken() error = %v", err)
+	}
+	if encrypted.AccessToken == token.AccessToken || encrypted.RefreshToken == token.RefreshToken || encrypted.KeyID != "k1" {
+		t.Fatalf("encryptProviderToken() = %+v, want sealed credentials under k1", encrypted)
+	}
+
+	otherUser := *encrypted
+	otherUser.UserID = uuid.New()
+	otherProvider := *encrypted
+	otherProvider.ProviderID = uuid.New()
+	plaintext := *token
+
+	tests := []struct {
+		name    string
+		store   *Store
+		token   *db.ProviderToken
+		wantErr bool
+		is      error // the error wantErr expects, if it is a sentinel
+	}{
+		{"same row", store, encrypted, false, nil},
+		{"copied to another user", store, &otherUser, true, nil},
+		{"copied to another provider", store, &otherProvider, true, nil},
+		{"stored before encryption", store, &plaintext, false, nil},
+		{"no keyring", &Store{}, encrypted, true, ErrNoKeyring},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decrypted, err := test.store.decryptProviderToken(test.token)
+			if (err != nil) != test.wantErr || (test.is != nil && !errors.Is(err, test.is)) {
+				t.Fatalf("decryptProviderToken() error = %v, want error %v", err, test.wantErr)
+			}
+			if test.wantErr {
+				return
+			}
+			if decrypted.AccessToken != "access" || decrypted.RefreshToken != "refresh" {
+				t.Errorf("decryptProviderToken() = %q, %q, want the original credentials", decrypted.AccessToken, decrypted.RefreshToken)
+			}
+		})
+	}
+}
+
+func TestSaveProviderTokenUpsert(t *testing.T) {
+	// DryRun builds the statements without sending them, so the recorded SQL is all SaveProviderToken would run
+	conn, err := gorm.Open(postgres.New(postgres.Config{Conn: sql.OpenDB(&stateDB{})}), &gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var statements []string
+	record := func(tx *gorm.DB) { statements = append(statements, tx.Statement.SQL.String()) }
+	conn.Callback().Create().After("gorm:create").Register("test:record", record)
+	conn.Callback().Query().After("gorm:query").Register("test:record", record)
+
+	store := &Store{DB: conn, Keyring: testKeyring(t)}
+	if err := store.SaveProviderToken(&db.ProviderToken{UserID: uuid.New(), ProviderID: uuid.New(), AccessToken: "access"}); err != nil {
+		t.Fatalf("SaveProviderToken() error = %v", err)
+	}
+	if len(statements) != 1 {
+		t.Fatalf("SaveProviderToken() ran %d statements, want a single upsert: %q", len(statements), statements)
+	}
+	for _, want := range []string{
+		`INSERT INTO "provider_tokens"`,
+		`ON CONFLICT ("user_id","provider_id")`,
+		`WHERE deleted_at IS NULL DO UPDATE SET`,
+		`"access_token"=EXCLUDED.access_token`,
+		`"refresh_failures"=$`,
+		`RETURNING "id"`,
+	} {
+		if !strings.Contains(statements[0], want) {
+			t.Errorf("SaveProviderToken() SQL = %s, want it to contain %s", statements[0], want)
+		}
+	}
+
+	// the conflict target only works against a unique index on the same columns and predicate
+	parsed, err := schema.Parse(&db.ProviderToken{}, &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := parsed.LookIndex("idx_provider_tokens_user_provider")
+	if index == nil || index.Class != "UNIQUE" || index.Where != "deleted_at IS NULL" || len(index.Fields) != 2 ||
+		index.Fields[0].DBName != "user_id" || index.Fields[1].DBName != "provider_id" {
+		t.Errorf("unique index = %+v, want (user_id, provider_id) WHERE deleted_at IS NULL", index)
+	}
+}
@@ -0,0 +1,458 @@
+package tools
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"lorallabs.com/oauth-server/internal/apispec"
+)
+
+const (
+	// BodyArgument is the argument holding the JSON request body of an operation
+	BodyArgument = "body"
+
+	maxNameLength        = 64
+	maxDescriptionLength = 1024
+	// maxSchemaDepth cuts off recursive schemas, which JSON schema tool definitions cannot reference
+	maxSchemaDepth = 8
+)
+
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// Tool is a provider operation described as a function an LLM can call
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  map[string]interface{} // JSON schema of the arguments object
+
+	Operation *apispec.Operation
+	arguments map[string]*openapi3.Parameter // argument name to the parameter it fills, the body is not listed
+}
+
+// FromSpecs returns a tool for every operation of specs, sorted by name
+func FromSpecs(specs []*apispec.Spec) []*Tool {
+	var tools []*Tool
+	byName := make(map[string][]*Tool)
+	for _, spec := range specs {
+		for _, op := range spec.Operations {
+			tool := FromOperation(op)
+			tools = append(tools, tool)
+			byName[tool.Name] = append(byName[tool.Name], tool)
+		}
+	}
+	// operations whose names only differ in characters tools cannot have are told apart by a hash
+	for name, named := range byName {
+		if len(named) > 1 {
+			for _, tool := range named {
+				tool.Name = hashSuffixed(name, tool.Operation)
+			}
+		}
+	}
+	sort.Slice(tools, func(i, j int) bool { return tools[i].Name < tools[j].Name })
+	return tools
+}
+
+// FromOperation describes op as a tool whose arguments are its path, query and header params,
+// plus BodyArgument for a JSON request body
+func FromOperation(op *apispec.Operation) *Tool {
+	tool := &Tool{
+		Name:        toolName(op),
+		Description: description(op),
+		Operation:   op,
+		arguments:   make(map[string]*openapi3.Parameter),
+	}
+
+	properties := make(map[string]interface{})
+	var required []string
+	for _, p := range parameters(op) {
+		if p.In == openapi3.ParameterInCookie {
+			continue
+		}
+		name := p.Name
+		if _, taken := properties[name]; taken || name == BodyArgument {
+			name = p.Name + "_" + p.In
+		}
+		schema := jsonSchema(p.Schema, 0)
+		if p.Description != "" {
+			schema["description"] = p.Description
+		}
+		properties[name] = schema
+		tool.arguments[name] = p
+		if p.Required {
+			required = append(required, name)
+		}
+	}
+
+	if body := op.Operation.RequestBody; body != nil && body.Value != nil {
+		if media := body.Value.Content.Get("application/json"); media != nil {
+			schema := jsonSchema(media.Schema, 0)
+			if body.Value.Description != "" {
+				schema["description"] = body.Value.Description
+			}
+			properties[BodyArgument] = schema
+			if body.Value.Required {
+				required = append(required, BodyArgument)
+			}
+		}
+	}
+
+	tool.Parameters = map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		tool.Parameters["required"] = required
+	}
+	return tool
+}
+
+// OpenAI formats tools for the OpenAI chat completions and responses APIs
+func OpenAI(tools []*Tool) []map[string]interface{} {
+	defs := make([]map[string]interface{}, len(tools))
+	for i, tool := range tools {
+		defs[i] = map[string]interface{}{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        tool.Name,
+				"description": tool.Description,
+				"parameters":  tool.Parameters,
+			},
+		}
+	}
+	return defs
+}
+
+// Anthropic formats tools for the Anthropic messages API
+func Anthropic(tools []*Tool) []map[string]interface{} {
+	defs := make([]map[string]interface{}, len(tools))
+	for i, tool := range tools {
+		defs[i] = map[string]interface{}{
+			"name":         tool.Name,
+			"description":  tool.Description,
+			"input_schema": tool.Parameters,
+		}
+	}
+	return defs
+}
+
+// Call is an execute request built from tool arguments
+type Call struct {
+	Method string
+	Path   string // under /{provider}/execute, with the path params filled in
+	Query  url.Values
+	Header http.Header
+	Body   []byte // JSON, nil without a body argument
+}
+
+// Result is the outcome of a tool call, to hand back to the model
+type Result struct {
+	Name        string      `json:"name"`
+	Status      int         `json:"status"`
+	IsError     bool        `json:"is_error"`
+	ContentType string      `json:"content_type,omitempty"`
+	Content     interface{} `json:"content"`             // parsed JSON, or the raw body as a string
+	Truncated   bool        `json:"truncated,omitempty"` // the body was cut off at the size limit, Content is a string
+}
+
+// BuildCall turns tool arguments into the request a client of the execute proxy would send for the
+// operation, serializing each argument the way its parameter's style expects
+func (t *Tool) BuildCall(args map[string]interface{}) (*Call, error) {
+	op := t.Operation
+	call := &Call{Method: op.Method, Path: op.Path, Query: url.Values{}, Header: http.Header{}}
+
+	for name, p := range t.arguments {
+		value, ok := args[name]
+		if !ok || value == nil {
+			if p.Required {
+				return nil, fmt.Errorf("missing required argument %q", name)
+			}
+			continue
+		}
+		method, err := p.SerializationMethod()
+		if err != nil {
+			return nil, err
+		}
+		switch p.In {
+		case openapi3.ParameterInPath:
+			call.Path = strings.ReplaceAll(call.Path, "{"+p.Name+"}", pathValue(p.Name, method, value))
+		case openapi3.ParameterInHeader:
+			call.Header.Set(p.Name, strings.Join(flatten(value), ","))
+		case openapi3.ParameterInQuery:
+			addQuery(call.Query, p.Name, method, value)
+		}
+	}
+
+	if body, ok := args[BodyArgument]; ok && body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		call.Body = raw
+	}
+	for name := range args {
+		if _, known := t.arguments[name]; !known && name != BodyArgument {
+			return nil, fmt.Errorf("unknown argument %q", name)
+		}
+	}
+	return call, nil
+}
+
+// addQuery adds a query argument in the serialization the execute proxy validates against
+func addQuery(query url.Values, name string, method *openapi3.SerializationMethod, value interface{}) {
+	object, isObject := value.(map[string]interface{})
+	switch {
+	case isObject && method.Style == openapi3.SerializationDeepObject:
+		for _, key := range sortedKeys(object) {
+			query.Add(name+"["+key+"]", scalar(object[key]))
+		}
+	case isObject && method.Explode:
+		for _, key := range sortedKeys(object) {
+			query.Add(key, scalar(object[key]))
+		}
+	case isObject:
+		var pairs []string
+		for _, key := range sortedKeys(object) {
+			pairs = append(pairs, key, scalar(object[key]))
+		}
+		query.Add(name, strings.Join(pairs, ","))
+	case method.Explode:
+		for _, item := range flatten(value) {
+			query.Add(name, item)
+		}
+	default:
+		separator := ","
+		switch method.Style {
+		case openapi3.SerializationSpaceDelimited:
+			separator = " "
+		case openapi3.SerializationPipeDelimited:
+			separator = "|"
+		}
+		query.Add(name, strings.Join(flatten(value), separator))
+	}
+}
+
+// pathValue serializes a path argument with the prefix and delimiters of its style, escaping each item
+func pathValue(name string, method *openapi3.SerializationMethod, value interface{}) string {
+	var items []string
+	object, isObject := value.(map[string]interface{})
+	if isObject {
+		for _, key := range sortedKeys(object) {
+			if method.Explode {
+				items = append(items, url.PathEscape(key)+"="+url.PathEscape(scalar(object[key])))
+			} else {
+				items = append(items, url.PathEscape(key), url.PathEscape(scalar(object[key])))
+			}
+		}
+	} else {
+		for _, item := range flatten(value) {
+			items = append(items, url.PathEscape(item))
+		}
+	}
+
+	switch method.Style {
+	case openapi3.SerializationLabel:
+		if method.Explode {
+			return "." + strings.Join(items, ".")
+		}
+		return "." + strings.Join(items, ",")
+	case openapi3.SerializationMatrix:
+		name = url.PathEscape(name)
+		switch {
+		case method.Explode && isObject:
+			return ";" + strings.Join(items, ";")
+		case method.Explode:
+			return ";" + name + "=" + strings.Join(items, ";"+name+"=")
+		}
+		return ";" + name + "=" + strings.Join(items, ",")
+	}
+	return strings.Join(items, ",")
+}
+
+// flatten returns the items of an array argument, or the argument itself
+func flatten(value interface{}) []string {
+	items, ok := value.([]interface{})
+	if !ok {
+		return []string{scalar(value)}
+	}
+	values := make([]string, len(items))
+	for i, item := range items {
+		values[i] = scalar(item)
+	}
+	return values
+}
+
+func scalar(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+	raw, _ := json.Marshal(value)
+	return string(raw)
+}
+
+// parameters returns the parameters of op, with operation level ones overriding path level ones
+func parameters(op *apispec.Operation) []*openapi3.Parameter {
+	var params []*openapi3.Parameter
+	seen := make(map[string]bool)
+	for _, list := range []openapi3.Parameters{op.Operation.Parameters, op.PathItem.Parameters} {
+		for _, ref := range list {
+			if ref == nil || ref.Value == nil || seen[ref.Value.In+":"+ref.Value.Name] {
+				continue
+			}
+			seen[ref.Value.In+":"+ref.Value.Name] = true
+			params = append(params, ref.Value)
+		}
+	}
+	return params
+}
+
+func toolName(op *apispec.Operation) string {
+	name := op.Operation.OperationID
+	if name == "" {
+		name = strings.ToLower(op.Method) + op.Path
+	}
+	name = invalidNameChars.ReplaceAllString(op.Provider+"_"+name, "_")
+	name = strings.Trim(name, "_")
+	if len(name) > maxNameLength {
+		name = hashSuffixed(name, op)
+	}
+	return name
+}
+
+// hashSuffixed appends a short hash of op's method and path to name, shortening it to fit, so names that
+// were truncated or collide stay unique and stable
+func hashSuffixed(name string, op *apispec.Operation) string {
+	sum := sha256.Sum256([]byte(op.Provider + " " + op.Method + " " + op.Path))
+	suffix := "_" + hex.EncodeToString(sum[:4])
+	if len(name) > maxNameLength-len(suffix) {
+		name = name[:maxNameLength-len(suffix)]
+	}
+	return name + suffix
+}
+
+func description(op *apispec.Operation) string {
+	parts := []string{op.Method + " " + op.Path + " on " + op.Provider + "."}
+	if summary := strings.TrimSpace(op.Operation.Summary); summary != "" {
+		if !strings.HasSuffix(summary, ".") {
+			summary += "."
+		}
+		parts = append(parts, summary)
+	}
+	if op.Operation.Description != "" {
+		parts = append(parts, op.Operation.Description)
+	}
+	d := strings.Join(parts, " ")
+	if len(d) > maxDescriptionLength {
+		d = strings.ToValidUTF8(d[:maxDescriptionLength-3], "") + "..."
+	}
+	return d
+}
+
+// jsonSchema converts an OpenAPI schema to plain JSON schema with every $ref inlined
+func jsonSchema(ref *openapi3.SchemaRef, depth int) map[string]interface{} {
+	schema := make(map[string]interface{})
+	if ref == nil || ref.Value == nil || depth > maxSchemaDepth {
+		return schema
+	}
+	s := ref.Value
+
+	if s.Type != "" {
+		if s.Nullable {
+			schema["type"] = []string{s.Type, "null"}
+		} else {
+			schema["type"] = s.Type
+		}
+	}
+	if s.Description != "" {
+		schema["description"] = s.Description
+	}
+	if s.Format != "" {
+		schema["format"] = s.Format
+	}
+	if len(s.Enum) > 0 {
+		schema["enum"] = s.Enum
+	}
+	if s.Default != nil {
+		schema["default"] = s.Default
+	}
+	if s.Pattern != "" {
+		schema["pattern"] = s.Pattern
+	}
+	if s.Min != nil {
+		schema["minimum"] = *s.Min
+	}
+	if s.Max != nil {
+		schema["maximum"] = *s.Max
+	}
+	if s.MinLength > 0 {
+		schema["minLength"] = s.MinLength
+	}
+	if s.MaxLength != nil {
+		schema["maxLength"] = *s.MaxLength
+	}
+	if s.MinItems > 0 {
+		schema["minItems"] = s.MinItems
+	}
+	if s.MaxItems != nil {
+		schema["maxItems"] = *s.MaxItems
+	}
+	if s.Items != nil {
+		schema["items"] = jsonSchema(s.Items, depth+1)
+	}
+	if len(s.Properties) > 0 {
+		properties := make(map[string]interface{}, len(s.Properties))
+		for name, property := range s.Properties {
+			if property != nil && property.Value != nil && property.Value.ReadOnly {
+				continue
+			}
+			properties[name] = jsonSchema(property, depth+1)
+		}
+		schema["properties"] = properties
+	}
+	if len(s.Required) > 0 {
+		var required []string
+		for _, name := range s.Required {
+			// read only properties were dropped above, the caller cannot send them
+			if property := s.Properties[name]; property == nil || property.Value == nil || !property.Value.ReadOnly {
+				required = append(required, name)
+			}
+		}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+	}
+	if s.AdditionalProperties.Schema != nil {
+		schema["additionalProperties"] = jsonSchema(s.AdditionalProperties.Schema, depth+1)
+	}
+	for keyword, refs := range map[string]openapi3.SchemaRefs{"oneOf": s.OneOf, "anyOf": s.AnyOf, "allOf": s.AllOf} {
+		if len(refs) == 0 {
+			continue
+		}
+		schemas := make([]interface{}, len(refs))
+		for i, r := range refs {
+			schemas[i] = jsonSchema(r, depth+1)
+		}
+		schema[keyword] = schemas
+	}
+	return schema
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
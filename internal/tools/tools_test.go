@@ -0,0 +1,289 @@
+package tools
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"lorallabs.com/oauth-server/internal/apispec"
+)
+
+// operation is an operation of the "shop" provider declaring params
+func operation(method, path, operationID string, params ...*openapi3.Parameter) *apispec.Operation {
+	op := openapi3.NewOperation()
+	op.OperationID = operationID
+	for _, p := range params {
+		op.AddParameter(p)
+	}
+	return &apispec.Operation{Provider: "shop", Path: path, Method: method, PathItem: &openapi3.PathItem{}, Operation: op}
+}
+
+func styled(p *openapi3.Parameter, style string, explode bool, schema *openapi3.Schema) *openapi3.Parameter {
+	p.Style = style
+	p.Explode = &explode
+	p.Schema = schema.NewRef()
+	return p
+}
+
+func TestToolName(t *testing.T) {
+	long := strings.Repeat("a", 80)
+
+	tests := []struct {
+		name string
+		op   *apispec.Operation
+		want string
+	}{
+		{"operation id", operation(http.MethodGet, "/products", "listProducts"), "shop_listProducts"},
+		{"method and path", operation(http.MethodGet, "/products/{id}", ""), "shop_get_products_id"},
+		{"invalid characters", operation(http.MethodPost, "/v1.2/orders", "orders.create!"), "shop_orders_create"},
+		{"truncated with a hash", operation(http.MethodGet, "/"+long, ""), "shop_get_" + long[:46] + "_" + hashOf("shop GET /"+long)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := toolName(tt.op)
+			if got != tt.want {
+				t.Errorf("toolName() = %q, want %q", got, tt.want)
+			}
+			if len(got) > maxNameLength {
+				t.Errorf("toolName() is %d characters long, want at most %d", len(got), maxNameLength)
+			}
+		})
+	}
+}
+
+func hashOf(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:4])
+}
+
+func TestFromSpecsSeparatesCollidingNames(t *testing.T) {
+	dotted := operation(http.MethodGet, "/a.b", "")
+	underscored := operation(http.MethodGet, "/a_b", "")
+	other := operation(http.MethodGet, "/c", "")
+	tools := FromSpecs([]*apispec.Spec{{Provider: "shop", Operations: []*apispec.Operation{dotted, underscored, other}}})
+
+	names := make(map[*apispec.Operation]string)
+	for _, tool := range tools {
+		names[tool.Operation] = tool.Name
+	}
+	if names[dotted] == names[underscored] {
+		t.Fatalf("colliding operations share the name %q", names[dotted])
+	}
+	for _, op := range []*apispec.Operation{dotted, underscored} {
+		if !strings.HasPrefix(names[op], "shop_get_a_b_") {
+			t.Errorf("name = %q, want it hash suffixed", names[op])
+		}
+	}
+	if names[other] != "shop_get_c" {
+		t.Errorf("name = %q, want the unique name left alone", names[other])
+	}
+	for i := 1; i < len(tools); i++ {
+		if tools[i-1].Name > tools[i].Name {
+			t.Errorf("tools are not sorted by name: %q before %q", tools[i-1].Name, tools[i].Name)
+		}
+	}
+}
+
+func TestFromOperationArguments(t *testing.T) {
+	op := operation(http.MethodPost, "/items/{id}", "updateItem",
+		openapi3.NewPathParameter("id").WithSchema(openapi3.NewStringSchema()).WithRequired(true),
+		openapi3.NewQueryParameter("id").WithSchema(openapi3.NewStringSchema()),
+		openapi3.NewQueryParameter("body").WithSchema(openapi3.NewStringSchema()),
+		openapi3.NewHeaderParameter("X-Trace").WithSchema(openapi3.NewStringSchema()),
+		openapi3.NewCookieParameter("session").WithSchema(openapi3.NewStringSchema()),
+	)
+	op.Operation.RequestBody = &openapi3.RequestBodyRef{Value: openapi3.NewRequestBody().
+		WithRequired(true).WithJSONSchema(openapi3.NewObjectSchema())}
+
+	tool := FromOperation(op)
+	properties := tool.Parameters["properties"].(map[string]interface{})
+	var names []string
+	for name := range properties {
+		names = append(names, name)
+	}
+	for _, want := range []string{"id", "id_query", "body_query", "X-Trace", BodyArgument} {
+		if _, ok := properties[want]; !ok {
+			t.Errorf("argument %q missing, got %v", want, names)
+		}
+	}
+	if _, ok := properties["session"]; ok {
+		t.Error("cookie parameter is an argument, want it skipped")
+	}
+	if want := []string{BodyArgument, "id"}; !reflect.DeepEqual(tool.Parameters["required"], want) {
+		t.Errorf("required = %v, want %v", tool.Parameters["required"], want)
+	}
+}
+
+func TestBuildCall(t *testing.T) {
+	array := openapi3.NewArraySchema().WithItems(openapi3.NewStringSchema())
+	object := openapi3.NewObjectSchema().WithProperty("R", openapi3.NewIntegerSchema()).WithProperty("G", openapi3.NewIntegerSchema())
+	pathParam := func(style string, explode bool, schema *openapi3.Schema) *openapi3.Parameter {
+		return styled(openapi3.NewPathParameter("id"), style, explode, schema).WithRequired(true)
+	}
+	queryParam := func(style string, explode bool, schema *openapi3.Schema) *openapi3.Parameter {
+		return styled(openapi3.NewQueryParameter("q"), style, explode, schema)
+	}
+	rgb := map[string]interface{}{"R": 1, "G": 2}
+	ab := []interface{}{"a", "b c"}
+
+	tests := []struct {
+		name      string
+		param     *openapi3.Parameter
+		args      map[string]interface{}
+		wantPath  string
+		wantQuery url.Values
+		wantErr   bool
+	}{
+		{"simple path", pathParam("simple", false, openapi3.NewStringSchema()), map[string]interface{}{"id": "a/b"}, "/items/a%2Fb", url.Values{}, false},
+		{"simple path array", pathParam("simple", false, array), map[string]interface{}{"id": ab}, "/items/a,b%20c", url.Values{}, false},
+		{"simple path exploded object", pathParam("simple", true, object), map[string]interface{}{"id": rgb}, "/items/G=2,R=1", url.Values{}, false},
+		{"label path", pathParam("label", false, openapi3.NewStringSchema()), map[string]interface{}{"id": "a"}, "/items/.a", url.Values{}, false},
+		{"label path array", pathParam("label", false, array), map[string]interface{}{"id": ab}, "/items/.a,b%20c", url.Values{}, false},
+		{"label path exploded array", pathParam("label", true, array), map[string]interface{}{"id": ab}, "/items/.a.b%20c", url.Values{}, false},
+		{"label path exploded object", pathParam("label", true, object), map[string]interface{}{"id": rgb}, "/items/.G=2.R=1", url.Values{}, false},
+		{"matrix path", pathParam("matrix", false, openapi3.NewStringSchema()), map[string]interface{}{"id": "a"}, "/items/;id=a", url.Values{}, false},
+		{"matrix path array", pathParam("matrix", false, array), map[string]interface{}{"id": ab}, "/items/;id=a,b%20c", url.Values{}, false},
+		{"matrix path exploded array", pathParam("matrix", true, array), map[string]interface{}{"id": ab}, "/items/;id=a;id=b%20c", url.Values{}, false},
+		{"matrix path object", pathParam("matrix", false, object), map[string]interface{}{"id": rgb}, "/items/;id=G,2,R,1", url.Values{}, false},
+		{"matrix path exploded object", pathParam("matrix", true, object), map[string]interface{}{"id": rgb}, "/items/;G=2;R=1", url.Values{}, false},
+		{"form query", queryParam("form", false, array), map[string]interface{}{"q": ab}, "/items/{id}", url.Values{"q": {"a,b c"}}, false},
+		{"form exploded query", queryParam("form", true, array), map[string]interface{}{"q": ab}, "/items/{id}", url.Values{"q": {"a", "b c"}}, false},
+		{"space delimited query", queryParam("spaceDelimited", false, array), map[string]interface{}{"q": ab}, "/items/{id}", url.Values{"q": {"a b c"}}, false},
+		{"pipe delimited query", queryParam("pipeDelimited", false, array), map[string]interface{}{"q": ab}, "/items/{id}", url.Values{"q": {"a|b c"}}, false},
+		{"form query object", queryParam("form", false, object), map[string]interface{}{"q": rgb}, "/items/{id}", url.Values{"q": {"G,2,R,1"}}, false},
+		{"form exploded query object", queryParam("form", true, object), map[string]interface{}{"q": rgb}, "/items/{id}", url.Values{"G": {"2"}, "R": {"1"}}, false},
+		{"deep object query", queryParam("deepObject", true, object), map[string]interface{}{"q": rgb}, "/items/{id}", url.Values{"q[G]": {"2"}, "q[R]": {"1"}}, false},
+		{"optional argument left out", queryParam("form", false, array), map[string]interface{}{}, "/items/{id}", url.Values{}, false},
+		{"required argument missing", pathParam("simple", false, openapi3.NewStringSchema()), map[string]interface{}{}, "", nil, true},
+		{"required argument null", pathParam("simple", false, openapi3.NewStringSchema()), map[string]interface{}{"id": nil}, "", nil, true},
+		{"unknown argument", queryParam("form", false, array), map[string]interface{}{"other": "x"}, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tool := FromOperation(operation(http.MethodGet, "/items/{id}", "getItem", tt.param))
+			call, err := tool.BuildCall(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("BuildCall() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if call.Path != tt.wantPath {
+				t.Errorf("Path = %q, want %q", call.Path, tt.wantPath)
+			}
+			if !reflect.DeepEqual(call.Query, tt.wantQuery) {
+				t.Errorf("Query = %v, want %v", call.Query, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestBuildCallHeaderAndBody(t *testing.T) {
+	op := operation(http.MethodPost, "/items", "createItem",
+		openapi3.NewHeaderParameter("X-Tags").WithSchema(openapi3.NewArraySchema().WithItems(openapi3.NewStringSchema())))
+	op.Operation.RequestBody = &openapi3.RequestBodyRef{Value: openapi3.NewRequestBody().WithJSONSchema(openapi3.NewObjectSchema())}
+
+	call, err := FromOperation(op).BuildCall(map[string]interface{}{
+		"X-Tags":     []interface{}{"a", "b"},
+		BodyArgument: map[string]interface{}{"name": "lamp"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call.Method != http.MethodPost {
+		t.Errorf("Method = %q, want %q", call.Method, http.MethodPost)
+	}
+	if got := call.Header.Get("X-Tags"); got != "a,b" {
+		t.Errorf("X-Tags = %q, want %q", got, "a,b")
+	}
+	if got := string(call.Body); got != `{"name":"lamp"}` {
+		t.Errorf("Body = %s, want %s", got, `{"name":"lamp"}`)
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	nullable := openapi3.NewStringSchema()
+	nullable.Nullable = true
+	readOnly := openapi3.NewStringSchema()
+	readOnly.ReadOnly = true
+	withReadOnly := openapi3.NewObjectSchema().WithProperty("id", readOnly).WithProperty("name", openapi3.NewStringSchema())
+	withReadOnly.Required = []string{"id", "name"}
+	onlyReadOnly := openapi3.NewObjectSchema().WithProperty("id", readOnly)
+	onlyReadOnly.Required = []string{"id"}
+
+	tests := []struct {
+		name   string
+		schema *openapi3.Schema
+		want   map[string]interface{}
+	}{
+		{"nullable", nullable, map[string]interface{}{"type": []string{"string", "null"}}},
+		{"read only property dropped", withReadOnly, map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{"name": map[string]interface{}{"type": "string"}},
+			"required":   []string{"name"},
+		}},
+		{"only read only properties", onlyReadOnly, map[string]interface{}{
+			"type":       "object",
+			"properties": map[string]interface{}{},
+		}},
+		{"array items", openapi3.NewArraySchema().WithItems(openapi3.NewIntegerSchema()), map[string]interface{}{
+			"type":  "array",
+			"items": map[string]interface{}{"type": "integer"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := jsonSchema(tt.schema.NewRef(), 0); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("jsonSchema() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONSchemaCutsOffRecursion(t *testing.T) {
+	node := openapi3.NewObjectSchema()
+	node.WithProperty("child", node)
+
+	schema := jsonSchema(node.NewRef(), 0)
+	depth := 0
+	for {
+		properties, ok := schema["properties"].(map[string]interface{})
+		if !ok {
+			break
+		}
+		schema = properties["child"].(map[string]interface{})
+		depth++
+	}
+	if depth != maxSchemaDepth+1 {
+		t.Errorf("nested %d levels deep, want %d", depth, maxSchemaDepth+1)
+	}
+	if len(schema) != 0 {
+		t.Errorf("schema past the cutoff = %v, want it empty", schema)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	tool := FromOperation(operation(http.MethodGet, "/products", "listProducts"))
+
+	openAI := OpenAI([]*Tool{tool})
+	function, _ := openAI[0]["function"].(map[string]interface{})
+	if openAI[0]["type"] != "function" || function["name"] != tool.Name || function["description"] != tool.Description {
+		t.Errorf("OpenAI() = %v, want a function named %q", openAI[0], tool.Name)
+	}
+	if !reflect.DeepEqual(function["parameters"], tool.Parameters) {
+		t.Errorf("OpenAI() parameters = %v, want %v", function["parameters"], tool.Parameters)
+	}
+
+	anthropic := Anthropic([]*Tool{tool})
+	if anthropic[0]["name"] != tool.Name || anthropic[0]["description"] != tool.Description {
+		t.Errorf("Anthropic() = %v, want a tool named %q", anthropic[0], tool.Name)
+	}
+	if !reflect.DeepEqual(anthropic[0]["input_schema"], tool.Parameters) {
+		t.Errorf("Anthropic() input_schema = %v, want %v", anthropic[0]["input_schema"], tool.Parameters)
+	}
+}
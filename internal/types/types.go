@@ -4,12 +4,17 @@ package types
 type ContextKey string
 
 const (
-	OryClientKey   ContextKey = "OryClient"
-	ConfigKey      ContextKey = "Config"
-	StoreKey       ContextKey = "Store"
-	BearerTokenKey ContextKey = "BearerToken"
-	OryUserIDKey   ContextKey = "OryUserID"
-	LaxAuthFlag    ContextKey = "LaxAuthFlag"
+	AuthServerKey    ContextKey = "AuthServer"
+	ConfigKey        ContextKey = "Config"
+	StoreKey         ContextKey = "Store"
+	BearerTokenKey   ContextKey = "BearerToken"
+	OryUserIDKey     ContextKey = "OryUserID"
+	OryClientIDKey   ContextKey = "OryClientID"
+	LaxAuthFlag      ContextKey = "LaxAuthFlag"
+	OAuthHandlerKey  ContextKey = "OAuthHandler"
+	DriftRecorderKey ContextKey = "DriftRecorder"
+	UpstreamKey      ContextKey = "Upstream"
+	RateLimiterKey   ContextKey = "RateLimiter"
 )
 
 // Patch Operation enum
@@ -0,0 +1,156 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"lorallabs.com/oauth-server/internal/config"
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultOpenFor          = 30 * time.Second
+)
+
+// BreakerState is the state of a circuit breaker
+type BreakerState string
+
+const (
+	// BreakerClosed lets every call through
+	BreakerClosed BreakerState = "closed"
+	// BreakerOpen fails every call fast until OpenFor has passed
+	BreakerOpen BreakerState = "open"
+	// BreakerHalfOpen lets a single probe through, which closes or re-opens the circuit
+	BreakerHalfOpen BreakerState = "half_open"
+)
+
+// ErrCircuitOpen is matched by errors.Is for every CircuitOpenError
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitOpenError is returned instead of calling a provider whose circuit is open
+type CircuitOpenError struct {
+	Provider   string
+	RetryAfter time.Duration // until a probe is allowed again
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s is failing, circuit breaker open for another %s", e.Provider, e.RetryAfter.Round(time.Millisecond))
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// BreakerStatus is a snapshot of a breaker for the status endpoint
+type BreakerStatus struct {
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	LastFailure         string       `json:"last_failure,omitempty"` // method, host and path with the kind of failure, never the query
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+	RetryAt             *time.Time   `json:"retry_at,omitempty"`
+}
+
+// Breaker opens after FailureThreshold consecutive failed calls to a provider, so an outage
+// fails requests immediately instead of making each one wait for its own timeout
+type Breaker struct {
+	provider  string
+	threshold int
+	openFor   time.Duration
+
+	mu          sync.Mutex
+	state       BreakerState
+	failures    int
+	lastFailure string
+	openedAt    time.Time
+	probing     bool // a half-open probe is in flight
+}
+
+func NewBreaker(provider string, c config.BreakerConfig) *Breaker {
+	return &Breaker{
+		provider:  provider,
+		threshold: orDefault(c.FailureThreshold, defaultFailureThreshold),
+		openFor:   orDefault(c.OpenFor, defaultOpenFor),
+		state:     BreakerClosed,
+	}
+}
+
+// Allow reports whether a call may go ahead, returning a *CircuitOpenError if not.
+// Every allowed call must be followed by exactly one Success, Failure or Cancel.
+func (b *Breaker) Allow() error {
+	if b.threshold < 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen {
+		if wait := time.Until(b.openedAt.Add(b.openFor)); wait > 0 {
+			return &CircuitOpenError{Provider: b.provider, RetryAfter: wait}
+		}
+		b.state = BreakerHalfOpen
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probing {
+			return &CircuitOpenError{Provider: b.provider, RetryAfter: time.Second}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Success closes the circuit
+func (b *Breaker) Success() {
+	if b.threshold < 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure counts a failed call, opening the circuit at the threshold or when a probe fails. reason is served
+// by the unauthenticated status endpoint, so it must not carry anything user specific.
+func (b *Breaker) Failure(reason string) {
+	if b.threshold < 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastFailure = reason
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+	b.probing = false
+}
+
+// Cancel releases an allowed call that ended without saying anything about the provider, ie. the client hung up
+func (b *Breaker) Cancel() {
+	if b.threshold < 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *Breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	status := BreakerStatus{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		LastFailure:         b.lastFailure,
+	}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		retryAt := b.openedAt.Add(b.openFor)
+		status.OpenedAt, status.RetryAt = &openedAt, &retryAt
+	}
+	return status
+}
@@ -0,0 +1,138 @@
+package upstream
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"lorallabs.com/oauth-server/internal/config"
+)
+
+func TestBreaker(t *testing.T) {
+	type step struct {
+		action    string // allow, success, failure, cancel or elapse (OpenFor passes)
+		wantOpen  bool   // for allow, whether ErrCircuitOpen is returned
+		wantState BreakerState
+	}
+	tests := []struct {
+		name      string
+		threshold int
+		steps     []step
+	}{
+		{
+			name:      "opens at the threshold",
+			threshold: 3,
+			steps: []step{
+				{action: "failure", wantState: BreakerClosed},
+				{action: "failure", wantState: BreakerClosed},
+				{action: "failure", wantState: BreakerOpen},
+				{action: "allow", wantOpen: true, wantState: BreakerOpen},
+			},
+		},
+		{
+			name:      "success resets the count",
+			threshold: 3,
+			steps: []step{
+				{action: "failure", wantState: BreakerClosed},
+				{action: "failure", wantState: BreakerClosed},
+				{action: "success", wantState: BreakerClosed},
+				{action: "failure", wantState: BreakerClosed},
+				{action: "failure", wantState: BreakerClosed},
+			},
+		},
+		{
+			name:      "probe succeeds",
+			threshold: 1,
+			steps: []step{
+				{action: "failure", wantState: BreakerOpen},
+				{action: "elapse", wantState: BreakerOpen},
+				{action: "allow", wantState: BreakerHalfOpen},
+				{action: "allow", wantOpen: true, wantState: BreakerHalfOpen},
+				{action: "success", wantState: BreakerClosed},
+				{action: "allow", wantState: BreakerClosed},
+			},
+		},
+		{
+			name:      "probe fails",
+			threshold: 3,
+			steps: []step{
+				{action: "failure"}, {action: "failure"}, {action: "failure", wantState: BreakerOpen},
+				{action: "elapse", wantState: BreakerOpen},
+				{action: "allow", wantState: BreakerHalfOpen},
+				{action: "failure", wantState: BreakerOpen},
+				{action: "allow", wantOpen: true, wantState: BreakerOpen},
+			},
+		},
+		{
+			name:      "cancelled probe",
+			threshold: 1,
+			steps: []step{
+				{action: "failure", wantState: BreakerOpen},
+				{action: "elapse", wantState: BreakerOpen},
+				{action: "allow", wantState: BreakerHalfOpen},
+				{action: "cancel", wantState: BreakerHalfOpen},
+				{action: "allow", wantState: BreakerHalfOpen},
+			},
+		},
+		{
+			name:      "disabled",
+			threshold: -1,
+			steps: []step{
+				{action: "failure", wantState: BreakerClosed},
+				{action: "failure", wantState: BreakerClosed},
+				{action: "allow", wantState: BreakerClosed},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewBreaker("github", config.BreakerConfig{FailureThreshold: test.threshold, OpenFor: time.Minute})
+			for i, step := range test.steps {
+				switch step.action {
+				case "allow":
+					err := b.Allow()
+					if errors.Is(err, ErrCircuitOpen) != step.wantOpen {
+						t.Fatalf("step %d: Allow() = %v, want open %v", i, err, step.wantOpen)
+					}
+				case "success":
+					b.Success()
+				case "failure":
+					b.Failure("GET api.github.com/user returned 503")
+				case "cancel":
+					b.Cancel()
+				case "elapse":
+					b.mu.Lock()
+					b.openedAt = b.openedAt.Add(-b.openFor)
+					b.mu.Unlock()
+				}
+				if step.wantState != "" {
+					if state := b.Status().State; state != step.wantState {
+						t.Fatalf("step %d (%s): state = %s, want %s", i, step.action, state, step.wantState)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerStatus(t *testing.T) {
+	b := NewBreaker("github", config.BreakerConfig{FailureThreshold: 2, OpenFor: time.Minute})
+	if status := b.Status(); status.State != BreakerClosed || status.OpenedAt != nil || status.RetryAt != nil {
+		t.Errorf("Status() of a new breaker = %+v", status)
+	}
+
+	b.Failure("GET api.github.com/user: timeout")
+	b.Failure("GET api.github.com/user returned 502")
+	status := b.Status()
+	if status.State != BreakerOpen || status.ConsecutiveFailures != 2 || status.LastFailure != "GET api.github.com/user returned 502" {
+		t.Errorf("Status() = %+v", status)
+	}
+	if status.OpenedAt == nil || status.RetryAt == nil || status.RetryAt.Sub(*status.OpenedAt) != time.Minute {
+		t.Errorf("Status() opened at %v, retry at %v, want a minute apart", status.OpenedAt, status.RetryAt)
+	}
+
+	var openErr *CircuitOpenError
+	if err := b.Allow(); !errors.As(err, &openErr) || openErr.Provider != "github" || openErr.RetryAfter <= 0 || openErr.RetryAfter > time.Minute {
+		t.Errorf("Allow() = %v, want a CircuitOpenError for github", err)
+	}
+}
@@ -0,0 +1,139 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"lorallabs.com/oauth-server/internal/config"
+)
+
+const (
+	defaultTimeout               = 60 * time.Second
+	defaultDialTimeout           = 10 * time.Second
+	defaultTLSHandshakeTimeout   = 10 * time.Second
+	defaultResponseHeaderTimeout = 30 * time.Second
+	defaultIdleConnTimeout       = 90 * time.Second
+	defaultMaxIdleConns          = 32
+)
+
+// Clients holds one pooled HTTP client and circuit breaker per provider, shared by the execute proxy
+// and the token endpoint calls
+type Clients struct {
+	clients  map[string]*http.Client
+	breakers map[string]*Breaker
+}
+
+// NewClients builds an HTTP client for every configured provider
+func NewClients(providers []config.Provider) (*Clients, error) {
+	c := &Clients{
+		clients:  make(map[string]*http.Client, len(providers)),
+		breakers: make(map[string]*Breaker, len(providers)),
+	}
+	for _, p := range providers {
+		breaker := NewBreaker(p.Name, p.Breaker)
+		client, err := NewHTTPClient(p.HTTP)
+		if err != nil {
+			return nil, fmt.Errorf("building %s HTTP client: %w", p.Name, err)
+		}
+		client.Transport = newRetryTransport(client.Transport, breaker, p.Retry)
+		c.clients[p.Name] = client
+		c.breakers[p.Name] = breaker
+	}
+	return c, nil
+}
+
+// For returns the client of providerName, or a client with the default settings if it has none
+func (c *Clients) For(providerName string) *http.Client {
+	if client, ok := c.clients[providerName]; ok {
+		return client
+	}
+	client, _ := NewHTTPClient(config.HTTPConfig{})
+	return client
+}
+
+// Status returns the circuit breaker state of every provider
+func (c *Clients) Status() map[string]BreakerStatus {
+	status := make(map[string]BreakerStatus, len(c.breakers))
+	for name, breaker := range c.breakers {
+		status[name] = breaker.Status()
+	}
+	return status
+}
+
+// StatusHandler serves Status as JSON
+func (c *Clients) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(c.Status())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// NewHTTPClient returns a client with its own connection pool, configured by c, without retries.
+// Requests are still cancelled with their context, the timeouts only bound providers that hang.
+func NewHTTPClient(c config.HTTPConfig) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if c.ProxyURL != "" {
+		proxyURL, err := url.Parse(c.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy_url: %w", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CABundle != "" {
+		pem, err := os.ReadFile(c.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca_bundle: %w", err)
+		}
+		// trust the bundle on top of the system roots, so a corporate proxy CA does not break public providers
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_bundle %s contains no PEM certificates", c.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	maxIdleConns := orDefault(c.MaxIdleConns, defaultMaxIdleConns)
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   orDefault(c.DialTimeout, defaultDialTimeout),
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   orDefault(c.TLSHandshakeTimeout, defaultTLSHandshakeTimeout),
+		ResponseHeaderTimeout: orDefault(c.ResponseHeaderTimeout, defaultResponseHeaderTimeout),
+		IdleConnTimeout:       orDefault(c.IdleConnTimeout, defaultIdleConnTimeout),
+		ExpectContinueTimeout: time.Second,
+		// each provider is a handful of hosts, so the pool is sized per host
+		MaxIdleConns:        maxIdleConns,
+		MaxIdleConnsPerHost: maxIdleConns,
+		ForceAttemptHTTP2:   true,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   orDefault(c.Timeout, defaultTimeout),
+	}, nil
+}
+
+func orDefault[T int | time.Duration](value, fallback T) T {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,186 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"lorallabs.com/oauth-server/internal/config"
+)
+
+const (
+	defaultMaxAttempts    = 3
+	defaultInitialBackoff = 200 * time.Millisecond
+	defaultMaxBackoff     = 5 * time.Second
+)
+
+var defaultRetryStatuses = []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+type idempotentKey struct{}
+
+// WithIdempotent marks requests made with ctx as safe, or unsafe, to retry, see apispec.Operation.Idempotent.
+// Requests without it are never retried.
+func WithIdempotent(ctx context.Context, idempotent bool) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, idempotent)
+}
+
+func isIdempotent(req *http.Request) bool {
+	idempotent, _ := req.Context().Value(idempotentKey{}).(bool)
+	return idempotent
+}
+
+// retryTransport sends requests through the provider's circuit breaker and retries idempotent
+// requests that failed with a retryable status or a network error
+type retryTransport struct {
+	next    http.RoundTripper
+	breaker *Breaker
+
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	statuses       map[int]bool
+}
+
+func newRetryTransport(next http.RoundTripper, breaker *Breaker, c config.RetryConfig) *retryTransport {
+	statuses := c.Statuses
+	if len(statuses) == 0 {
+		statuses = defaultRetryStatuses
+	}
+	t := &retryTransport{
+		next:           next,
+		breaker:        breaker,
+		maxAttempts:    orDefault(c.MaxAttempts, defaultMaxAttempts),
+		initialBackoff: orDefault(c.InitialBackoff, defaultInitialBackoff),
+		maxBackoff:     orDefault(c.MaxBackoff, defaultMaxBackoff),
+		statuses:       make(map[int]bool, len(statuses)),
+	}
+	for _, status := range statuses {
+		t.statuses[status] = true
+	}
+	return t
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a body can only be replayed if the request knows how to rebuild it
+	retryable := t.maxAttempts > 1 && isIdempotent(req) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.try(req)
+		if !retryable || attempt >= t.maxAttempts || !t.shouldRetry(req, resp, err) {
+			return resp, err
+		}
+
+		wait := t.backoff(attempt)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				// relay a long Retry-After to the client rather than holding the request open
+				if retryAfter > t.maxBackoff {
+					return resp, nil
+				}
+				wait = retryAfter
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// try makes a single attempt, reporting its outcome to the breaker
+func (t *retryTransport) try(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.Allow(); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		t.breaker.Cancel()
+	case err != nil:
+		t.breaker.Failure(fmt.Sprintf("%s %s%s: %s", req.Method, req.URL.Host, req.URL.Path, errorClass(err)))
+	case resp.StatusCode >= 500:
+		t.breaker.Failure(fmt.Sprintf("%s %s%s returned %d", req.Method, req.URL.Host, req.URL.Path, resp.StatusCode))
+	default:
+		// 4xx, including 429, is the provider answering, not the provider failing
+		t.breaker.Success()
+	}
+	return resp, err
+}
+
+// errorClass names the kind of transport error without its text, which holds the full URL and query
+func errorClass(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "DNS lookup failed"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection closed"
+	case errors.As(err, &certErr):
+		return "TLS certificate rejected"
+	}
+	return "network error"
+}
+
+func (t *retryTransport) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil && !errors.Is(err, ErrCircuitOpen)
+	}
+	return t.statuses[resp.StatusCode]
+}
+
+// backoff returns the wait after the given attempt, doubling from initialBackoff with jitter so
+// concurrent retries spread out
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	wait := t.initialBackoff << (attempt - 1)
+	if wait > t.maxBackoff || wait <= 0 {
+		wait = t.maxBackoff
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// parseRetryAfter reads a Retry-After header in either delay-seconds or HTTP-date form
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		wait := time.Until(date)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
@@ -0,0 +1,192 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"lorallabs.com/oauth-server/internal/config"
+)
+
+// scriptedTransport answers each attempt with the next of its responses, a status code or an error,
+// recording the bodies it was sent
+type scriptedTransport struct {
+	responses []interface{}
+	header    http.Header // sent with every response
+	bodies    []string
+}
+
+func (s *scriptedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body := ""
+	if req.Body != nil {
+		raw, _ := io.ReadAll(req.Body)
+		body = string(raw)
+	}
+	s.bodies = append(s.bodies, body)
+	next := s.responses[0]
+	if len(s.responses) > 1 {
+		s.responses = s.responses[1:]
+	}
+	if err, ok := next.(error); ok {
+		return nil, err
+	}
+	return &http.Response{StatusCode: next.(int), Header: s.header.Clone(), Body: io.NopCloser(strings.NewReader("")), Request: req}, nil
+}
+
+func TestRetryTransport(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+	tests := []struct {
+		name         string
+		method       string
+		idempotent   bool
+		body         string
+		noGetBody    bool // the body cannot be replayed
+		responses    []interface{}
+		header       http.Header
+		wantAttempts int
+		wantStatus   int
+	}{
+		{"retries idempotent calls", http.MethodGet, true, "", false, []interface{}{503, 502, 200}, nil, 3, 200},
+		{"gives up after max attempts", http.MethodGet, true, "", false, []interface{}{503}, nil, 3, 503},
+		{"retries network errors", http.MethodGet, true, "", false, []interface{}{refused, 200}, nil, 2, 200},
+		{"never retries non idempotent calls", http.MethodPost, false, `{"a":1}`, false, []interface{}{503, 200}, nil, 1, 503},
+		{"replays the body", http.MethodPut, true, `{"a":1}`, false, []interface{}{429, 200}, nil, 2, 200},
+		{"body that cannot be replayed", http.MethodPut, true, `{"a":1}`, true, []interface{}{503, 200}, nil, 1, 503},
+		{"status not retried", http.MethodGet, true, "", false, []interface{}{500, 200}, nil, 1, 500},
+		{"client error", http.MethodGet, true, "", false, []interface{}{404, 200}, nil, 1, 404},
+		{"short Retry-After", http.MethodGet, true, "", false, []interface{}{429, 200}, http.Header{"Retry-After": {"0"}}, 2, 200},
+		{"long Retry-After is relayed", http.MethodGet, true, "", false, []interface{}{429, 200}, http.Header{"Retry-After": {"120"}}, 1, 429},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := &scriptedTransport{responses: test.responses, header: test.header}
+			breaker := NewBreaker("demo", config.BreakerConfig{FailureThreshold: 100})
+			transport := newRetryTransport(next, breaker, config.RetryConfig{InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+
+			ctx := WithIdempotent(context.Background(), test.idempotent)
+			var body io.Reader
+			if test.body != "" {
+				body = bytes.NewReader([]byte(test.body))
+			}
+			req, _ := http.NewRequestWithContext(ctx, test.method, "https://api.example.com/items", body)
+			if test.noGetBody {
+				req.GetBody = nil
+			}
+
+			resp, err := transport.RoundTrip(req)
+			if len(next.bodies) != test.wantAttempts {
+				t.Errorf("RoundTrip() made %d attempts, want %d", len(next.bodies), test.wantAttempts)
+			}
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			if resp.StatusCode != test.wantStatus {
+				t.Errorf("RoundTrip() = %d, want %d", resp.StatusCode, test.wantStatus)
+			}
+			for i, sent := range next.bodies {
+				if sent != test.body {
+					t.Errorf("attempt %d sent body %q, want %q", i+1, sent, test.body)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryTransportBreaker(t *testing.T) {
+	next := &scriptedTransport{responses: []interface{}{503}}
+	breaker := NewBreaker("demo", config.BreakerConfig{FailureThreshold: 2, OpenFor: time.Minute})
+	transport := newRetryTransport(next, breaker, config.RetryConfig{MaxAttempts: 5, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+
+	req, _ := http.NewRequestWithContext(WithIdempotent(context.Background(), true), http.MethodGet, "https://api.example.com/items?token=secret", nil)
+	_, err := transport.RoundTrip(req)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("RoundTrip() error = %v, want ErrCircuitOpen once the breaker opens", err)
+	}
+	if len(next.bodies) != 2 {
+		t.Errorf("RoundTrip() made %d attempts, want the retries to stop when the circuit opens after 2", len(next.bodies))
+	}
+	if status := breaker.Status(); status.LastFailure != "GET api.example.com/items returned 503" {
+		t.Errorf("LastFailure = %q, want the method, host, path and status only", status.LastFailure)
+	}
+}
+
+func TestRetryTransportCancelled(t *testing.T) {
+	next := &scriptedTransport{responses: []interface{}{503, 200}}
+	breaker := NewBreaker("demo", config.BreakerConfig{})
+	transport := newRetryTransport(next, breaker, config.RetryConfig{InitialBackoff: time.Minute, MaxBackoff: time.Minute})
+
+	ctx, cancel := context.WithTimeout(WithIdempotent(context.Background(), true), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.example.com/items", nil)
+	if _, err := transport.RoundTrip(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("RoundTrip() error = %v, want the deadline instead of waiting out the backoff", err)
+	}
+	if len(next.bodies) != 1 {
+		t.Errorf("RoundTrip() made %d attempts, want 1", len(next.bodies))
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	secretURL := "https://api.example.com/items?token=secret"
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"deadline", &url.Error{Op: "Get", URL: secretURL, Err: context.DeadlineExceeded}, "timeout"},
+		{"DNS", &url.Error{Op: "Get", URL: secretURL, Err: &net.DNSError{Name: "api.example.com", Err: "no such host"}}, "DNS lookup failed"},
+		{"refused", &url.Error{Op: "Get", URL: secretURL, Err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, "connection refused"},
+		{"reset", &url.Error{Op: "Get", URL: secretURL, Err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}, "connection closed"},
+		{"EOF", &url.Error{Op: "Get", URL: secretURL, Err: io.EOF}, "connection closed"},
+		{"certificate", &url.Error{Op: "Get", URL: secretURL, Err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}}, "TLS certificate rejected"},
+		{"other", fmt.Errorf("proxy said no to %s", secretURL), "network error"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := errorClass(test.err); got != test.want {
+				t.Errorf("errorClass() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{"", 0, false},
+		{"30", 30 * time.Second, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, ok := parseRetryAfter(test.value)
+			if got != test.want || ok != test.wantOK {
+				t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", test.value, got, ok, test.want, test.wantOK)
+			}
+		})
+	}
+
+	// an HTTP date in the future waits until then
+	got, ok := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if !ok || got <= 58*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter() of a date a minute away = %v, %v", got, ok)
+	}
+}
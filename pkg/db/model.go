@@ -20,19 +20,27 @@ type User struct {
 	Clients        []Client
 }
 
+// APIKey is a bearer token of the local identity backend, acting for a user through a client
 type APIKey struct {
 	ID        uuid.UUID `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()"`
-	Secret    string    `gorm:"unique"`
+	Secret    string    `gorm:"unique"` // SHA-256 of the key, hex encoded
 	ClientID  uuid.UUID // Foreign key for Client
+	UserID    uuid.UUID // user the key acts for
+	Scope     string    // space separated, empty for all of the client's scopes
+	ExpiresAt *time.Time
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
 }
 
+// Client is a Loral OAuth client registered with the local identity backend
 type Client struct {
-	ID           uuid.UUID `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()"`
-	Name         string    `gorm:"unique"`
-	UserID       uuid.UUID // Foreign key for User
+	ID           uuid.UUID  `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()"`
+	Name         string     `gorm:"unique"`
+	UserID       *uuid.UUID // Foreign key for User, unset for clients registered through /client/create
+	SecretHash   string     // SHA-256 of the client secret, hex encoded
+	Scope        string     // space separated
+	RedirectURIs []string   `gorm:"serializer:json"`
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
 	DeletedAt    gorm.DeletedAt `gorm:"index"`
@@ -58,14 +66,70 @@ type Provider struct {
 	ClientGrants   []ClientGrants  `gorm:"foreignKey:ProviderID"` // Explicitly define the foreign key relationship
 	ProviderTokens []ProviderToken `gorm:"foreignKey:ProviderID"` // Explicitly define the foreign key relationship
 }
+
+// ProviderToken credentials are encrypted at rest by the store, see store.SaveProviderToken
 type ProviderToken struct {
 	ID           uuid.UUID `gorm:"primaryKey;type:uuid;default:uuid_generate_v4()"`
 	AccessToken  string
 	RefreshToken string
-	Expiry       int64     // Unix time
-	UserID       uuid.UUID // Foreign key for User
-	ProviderID   uuid.UUID // Foreign key for Provider, assuming this is the missing link
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
-	DeletedAt    gorm.DeletedAt `gorm:"index"`
+	KeyID        string `gorm:"index"` // Key-encryption key that wrapped WrappedKey, empty for legacy plaintext rows
+	WrappedKey   []byte // Per-row data key, encrypted with KeyID
+	Expiry       int64  // Unix time, 0 for tokens that do not expire
+	Scope        string // scopes granted by the provider, space separated as returned
+	TokenType    string
+	UserID       uuid.UUID `gorm:"uniqueIndex:idx_provider_tokens_user_provider,where:deleted_at IS NULL"` // Foreign key for User
+	ProviderID   uuid.UUID `gorm:"uniqueIndex:idx_provider_tokens_user_provider,where:deleted_at IS NULL"` // Foreign key for Provider, one token per user and provider
+
+	NeedsReconsent     bool  `gorm:"not null;default:false"` // provider rejected the refresh token, the user must run /{provider}/auth again
+	LastRefreshAttempt int64 `gorm:"not null;default:0"`     // Unix time
+	LastRefreshError   string
+	RefreshFailures    int `gorm:"not null;default:0"` // consecutive failed refreshes
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+	DeletedAt          gorm.DeletedAt `gorm:"index"`
+}
+
+// OAuthState is a pending provider authorization, created by /{provider}/auth and
+// consumed exactly once by the provider callback
+type OAuthState struct {
+	Nonce             string `gorm:"primaryKey"`
+	ProviderName      string
+	UserID            uuid.UUID // Foreign key for User
+	ClientID          string    // Loral OAuth client that started the flow
+	ClientRedirectURI string
+	CodeVerifier      string // PKCE verifier sent with the code exchange
+	ExpiresAt         int64  `gorm:"index"` // Unix time
+	CreatedAt         time.Time
+}
+
+// AuthorizationCode is a code issued by the built-in authorization server, exchanged at most once
+type AuthorizationCode struct {
+	Code                string    `gorm:"primaryKey"` // SHA-256 of the code, hex encoded
+	ClientID            uuid.UUID // Foreign key for Client
+	UserID              uuid.UUID // Foreign key for User
+	RedirectURI         string
+	RedirectURISent     bool   `gorm:"not null;default:false"` // the request named RedirectURI, so the exchange must repeat it
+	Scope               string // space separated
+	CodeChallenge       string // PKCE, empty if the client sent none
+	CodeChallengeMethod string
+	ExpiresAt           int64 `gorm:"index"` // Unix time
+	CreatedAt           time.Time
+}
+
+// RefreshToken is a refresh token issued by the built-in authorization server, replaced on every use
+type RefreshToken struct {
+	Token     string    `gorm:"primaryKey"` // SHA-256 of the token, hex encoded
+	ClientID  uuid.UUID // Foreign key for Client
+	UserID    uuid.UUID // Foreign key for User
+	Scope     string    // space separated
+	ExpiresAt int64     `gorm:"index"` // Unix time
+	CreatedAt time.Time
+}
+
+// RateLimitBucket is a token bucket shared by every replica, see store.TakeRateLimitToken
+type RateLimitBucket struct {
+	Key       string    `gorm:"primaryKey"`
+	Tokens    float64   // tokens left as of UpdatedAt
+	Allowed   bool      // whether the last take succeeded
+	UpdatedAt time.Time `gorm:"index"`
 }
@@ -9,14 +9,22 @@ import (
 )
 
 func main() {
-	c := config.LoadConfig()
+	c, err := config.LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	s, err := store.NewStore(c.DBConnectionString)
+	s, err := store.NewStore(c.DBConnectionString, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	s.DB.Create(&schema.Provider{
-		Name: "kroger",
-	})
+	// create a row for every provider in the providers file that is not in the DB yet
+	for _, p := range c.Providers {
+		err := s.DB.Where(schema.Provider{Name: p.Name}).FirstOrCreate(&schema.Provider{}).Error
+		if err != nil {
+			log.Fatalf("Failed to add provider %s: %v", p.Name, err)
+		}
+		log.Printf("Provider %s registered", p.Name)
+	}
 }